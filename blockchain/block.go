@@ -1,6 +1,8 @@
 package blockchain
 
 import (
+  "context"
+  "errors"
   "log"
   "bytes"
   "encoding/gob"
@@ -49,29 +51,60 @@ func Deserialize(data []byte) *Block {
   return &block
 }
 
+// Same as Deserialize(), for data from peers that may be garbage
+func DecodeBlock(data []byte) (*Block, error) {
+  var block Block
+
+  decoder := gob.NewDecoder(bytes.NewReader(data))
+  if err := decoder.Decode(&block); err != nil {
+    return nil, err
+  }
+
+  for _, tx := range block.Transactions {
+    if tx == nil {
+      return nil, errors.New("Block has an empty transaction")
+    }
+  }
+
+  return &block, nil
+}
+
 /*---------------------------main---------------------------*/
 
 func CreateBlock(txs []*Transaction, prevHash []byte, height int) *Block {
+  block, err := CreateBlockContext(context.Background(), txs, prevHash, height)
+  Handle(err)
+
+  return block
+}
+
+// Like CreateBlock() but mining stops with ctx.Err() once ctx is done
+func CreateBlockContext(ctx context.Context, txs []*Transaction, prevHash []byte, height int) (*Block, error) {
   // Create block with only data and hash of previous block
   // other fields (hash, nonce) empty
   block := &Block{time.Now().Unix(), []byte{}, txs, prevHash, 0, height}
   pow := NewProofOfWork(block)
 
   // Get noncce and hash of block after mined
-  nonce, hash := pow.Run()
+  nonce, hash, err := pow.RunContext(ctx)
+  if err != nil {
+    return nil, err
+  }
 
   block.Hash = hash[:]
   block.Nonce = nonce
 
-  return block
+  return block, nil
 }
 
 func (b *Block) SerializeTransactions() []byte {
-  // Array of transaction IDs
+  // Whole txs, so the proof of work covers what they pay and not just their IDs
+  // (not tx.Serialize(), gob output depends on what else the process has
+  // encoded, so other nodes could not reproduce the root)
   var serializedTXs [][]byte
 
   for _, tx := range b.Transactions {
-    serializedTXs = append(serializedTXs, tx.Serialize())
+    serializedTXs = append(serializedTXs, tx.Canonical())
   }
 
   tree := NewMerkleTree(serializedTXs)
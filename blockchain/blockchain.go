@@ -1,6 +1,8 @@
 package blockchain
 
 import (
+  "context"
+  "encoding/binary"
   "fmt"
   "github.com/dgraph-io/badger"
   "os"
@@ -11,17 +13,37 @@ import (
   "crypto/ecdsa"
   "path/filepath"
   "strings"
+  "sync"
   "log"
 )
 
 const (
   dbPath = "./tmp/blocks_%s"
   genesisData = "First Transaction from Genesis"
+  // Raised whenever blocks stored by older versions stop being valid, e.g.
+  // when what merkle roots are built from changes
+  // 1: merkle roots are built from Transaction.Canonical()
+  // 2: tx IDs are hashes of Transaction.Canonical()
+  // 3: signatures cover the outputs a tx spends
+  chainVersion = 3
 )
 
+// Stored as "cv" -> chainVersion, chains without it predate versioning
+var versionKey = []byte("cv")
+
+// Returned by AddBlock for a block whose parent is not stored yet
+var ErrOrphanBlock = errors.New("Parent block is not known")
+
+// Returned by MineBlockContext when another block became the tip meanwhile
+var ErrStaleTip = errors.New("Tip changed while mining")
+
 type BlockChain struct{
-  LastHash []byte
+  lastHash []byte
   Database *badger.DB
+  Params   Params
+  // Held for reading lastHash and for moving the tip, which the network
+  // and the miner do from different goroutines
+  tipMu    sync.RWMutex
 }
 
 /*-------------------------------utils-------------------------------*/
@@ -59,17 +81,62 @@ func openDB(dir string, opts badger.Options) (*badger.DB, error) {
 	}
 }
 
+// Hash of the tip of the best chain
+func (chain *BlockChain) LastHash() []byte {
+  chain.tipMu.RLock()
+  defer chain.tipMu.RUnlock()
+
+  return chain.lastHash
+}
+
 /*-------------------------------main-------------------------------*/
 
-func (chain *BlockChain) AddBlock(block *Block) {
+// Store block, making it the tip if it is higher than the current one
+// Blocks are only stored after their parent, orphans return ErrOrphanBlock
+func (chain *BlockChain) AddBlock(block *Block) error {
+  return chain.addBlock(block, false)
+}
+
+// Store block only if it extends the tip and becomes the new one, returns
+// ErrStaleTip if it does not, so what depends on the tip (UTXO set, mempool)
+// can be updated with it
+func (chain *BlockChain) ExtendTip(block *Block) error {
+  return chain.addBlock(block, true)
+}
+
+func (chain *BlockChain) addBlock(block *Block, tipOnly bool) error {
   var lastHash []byte
   var lastBlockData [] byte
 
+  chain.tipMu.Lock()
+  defer chain.tipMu.Unlock()
+
+  if tipOnly && !bytes.Equal(block.PrevHash, chain.lastHash) {
+    return ErrStaleTip
+  }
+
   err := chain.Database.Update(func(txn *badger.Txn) error {
     if _, err := txn.Get(block.Hash); err == nil {
+      if tipOnly {
+        return ErrStaleTip
+      }
       return nil
     }
 
+    // Heights are not covered by the proof of work, a wrong one would leave
+    // gaps in the height index
+    if len(block.PrevHash) > 0 {
+      parent, err := getBlockTxn(txn, block.PrevHash)
+      if err == badger.ErrKeyNotFound {
+        return ErrOrphanBlock
+      }
+      Handle(err)
+
+      if block.Height != parent.Height+1 {
+        return fmt.Errorf("Block %x has height %d, its parent has %d", block.Hash, block.Height, parent.Height)
+      }
+    }
+
     // Add new block to database
     blockData := block.Serialize()
     err := txn.Set(block.Hash, blockData)
@@ -100,12 +167,14 @@ func (chain *BlockChain) AddBlock(block *Block) {
     if block.Height > lastBlock.Height {
       err = txn.Set([]byte("lh"), block.Hash)
       Handle(err)
-      chain.LastHash = block.Hash
+      Handle(indexMainChain(txn, block))
+      chain.lastHash = block.Hash
     }
 
     return nil
   })
-  Handle(err)
+
+  return err
 }
 
 func ( chain *BlockChain) GetBlock(blockHash []byte) (Block,error) {
@@ -132,24 +201,6 @@ func ( chain *BlockChain) GetBlock(blockHash []byte) (Block,error) {
   return block, nil
 }
 
-func (chain *BlockChain) GetBlockHashes() [][]byte {
-  var blocks [][]byte
-
-  iter := chain.Iterator()
-
-  for {
-    block := iter.Next()
-
-    blocks = append(blocks, block.Hash)
-
-    if len(block.PrevHash) == 0 {
-      break
-    }
-  }
-
-  return blocks
-}
-
 func (chain *BlockChain) GetBestHeight() int {
   var lastHash []byte
   var lastBlock Block
@@ -181,14 +232,26 @@ func (chain *BlockChain) GetBestHeight() int {
 }
 
 func (chain *BlockChain) MineBlock(transactions []*Transaction) *Block {
+  newBlock, err := chain.MineBlockContext(context.Background(), transactions)
+  Handle(err)
+
+  return newBlock
+}
+
+// Like MineBlock() but gives up with ctx.Err() once ctx is done, the chain
+// is left as it was
+func (chain *BlockChain) MineBlockContext(ctx context.Context, transactions []*Transaction) (*Block, error) {
   var lastHash []byte
   var lastHeight int
 
+  // Txs may spend outputs of txs earlier in the same block
+  pending := make(map[string]Transaction)
   for _, tx := range transactions {
-		if chain.VerifyTransaction(tx) != true {
-			log.Panic("Invalid Transaction")
-		}
-	}
+    if chain.VerifyTransactionWith(tx, pending) != true {
+      return nil, fmt.Errorf("Transaction %x is invalid", tx.ID)
+    }
+    pending[hex.EncodeToString(tx.ID)] = *tx
+  }
 
   // Get lastHash from database
   err := chain.Database.View(func(txn *badger.Txn) error { // error 1
@@ -217,22 +280,42 @@ func (chain *BlockChain) MineBlock(transactions []*Transaction) *Block {
   Handle(err) // Handle error 1
 
   // Create new block with hash retrieved from database
-  newBlock := CreateBlock(transactions, lastHash, lastHeight+1)
+  newBlock, err := CreateBlockContext(ctx, transactions, lastHash, lastHeight+1)
+  if err != nil {
+    return nil, err
+  }
+  if err := chain.Params.CheckBlock(newBlock); err != nil {
+    return nil, err
+  }
+
+  chain.tipMu.Lock()
+  defer chain.tipMu.Unlock()
 
   // Add new block to database and update lastHash
   err = chain.Database.Update(func(txn *badger.Txn) error { // error 3
+    // A block connected while mining has taken the place of the parent
+    if !bytes.Equal(chain.lastHash, newBlock.PrevHash) {
+      return ErrStaleTip
+    }
+
     err := txn.Set(newBlock.Hash, newBlock.Serialize()) // error 4
     Handle(err) // Handle error 4
 
     err = txn.Set([]byte("lh"), newBlock.Hash) // error 3
+    Handle(err)
 
-    chain.LastHash = newBlock.Hash
+    err = indexMainChain(txn, newBlock)
+
+    chain.lastHash = newBlock.Hash
 
     return err // error 3
   })
+  if err == ErrStaleTip {
+    return nil, err
+  }
   Handle(err) // Handle error 3
 
-  return newBlock
+  return newBlock, nil
 }
 
 // Only called for starting completely new chain
@@ -243,36 +326,56 @@ func InitBlockChain(address, nodeID string) *BlockChain { // miner's wallet pubK
     runtime.Goexit()
   }
 
-  var lastHash []byte
+  // Create genesis block with coinbase transaction
+  genesis := Genesis(CoinbaseTx(address, genesisData))
+  fmt.Println("Genesis created.")
 
-  // Open database
-  opts := badger.DefaultOptions(path)
+  chain, err := NewBlockChain(path, genesis)
+  Handle(err)
 
-  db, err := openDB(path, opts) // error 1
-  Handle(err) // Handle error 1
+  return chain
+}
 
-  err = db.Update(func(txn *badger.Txn) error { // error 2
-    // Create coinbase transaction
-    cbtx := CoinbaseTx(address, genesisData)
+// New chain stored in dir, starting with genesis
+// Chains of nodes that are to sync must share their genesis block, which is
+// why it is passed in, e.g. by simulated networks creating a chain per node
+func NewBlockChain(dir string, genesis *Block) (*BlockChain, error) {
+  if DBexists(dir) {
+    return nil, fmt.Errorf("blockchain already exists in %s", dir)
+  }
 
-    // Create genesis block with coinbase transaction
-    genesis := Genesis(cbtx)
-    fmt.Println("Genesis created.")
+  // Open database
+  opts := badger.DefaultOptions(dir)
+
+  db, err := openDB(dir, opts)
+  if err != nil {
+    return nil, err
+  }
 
+  err = db.Update(func(txn *badger.Txn) error {
     // Add block to database
-    err = txn.Set(genesis.Hash, genesis.Serialize()) // error 3
-    Handle(err) // Handle error 3
+    if err := txn.Set(genesis.Hash, genesis.Serialize()); err != nil {
+      return err
+    }
 
     // Set genesis block hash as last hash
-    err = txn.Set([]byte("lh"), genesis.Hash) // error 2
-    lastHash = genesis.Hash
+    if err := txn.Set([]byte("lh"), genesis.Hash); err != nil {
+      return err
+    }
 
-    return err // error 2
+    if err := txn.Set(versionKey, ToHex(chainVersion)); err != nil {
+      return err
+    }
+
+    return indexMainChain(txn, genesis)
   })
-  Handle(err) // error 2
+  if err != nil {
+    db.Close()
+    return nil, err
+  }
 
-  chain := BlockChain{lastHash, db}
-  return &chain
+  chain := BlockChain{lastHash: genesis.Hash, Database: db, Params: DefaultParams}
+  return &chain, nil
 }
 
 // Only called for continuing with existing chain
@@ -284,6 +387,7 @@ func ContinueBlockChain(nodeID string) *BlockChain { // miner's wallet pubKeyHas
   }
 
   var lastHash []byte
+  var version int64
 
   // Open database
   opts := badger.DefaultOptions(path)
@@ -292,6 +396,15 @@ func ContinueBlockChain(nodeID string) *BlockChain { // miner's wallet pubKeyHas
   Handle(err) // Handle error 1
 
   err = db.Update(func(txn *badger.Txn) error { // error 2
+    // Missing in chains created before versioning, which counts as 0
+    if item, err := txn.Get(versionKey); err == nil {
+      err = item.Value(func(val []byte) error {
+        version = int64(binary.BigEndian.Uint64(val))
+        return nil
+      })
+      Handle(err)
+    }
+
     item, err := txn.Get([]byte("lh")) // error 3
     Handle(err) // Handle error 3
 
@@ -306,8 +419,18 @@ func ContinueBlockChain(nodeID string) *BlockChain { // miner's wallet pubKeyHas
   })
   Handle(err) // Handle error 2
 
+  // Its blocks would fail proof of work or signature checks here and on other nodes
+  if version < chainVersion {
+    db.Close()
+    fmt.Printf("Blockchain in %s was created by an older version (%d, current is %d).\n", path, version, chainVersion)
+    fmt.Println("Remove it and call 'InitBlockChain' to create a new one.")
+    runtime.Goexit()
+  }
+
   // Set LastHash instance
-  chain := BlockChain{lastHash, db}
+  chain := BlockChain{lastHash: lastHash, Database: db, Params: DefaultParams}
+  chain.indexHeights()
+
   return &chain
 }
 
@@ -345,6 +468,7 @@ func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
         outs := UTXO[txID]
         // Modify map
         outs.Outputs = append(outs.Outputs, out)
+        outs.Indexes = append(outs.Indexes, outIdx)
         // Set map
         UTXO[txID] = outs
       }
@@ -376,7 +500,26 @@ func (bc *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
   return Transaction{}, errors.New("Transaction does not exist")
 }
 
-func (bc *BlockChain) SignTransaction(tx *Transaction, privateKey ecdsa.PrivateKey) {
+// Outputs spent by each input of tx, in input order
+func (bc *BlockChain) PrevOutputs(tx *Transaction) ([]TxOutput, error) {
+  var outputs []TxOutput
+
+  for _, in := range tx.Inputs {
+    prevTX, err := bc.FindTransaction(in.ID)
+    if err != nil {
+      return nil, err
+    }
+    if in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+      return nil, fmt.Errorf("Output %d of transaction %x does not exist", in.Out, in.ID)
+    }
+    outputs = append(outputs, prevTX.Outputs[in.Out])
+  }
+
+  return outputs, nil
+}
+
+// Keys are private keys of input owners, see SigningKeys()
+func (bc *BlockChain) SignTransaction(tx *Transaction, keys map[string]ecdsa.PrivateKey) {
   prevTXs := make(map[string]Transaction)
 
   for _, in := range tx.Inputs {
@@ -385,21 +528,50 @@ func (bc *BlockChain) SignTransaction(tx *Transaction, privateKey ecdsa.PrivateK
     prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
   }
 
-  tx.Sign(privateKey, prevTXs)
+  tx.Sign(keys, prevTXs)
 }
 
 func (bc *BlockChain) VerifyTransaction(tx *Transaction) bool {
+  return bc.VerifyTransactionWith(tx, nil)
+}
+
+// Same as VerifyTransaction(), but inputs may also spend txs that are not
+// in the chain yet, e.g. earlier txs of the same block or mempool txs
+func (bc *BlockChain) VerifyTransactionWith(tx *Transaction, pending map[string]Transaction) bool {
   if tx.IsCoinbase() {
     return true
   }
 
+  // Spends a tx that does not exist (anymore), e.g. after a reorg
+  prevTXs, err := bc.FindPrevTXs(tx, pending)
+  if err != nil {
+    return false
+  }
+
+  return tx.Verify(prevTXs)
+}
+
+// Txs referenced by inputs of tx, looked up in pending first and then in the chain
+func (bc *BlockChain) FindPrevTXs(tx *Transaction, pending map[string]Transaction) (map[string]Transaction, error) {
   prevTXs := make(map[string]Transaction)
 
   for _, in := range tx.Inputs {
+    id := hex.EncodeToString(in.ID)
+    if _, ok := prevTXs[id]; ok {
+      continue
+    }
+
+    if prevTX, ok := pending[id]; ok {
+      prevTXs[id] = prevTX
+      continue
+    }
+
     prevTX, err := bc.FindTransaction(in.ID)
-    Handle(err)
-    prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+    if err != nil {
+      return nil, err
+    }
+    prevTXs[id] = prevTX
   }
 
-  return tx.Verify(prevTXs)
+  return prevTXs, nil
 }
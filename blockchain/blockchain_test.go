@@ -0,0 +1,302 @@
+package blockchain
+
+import (
+  "bytes"
+  "io/ioutil"
+  "os"
+  "testing"
+
+  "github.com/LidoKing/learnBlockchain/blockchain/wallet"
+)
+
+/*-------------------------------utils-------------------------------*/
+
+// Chain in a temp dir whose genesis pays w, mined at a low difficulty
+func newTestChain(t *testing.T) (*BlockChain, *wallet.Wallet) {
+  t.Helper()
+
+  prevDifficulty := Difficulty
+  Difficulty = 4
+
+  dir, err := ioutil.TempDir("", "chain")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  w := wallet.MakeWallet()
+  chain, err := NewBlockChain(dir, Genesis(CoinbaseTx(string(w.Address()), "genesis")))
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  UTXOSet := UTXOSet{Blockchain: chain}
+  UTXOSet.Reindex()
+
+  t.Cleanup(func() {
+    chain.Database.Close()
+    os.RemoveAll(dir)
+    Difficulty = prevDifficulty
+  })
+
+  return chain, w
+}
+
+// Empty blocks on top of prev (a hash of chain), returns their hashes
+func extend(t *testing.T, chain *BlockChain, prev []byte, count int, address string) [][]byte {
+  t.Helper()
+
+  parent, err := chain.GetBlock(prev)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var hashes [][]byte
+  for i := 0; i < count; i++ {
+    block := CreateBlock([]*Transaction{NewCoinbaseTx(address, "", 0)}, prev, parent.Height+1+i)
+    if err := chain.AddBlock(block); err != nil {
+      t.Fatal(err)
+    }
+
+    hashes = append(hashes, block.Hash)
+    prev = block.Hash
+  }
+
+  return hashes
+}
+
+/*-------------------------------validation-------------------------------*/
+
+func TestCheckBlockTxs(t *testing.T) {
+  chain, w := newTestChain(t)
+  address := string(w.Address())
+  UTXOSet := UTXOSet{Blockchain: chain}
+
+  tx := NewTransaction(w, address, 5, &UTXOSet)
+  // Spends the same genesis output as tx
+  conflict := NewTransaction(w, address, 6, &UTXOSet)
+
+  badSig := *tx
+  badSig.Inputs = append([]TxInput(nil), tx.Inputs...)
+  badSig.Inputs[0].Sig = append([]byte(nil), tx.Inputs[0].Sig...)
+  badSig.Inputs[0].Sig[3] ^= 1
+
+  stranger := wallet.MakeWallet()
+  stolen := *tx
+  stolen.Inputs = append([]TxInput(nil), tx.Inputs...)
+  stolen.Inputs[0].PubKey = stranger.PublicKey
+
+  forged := *tx
+  forged.ID = conflict.ID
+
+  coinbase := NewCoinbaseTx(address, "", 0)
+  forgedCoinbase := *coinbase
+  forgedCoinbase.ID = tx.ID
+
+  genesis := chain.LastHash()
+
+  tests := []struct {
+    name  string
+    txs   []*Transaction
+    valid bool
+  }{
+    {"coinbase only", []*Transaction{NewCoinbaseTx(address, "", 0)}, true},
+    {"spend", []*Transaction{NewCoinbaseTx(address, "", 0), tx}, true},
+    {"no coinbase", []*Transaction{tx}, false},
+    {"two coinbases", []*Transaction{NewCoinbaseTx(address, "", 0), NewCoinbaseTx(address, "", 0)}, false},
+    {"coinbase pays more than subsidy", []*Transaction{NewCoinbaseTx(address, "", 1)}, false},
+    {"double spend in block", []*Transaction{NewCoinbaseTx(address, "", 0), tx, conflict}, false},
+    {"invalid signature", []*Transaction{NewCoinbaseTx(address, "", 0), &badSig}, false},
+    {"not the owner", []*Transaction{NewCoinbaseTx(address, "", 0), &stolen}, false},
+    {"forged ID", []*Transaction{NewCoinbaseTx(address, "", 0), &forged}, false},
+    {"forged coinbase ID", []*Transaction{&forgedCoinbase}, false},
+    {"tx twice", []*Transaction{NewCoinbaseTx(address, "", 0), tx, tx}, false},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      block := CreateBlock(test.txs, genesis, 1)
+
+      err := chain.CheckBlockTxs(block)
+      if test.valid && err != nil {
+        t.Fatalf("valid block refused: %s", err)
+      }
+      if !test.valid && err == nil {
+        t.Fatal("invalid block accepted")
+      }
+    })
+  }
+
+  // Heights are not covered by the proof of work
+  for _, height := range []int{0, 2, 1000} {
+    block := CreateBlock([]*Transaction{NewCoinbaseTx(address, "", 0)}, genesis, height)
+    if chain.CheckBlockTxs(block) == nil || chain.AddBlock(block) == nil {
+      t.Fatalf("block at height %d on genesis accepted", height)
+    }
+  }
+
+  // Output spent in an earlier block of the branch
+  first := CreateBlock([]*Transaction{NewCoinbaseTx(address, "", 0), tx}, genesis, 1)
+  if err := chain.AddBlock(first); err != nil {
+    t.Fatal(err)
+  }
+
+  again := CreateBlock([]*Transaction{NewCoinbaseTx(address, "", 0), conflict}, first.Hash, 2)
+  if err := chain.CheckBlockTxs(again); err == nil {
+    t.Fatal("output spent in the branch accepted again")
+  }
+
+  // Same spend on a competing branch is fine
+  sibling := CreateBlock([]*Transaction{NewCoinbaseTx(address, "", 0), conflict}, genesis, 1)
+  if err := chain.CheckBlockTxs(sibling); err != nil {
+    t.Fatalf("spend on other branch refused: %s", err)
+  }
+}
+
+func TestCheckTxIDs(t *testing.T) {
+  chain, w := newTestChain(t)
+  address := string(w.Address())
+  UTXOSet := UTXOSet{Blockchain: chain}
+
+  // Same content as the genesis coinbase, so the same ID
+  again := CreateBlock([]*Transaction{CoinbaseTx(address, "genesis")}, chain.LastHash(), 1)
+  if err := chain.CheckBlockTxs(again); err != nil {
+    t.Fatal(err)
+  }
+  if err := UTXOSet.CheckTxIDs(again); err == nil {
+    t.Fatal("ID of a tx with unspent outputs reused")
+  }
+
+  fresh := CreateBlock([]*Transaction{NewCoinbaseTx(address, "", 0)}, chain.LastHash(), 1)
+  if err := UTXOSet.CheckTxIDs(fresh); err != nil {
+    t.Fatal(err)
+  }
+}
+
+func TestExtendTip(t *testing.T) {
+  chain, w := newTestChain(t)
+  address := string(w.Address())
+  genesis := chain.LastHash()
+
+  first := CreateBlock([]*Transaction{NewCoinbaseTx(address, "", 0)}, genesis, 1)
+  if err := chain.ExtendTip(first); err != nil {
+    t.Fatal(err)
+  }
+  if !bytes.Equal(chain.LastHash(), first.Hash) {
+    t.Fatal("block did not become the tip")
+  }
+
+  // Sibling of the tip, or the tip again, does not become the tip
+  sibling := CreateBlock([]*Transaction{NewCoinbaseTx(address, "", 0)}, genesis, 1)
+  for _, block := range []*Block{sibling, first} {
+    if err := chain.ExtendTip(block); err != ErrStaleTip {
+      t.Fatalf("got %v, want ErrStaleTip", err)
+    }
+  }
+  if chain.HasBlock(sibling.Hash) {
+    t.Fatal("block that did not extend the tip was stored")
+  }
+}
+
+/*-------------------------------psbt-------------------------------*/
+
+func TestPartialTxInputValues(t *testing.T) {
+  chain, w := newTestChain(t)
+  address := string(w.Address())
+  UTXOSet := UTXOSet{Blockchain: chain}
+
+  psbt := CreatePartialTx([]string{address}, []Payment{{Address: address, Amount: 5}}, address, TxOptions{Fee: 1}, &UTXOSet)
+
+  decoded, err := DecodePartialTx(psbt.Encode())
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // Signer told the input is worth less, so the fee looks smaller than it is
+  lied, _ := DecodePartialTx(psbt.Encode())
+  lied.PrevOutputs[0].Value--
+
+  for _, test := range []struct {
+    name  string
+    psbt  *PartialTx
+    valid bool
+  }{
+    {"true values", decoded, true},
+    {"lied values", lied, false},
+  } {
+    if test.psbt.Sign([]*wallet.Wallet{w}) != 1 {
+      t.Fatalf("%s: input not signed", test.name)
+    }
+
+    tx, err := test.psbt.Finalize()
+    if err != nil {
+      t.Fatalf("%s: %s", test.name, err)
+    }
+
+    block := CreateBlock([]*Transaction{NewCoinbaseTx(address, "", 1), tx}, chain.LastHash(), 1)
+    if err := chain.CheckBlockTxs(block); test.valid != (err == nil) {
+      t.Fatalf("%s: valid %t, want %t (%v)", test.name, err == nil, test.valid, err)
+    }
+  }
+
+  // Another tx under the ID the signer is shown
+  forged := *psbt
+  forged.Tx.Outputs = []TxOutput{*NewTXOutput(1, address)}
+  if _, err := DeserializePartialTx(forged.Serialize()); err == nil {
+    t.Fatal("partially signed tx with a forged ID accepted")
+  }
+}
+
+/*-------------------------------locators-------------------------------*/
+
+func TestLocatorAfterReorg(t *testing.T) {
+  chain, w := newTestChain(t)
+  address := string(w.Address())
+  genesis := chain.LastHash()
+
+  main := extend(t, chain, genesis, 20, address)
+
+  locator := chain.BlockLocator()
+  if !bytes.Equal(locator[0], main[19]) || !bytes.Equal(locator[len(locator)-1], genesis) {
+    t.Fatal("locator does not run from tip to genesis")
+  }
+  if len(locator) >= 21 {
+    t.Fatalf("locator of 21 blocks has %d hashes, it should thin out", len(locator))
+  }
+
+  // Peer that stopped at height 5
+  peer := [][]byte{main[4], genesis}
+  if fork := chain.FindFork(peer); fork != 5 {
+    t.Fatalf("fork at %d, want 5", fork)
+  }
+
+  headers := chain.HeadersAfter(peer, nil, 3)
+  if len(headers) != 3 || !bytes.Equal(headers[0].Hash, main[5]) || !bytes.Equal(headers[2].PrevHash, main[6]) {
+    t.Fatal("wrong headers after fork")
+  }
+
+  if hashes := chain.HashesAfter(peer, main[6], 100); len(hashes) != 2 {
+    t.Fatalf("%d hashes up to stop, want 2", len(hashes))
+  }
+
+  // Longer branch off height 10 takes over
+  side := extend(t, chain, main[9], 12, address)
+  if !bytes.Equal(chain.LastHash(), side[11]) || chain.GetBestHeight() != 22 {
+    t.Fatal("longer branch did not become the tip")
+  }
+  if chain.IsMainChain(main[15]) || !chain.IsMainChain(main[5]) || !chain.IsMainChain(side[0]) {
+    t.Fatal("main chain index not updated after reorg")
+  }
+
+  // Peer still on the old branch forks off where the branches split
+  if fork := chain.FindFork([][]byte{main[19], main[15], main[7], genesis}); fork != 8 {
+    t.Fatalf("fork at %d, want 8", fork)
+  }
+  if fork := chain.FindFork([][]byte{[]byte("unknown")}); fork != -1 {
+    t.Fatalf("fork at %d for unknown locator, want -1", fork)
+  }
+
+  headers = chain.HeadersAfter([][]byte{main[19], main[9], genesis}, nil, 100)
+  if len(headers) != 12 || !bytes.Equal(headers[0].Hash, side[0]) {
+    t.Fatal("headers after reorg do not follow the new branch")
+  }
+}
@@ -10,7 +10,7 @@ type BlockChainIterator struct {
 
 // Turn blockchain struct to iterator struct
 func (chain *BlockChain) Iterator() *BlockChainIterator {
-  iter := &BlockChainIterator{chain.LastHash, chain.Database}
+  iter := &BlockChainIterator{chain.LastHash(), chain.Database}
 
   return iter
 }
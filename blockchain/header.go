@@ -0,0 +1,268 @@
+package blockchain
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "fmt"
+  "math/big"
+  "github.com/dgraph-io/badger"
+)
+
+// Everything needed to check the proof of work of a block without its txs
+type BlockHeader struct {
+  Timestamp   int64
+  Hash        []byte
+  PrevHash    []byte
+  MerkleRoot  []byte
+  Nonce       int
+  Height      int
+}
+
+// Main chain block hashes by height, stored as "hi-<height>" -> hash
+var heightPrefix = []byte("hi-")
+
+// Locators list this many hashes one by one before the steps start doubling
+const locatorDenseHashes = 10
+
+/*-------------------------------headers-------------------------------*/
+
+func (b *Block) Header() BlockHeader {
+  return BlockHeader{b.Timestamp, b.Hash, b.PrevHash, b.SerializeTransactions(), b.Nonce, b.Height}
+}
+
+func (h *BlockHeader) ValidatePoW() bool {
+  var intHash big.Int
+
+  hash := sha256.Sum256(powData(h.PrevHash, h.MerkleRoot, h.Nonce))
+  if !bytes.Equal(hash[:], h.Hash) {
+    return false
+  }
+
+  intHash.SetBytes(hash[:])
+  target := NewProofOfWork(&Block{}).Target
+
+  return intHash.Cmp(target) == -1
+}
+
+// Check that h has valid work and extends prev
+func (h *BlockHeader) Validate(prev *BlockHeader) error {
+  if !bytes.Equal(h.PrevHash, prev.Hash) {
+    return fmt.Errorf("Header %x does not follow %x", h.Hash, prev.Hash)
+  }
+
+  if h.Height != prev.Height+1 {
+    return fmt.Errorf("Header %x has height %d after %d", h.Hash, h.Height, prev.Height)
+  }
+
+  if !h.ValidatePoW() {
+    return fmt.Errorf("Header %x has invalid proof of work", h.Hash)
+  }
+
+  return nil
+}
+
+// Block is the one h was made for
+func (h *BlockHeader) Matches(b *Block) bool {
+  return bytes.Equal(h.Hash, b.Hash) &&
+    bytes.Equal(h.PrevHash, b.PrevHash) &&
+    h.Height == b.Height &&
+    bytes.Equal(h.MerkleRoot, b.SerializeTransactions())
+}
+
+/*-------------------------------height index-------------------------------*/
+
+func heightKey(height int) []byte {
+  return append(append([]byte{}, heightPrefix...), ToHex(int64(height))...)
+}
+
+func getBlockTxn(txn *badger.Txn, hash []byte) (*Block, error) {
+  item, err := txn.Get(hash)
+  if err != nil {
+    return nil, err
+  }
+
+  var block *Block
+  err = item.Value(func(val []byte) error {
+    block = Deserialize(val)
+    return nil
+  })
+
+  return block, err
+}
+
+// Point the heights of block and its ancestors at them, back to where the
+// index already agrees (the fork point when the tip moves to another branch)
+func indexMainChain(txn *badger.Txn, block *Block) error {
+  for {
+    key := heightKey(block.Height)
+
+    item, err := txn.Get(key)
+    if err == nil {
+      same := false
+      err = item.Value(func(val []byte) error {
+        same = bytes.Equal(val, block.Hash)
+        return nil
+      })
+      if err != nil || same {
+        return err
+      }
+    } else if err != badger.ErrKeyNotFound {
+      return err
+    }
+
+    if err := txn.Set(key, block.Hash); err != nil {
+      return err
+    }
+
+    if len(block.PrevHash) == 0 {
+      return nil
+    }
+
+    block, err = getBlockTxn(txn, block.PrevHash)
+    if err != nil {
+      return err
+    }
+  }
+}
+
+// Chains created before the index existed get it built on opening
+func (chain *BlockChain) indexHeights() {
+  tip, err := chain.GetBlock(chain.LastHash())
+  Handle(err)
+
+  if hash, err := chain.GetHashByHeight(tip.Height); err == nil && bytes.Equal(hash, tip.Hash) {
+    return
+  }
+
+  fmt.Println("Indexing block heights...")
+
+  // One block per db transaction, so long chains do not make it too big
+  iter := chain.Iterator()
+  for {
+    block := iter.Next()
+
+    err := chain.Database.Update(func(txn *badger.Txn) error {
+      return txn.Set(heightKey(block.Height), block.Hash)
+    })
+    Handle(err)
+
+    if len(block.PrevHash) == 0 {
+      break
+    }
+  }
+}
+
+func (chain *BlockChain) GetHashByHeight(height int) ([]byte, error) {
+  var hash []byte
+
+  err := chain.Database.View(func(txn *badger.Txn) error {
+    item, err := txn.Get(heightKey(height))
+    if err != nil {
+      return err
+    }
+
+    hash, err = item.ValueCopy(nil)
+    return err
+  })
+  if err == badger.ErrKeyNotFound {
+    return nil, fmt.Errorf("No block at height %d", height)
+  }
+
+  return hash, err
+}
+
+func (chain *BlockChain) GetBlockByHeight(height int) (Block, error) {
+  hash, err := chain.GetHashByHeight(height)
+  if err != nil {
+    return Block{}, err
+  }
+
+  return chain.GetBlock(hash)
+}
+
+func (chain *BlockChain) HasBlock(hash []byte) bool {
+  _, err := chain.GetBlock(hash)
+  return err == nil
+}
+
+// Block is stored and part of the chain ending in the current tip
+func (chain *BlockChain) IsMainChain(hash []byte) bool {
+  block, err := chain.GetBlock(hash)
+  if err != nil {
+    return false
+  }
+
+  indexed, err := chain.GetHashByHeight(block.Height)
+  return err == nil && bytes.Equal(indexed, hash)
+}
+
+/*-------------------------------locators-------------------------------*/
+
+// Hashes of main chain blocks from the tip back to genesis, dense near the
+// tip and sparse further back, so a peer can find where our chains fork
+func (chain *BlockChain) BlockLocator() [][]byte {
+  var locator [][]byte
+
+  step := 1
+  for height := chain.GetBestHeight(); height > 0; height -= step {
+    hash, err := chain.GetHashByHeight(height)
+    Handle(err)
+    locator = append(locator, hash)
+
+    if len(locator) >= locatorDenseHashes {
+      step *= 2
+    }
+  }
+
+  genesis, err := chain.GetHashByHeight(0)
+  Handle(err)
+
+  return append(locator, genesis)
+}
+
+// Height of the first locator hash on our main chain, -1 if there is none
+func (chain *BlockChain) FindFork(locator [][]byte) int {
+  for _, hash := range locator {
+    if chain.IsMainChain(hash) {
+      block, err := chain.GetBlock(hash)
+      Handle(err)
+      return block.Height
+    }
+  }
+
+  return -1
+}
+
+// Up to max main chain hashes following the fork with locator, ending early
+// at stop (may be empty)
+func (chain *BlockChain) HashesAfter(locator [][]byte, stop []byte, max int) [][]byte {
+  var hashes [][]byte
+
+  best := chain.GetBestHeight()
+  for height := chain.FindFork(locator) + 1; height <= best && len(hashes) < max; height++ {
+    hash, err := chain.GetHashByHeight(height)
+    Handle(err)
+
+    hashes = append(hashes, hash)
+
+    if bytes.Equal(hash, stop) {
+      break
+    }
+  }
+
+  return hashes
+}
+
+// Headers of the blocks HashesAfter() returns
+func (chain *BlockChain) HeadersAfter(locator [][]byte, stop []byte, max int) []BlockHeader {
+  var headers []BlockHeader
+
+  for _, hash := range chain.HashesAfter(locator, stop, max) {
+    block, err := chain.GetBlock(hash)
+    Handle(err)
+
+    headers = append(headers, block.Header())
+  }
+
+  return headers
+}
@@ -0,0 +1,83 @@
+package blockchain
+
+import (
+  "fmt"
+)
+
+// Consensus limits, a block or tx breaking any of them is invalid
+type Params struct {
+  // Serialized size in bytes
+  MaxBlockSize   int
+  MaxTxSize      int
+  // Per tx
+  MaxTxInputs    int
+  MaxTxOutputs   int
+  // Signature checks needed to verify all txs of a block, see SigOps()
+  MaxBlockSigOps int
+}
+
+var DefaultParams = Params{
+  MaxBlockSize:   1 << 20,
+  MaxTxSize:      100000,
+  MaxTxInputs:    2500,
+  MaxTxOutputs:   2500,
+  MaxBlockSigOps: 20000,
+}
+
+// Room left in a serialized block for everything but its txs (hash, nonce...)
+// Sizes of txs serialized on their own add up to more than the same txs
+// inside a block, so a block whose tx sizes fit into MaxTxsSize() is valid
+const blockHeaderAllowance = 256
+
+/*-------------------------------utils-------------------------------*/
+
+// Every input needs one signature check
+func (tx *Transaction) SigOps() int {
+  if tx.IsCoinbase() {
+    return 0
+  }
+  return len(tx.Inputs)
+}
+
+// Budget for the sum of tx.Size() of the txs of a block
+func (p Params) MaxTxsSize() int {
+  return p.MaxBlockSize - blockHeaderAllowance
+}
+
+/*-------------------------------main-------------------------------*/
+
+func (p Params) CheckTx(tx *Transaction) error {
+  if size := tx.Size(); size > p.MaxTxSize {
+    return fmt.Errorf("Transaction %x is %d bytes, max is %d", tx.ID, size, p.MaxTxSize)
+  }
+
+  if len(tx.Inputs) > p.MaxTxInputs {
+    return fmt.Errorf("Transaction %x has %d inputs, max is %d", tx.ID, len(tx.Inputs), p.MaxTxInputs)
+  }
+
+  if len(tx.Outputs) > p.MaxTxOutputs {
+    return fmt.Errorf("Transaction %x has %d outputs, max is %d", tx.ID, len(tx.Outputs), p.MaxTxOutputs)
+  }
+
+  return nil
+}
+
+func (p Params) CheckBlock(block *Block) error {
+  if size := len(block.Serialize()); size > p.MaxBlockSize {
+    return fmt.Errorf("Block %x is %d bytes, max is %d", block.Hash, size, p.MaxBlockSize)
+  }
+
+  sigOps := 0
+  for _, tx := range block.Transactions {
+    if err := p.CheckTx(tx); err != nil {
+      return err
+    }
+    sigOps += tx.SigOps()
+  }
+
+  if sigOps > p.MaxBlockSigOps {
+    return fmt.Errorf("Block %x needs %d signature checks, max is %d", block.Hash, sigOps, p.MaxBlockSigOps)
+  }
+
+  return nil
+}
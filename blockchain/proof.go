@@ -2,6 +2,7 @@ package blockchain
 
 import (
   "bytes"
+  "context"
   "crypto/sha256"
   "encoding/binary"
   "fmt"
@@ -11,7 +12,11 @@ import (
 )
 
 // Mining difficulty remains constant for simplicity
-const Difficulty = 18
+// All nodes must agree on it, only simulated networks lower it to mine fast
+var Difficulty = 18
+
+// Nonces tried between checks whether mining was cancelled
+const ctxCheckInterval = 1 << 12
 
 type ProofOfWork struct {
   Block *Block
@@ -40,10 +45,15 @@ func ToHex(num int64) []byte {
 
 // Create data that is combined with nonce for hashing
 func (pow *ProofOfWork) InitData(nonce int) []byte {
+  return powData(pow.Block.PrevHash, pow.Block.SerializeTransactions(), nonce)
+}
+
+// Hashed data only depends on these, so headers can be checked without txs
+func powData(prevHash, merkleRoot []byte, nonce int) []byte {
   data := bytes.Join(
     [][]byte{
-      pow.Block.PrevHash,
-      pow.Block.SerializeTransactions(),
+      prevHash,
+      merkleRoot,
       ToHex(int64(nonce)),
       ToHex(int64(Difficulty)),
     },
@@ -55,6 +65,12 @@ func (pow *ProofOfWork) InitData(nonce int) []byte {
 
 // The actual 'mining' function
 func (pow *ProofOfWork) Run() (int, []byte) {
+  nonce, hash, _ := pow.RunContext(context.Background())
+  return nonce, hash
+}
+
+// Like Run() but gives up with ctx.Err() once ctx is done
+func (pow *ProofOfWork) RunContext(ctx context.Context) (int, []byte, error) {
   var intHash big.Int
   var hash [32]byte
 
@@ -63,6 +79,12 @@ func (pow *ProofOfWork) Run() (int, []byte) {
   fmt.Println()
   // This is essentially an infinite loop due to how large MaxInt64 is.
   for nonce < math.MaxInt64 {
+    // Checking every time would slow mining down
+    if nonce%ctxCheckInterval == 0 && ctx.Err() != nil {
+      fmt.Println()
+      return 0, nil, ctx.Err()
+    }
+
     data := pow.InitData(nonce)
     hash = sha256.Sum256(data)
 
@@ -77,7 +99,7 @@ func (pow *ProofOfWork) Run() (int, []byte) {
   }
   fmt.Println()
 
-  return nonce, hash[:]
+  return nonce, hash[:], nil
 }
 
 func (pow *ProofOfWork) Validate() bool {
@@ -0,0 +1,229 @@
+package blockchain
+
+import (
+  "bytes"
+  "encoding/base64"
+  "encoding/gob"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "log"
+  "github.com/LidoKing/learnBlockchain/blockchain/wallet"
+)
+
+// Partially signed transaction
+// Carries everything needed to sign the tx without a copy of the chain,
+// so it can be passed between (offline) signers and combined afterwards
+type PartialTx struct {
+  // Unsigned tx, ID is fixed on creation and covered by every signature
+  Tx Transaction
+  // Output spent by each input, i.e. PrevOutputs[i] belongs to Tx.Inputs[i]
+  // Not checked against the chain, but covered by every signature
+  PrevOutputs []TxOutput
+  // Collected public keys and signatures, one slot per input (nil = unsigned)
+  PubKeys [][]byte
+  Sigs    [][]byte
+}
+
+/*--------------------------utils---------------------------*/
+
+func (p *PartialTx) Serialize() []byte {
+  var encoded bytes.Buffer
+  enc := gob.NewEncoder(&encoded)
+  err := enc.Encode(p)
+  Handle(err)
+
+  return encoded.Bytes()
+}
+
+func DeserializePartialTx(data []byte) (*PartialTx, error) {
+  var p PartialTx
+
+  dec := gob.NewDecoder(bytes.NewReader(data))
+  if err := dec.Decode(&p); err != nil {
+    return nil, err
+  }
+
+  if len(p.PrevOutputs) != len(p.Tx.Inputs) || len(p.PubKeys) != len(p.Tx.Inputs) || len(p.Sigs) != len(p.Tx.Inputs) {
+    return nil, errors.New("malformed partially signed transaction")
+  }
+
+  if !p.Tx.HasValidID() {
+    return nil, errors.New("ID of partially signed transaction does not match its content")
+  }
+
+  return &p, nil
+}
+
+// Base64 text form that is passed around as a file
+func (p *PartialTx) Encode() string {
+  return base64.StdEncoding.EncodeToString(p.Serialize())
+}
+
+func DecodePartialTx(data string) (*PartialTx, error) {
+  raw, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace([]byte(data))))
+  if err != nil {
+    return nil, err
+  }
+
+  return DeserializePartialTx(raw)
+}
+
+/*--------------------------main---------------------------*/
+
+// Wrap an unsigned tx with the outputs its inputs spend
+func NewPartialTx(tx Transaction, prevOutputs []TxOutput) *PartialTx {
+  if len(prevOutputs) != len(tx.Inputs) {
+    log.Panic("ERROR: One previous output is needed for every input")
+  }
+
+  p := PartialTx{tx, prevOutputs, make([][]byte, len(tx.Inputs)), make([][]byte, len(tx.Inputs))}
+
+  // Signatures are kept aside until the tx is finalized
+  for i := range p.Tx.Inputs {
+    p.Tx.Inputs[i].Sig = nil
+    p.Tx.Inputs[i].PubKey = nil
+  }
+  p.Tx.ID = p.Tx.Hash()
+
+  return &p
+}
+
+// Same as NewMultiSourceTransaction(), but only addresses (no private keys) are needed
+func CreatePartialTx(from []string, payments []Payment, changeAddress string, opts TxOptions, UTXO *UTXOSet) *PartialTx {
+  var inputs []TxInput
+  var outputs []TxOutput
+
+  if len(from) == 0 {
+    log.Panic("Error: No source addresses given!")
+  }
+
+  if len(payments) == 0 {
+    log.Panic("Error: No recipients given!")
+  }
+
+  for _, p := range payments {
+    if p.Amount <= 0 {
+      log.Panicf("Error: Invalid amount %d for %s!", p.Amount, p.Address)
+    }
+  }
+
+  if opts.Fee < 0 {
+    log.Panic("Error: Fee cannot be negative!")
+  }
+
+  amount := TotalPayments(payments) + opts.Fee
+  spendable := 0
+
+  for _, address := range uniqueAddresses(from) {
+    if spendable >= amount {
+      break
+    }
+
+    pubKeyHash := wallet.PubKeyHashFromAddress(address)
+    accumulated, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount-spendable)
+    spendable += accumulated
+    inputs = append(inputs, inputsFor(nil, validOutputs)...)
+  }
+
+  if spendable < amount {
+    log.Panic("Error: Not enough funds!")
+  }
+
+  for _, p := range payments {
+    outputs = append(outputs, *NewTXOutput(p.Amount, p.Address))
+  }
+
+  if spendable > amount {
+    outputs = append(outputs, *NewTXOutput(spendable-amount, changeAddress))
+  }
+
+  tx := Transaction{nil, inputs, outputs, opts.Replaceable}
+  prevOutputs, err := UTXO.Blockchain.PrevOutputs(&tx)
+  Handle(err)
+
+  return NewPartialTx(tx, prevOutputs)
+}
+
+// Sign every input owned by one of the wallets, returns number of inputs signed
+func (p *PartialTx) Sign(ws []*wallet.Wallet) int {
+  owners := walletOwners(ws)
+  signed := 0
+
+  for i, prevOut := range p.PrevOutputs {
+    w, ok := owners[hex.EncodeToString(prevOut.PubKeyHash)]
+    if !ok {
+      continue
+    }
+
+    p.PubKeys[i] = w.PublicKey
+    p.Sigs[i] = p.Tx.SignInput(i, w.PrivateKey, p.PrevOutputs)
+    signed++
+  }
+
+  return signed
+}
+
+// Merge signatures collected by another signer of the same tx
+func (p *PartialTx) Combine(other *PartialTx) error {
+  if !bytes.Equal(p.Tx.ID, other.Tx.ID) || len(p.Tx.Inputs) != len(other.Tx.Inputs) {
+    return errors.New("partially signed transactions are for different transactions")
+  }
+
+  for i := range p.Sigs {
+    if p.Sigs[i] == nil && other.Sigs[i] != nil {
+      p.Sigs[i] = other.Sigs[i]
+      p.PubKeys[i] = other.PubKeys[i]
+    }
+  }
+
+  return nil
+}
+
+// Number of inputs that still need a signature
+func (p *PartialTx) Missing() int {
+  missing := 0
+
+  for _, sig := range p.Sigs {
+    if sig == nil {
+      missing++
+    }
+  }
+
+  return missing
+}
+
+// Total value of the outputs being spent
+func (p *PartialTx) InputValue() int {
+  total := 0
+
+  for _, out := range p.PrevOutputs {
+    total += out.Value
+  }
+
+  return total
+}
+
+// Put collected signatures into the tx and check them
+func (p *PartialTx) Finalize() (*Transaction, error) {
+  if missing := p.Missing(); missing > 0 {
+    return nil, fmt.Errorf("%d of %d inputs are not signed yet", missing, len(p.Sigs))
+  }
+
+  tx := p.Tx
+  tx.Inputs = make([]TxInput, len(p.Tx.Inputs))
+  copy(tx.Inputs, p.Tx.Inputs)
+
+  for i := range tx.Inputs {
+    tx.Inputs[i].PubKey = p.PubKeys[i]
+    tx.Inputs[i].Sig = p.Sigs[i]
+  }
+
+  for i := range p.PrevOutputs {
+    if !tx.VerifyInput(i, p.PrevOutputs) {
+      return nil, fmt.Errorf("signature of input %d is invalid", i)
+    }
+  }
+
+  return &tx, nil
+}
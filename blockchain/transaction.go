@@ -9,8 +9,10 @@ import (
   "crypto/elliptic"
   "crypto/rand"
   "encoding/gob"
+  "encoding/binary"
   "fmt"
   "strings"
+  "errors"
   "math/big"
   "github.com/LidoKing/learnBlockchain/blockchain/wallet"
 )
@@ -21,6 +23,14 @@ type Transaction struct {
   ID      []byte
   Inputs  []TxInput
   Outputs []TxOutput
+  // Opt-in replace-by-fee, a conflicting tx paying a higher fee can evict it from the mempool
+  Replaceable bool
+}
+
+// Extras for building a new tx, zero value means no fee and not replaceable
+type TxOptions struct {
+  Fee         int
+  Replaceable bool
 }
 
 /*--------------------------utils---------------------------*/
@@ -48,21 +58,133 @@ func DeserializeTx(data []byte) Transaction {
   return tx
 }
 
-// Convert transaction into bytes then hash it to get ID
+// Hex of serialized tx, for passing raw txs around by hand
+func (tx *Transaction) Hex() string {
+  return hex.EncodeToString(tx.Serialize())
+}
+
+// Unlike DeserializeTx(), bad input is reported instead of panicking
+func DecodeTx(data []byte) (*Transaction, error) {
+  var tx Transaction
+
+  dec := gob.NewDecoder(bytes.NewReader(data))
+  if err := dec.Decode(&tx); err != nil {
+    return nil, err
+  }
+
+  return &tx, nil
+}
+
+// Tx from the output of Hex()
+func TransactionFromHex(data string) (*Transaction, error) {
+  raw, err := hex.DecodeString(strings.TrimSpace(data))
+  if err != nil {
+    return nil, err
+  }
+
+  return DecodeTx(raw)
+}
+
+// Size of serialized tx in bytes
+func (tx *Transaction) Size() int {
+  return len(tx.Serialize())
+}
+
+// Fee is whatever the spent outputs bring in but is not paid out again
+// prevOutputs[i] is the output spent by input i
+func (tx *Transaction) Fee(prevOutputs []TxOutput) int {
+  fee := 0
+
+  for _, out := range prevOutputs {
+    fee += out.Value
+  }
+
+  for _, out := range tx.Outputs {
+    fee -= out.Value
+  }
+
+  return fee
+}
+
+// Fee per 1000 bytes, so small fees on small txs don't round down to 0
+func FeeRate(fee, size int) int {
+  if size == 0 {
+    return 0
+  }
+
+  return fee * 1000 / size
+}
+
+// Every field of tx in an encoding any process reproduces byte for byte
+// Lengths and numbers are fixed size big endian, byte slices are prefixed with their length
+func (tx *Transaction) Canonical() []byte {
+  var buff bytes.Buffer
+
+  putInt := func(n int) {
+    binary.Write(&buff, binary.BigEndian, int64(n))
+  }
+  putBytes := func(b []byte) {
+    putInt(len(b))
+    buff.Write(b)
+  }
+
+  putBytes(tx.ID)
+
+  putInt(len(tx.Inputs))
+  for _, in := range tx.Inputs {
+    putBytes(in.ID)
+    putInt(in.Out)
+    putBytes(in.Sig)
+    putBytes(in.PubKey)
+  }
+
+  putInt(len(tx.Outputs))
+  for _, out := range tx.Outputs {
+    putInt(out.Value)
+    putBytes(out.PubKeyHash)
+  }
+
+  if tx.Replaceable {
+    buff.WriteByte(1)
+  } else {
+    buff.WriteByte(0)
+  }
+
+  return buff.Bytes()
+}
+
+// ID of tx, sha256 of its canonical encoding without the ID itself and
+// without the signatures and public keys of its inputs, which are only added
+// when signing (and signatures commit to the ID). The input of a coinbase
+// keeps its PubKey, it carries the coinbase data.
 func (tx *Transaction) Hash() []byte {
-  var hash [32]byte
+  txCopy := Transaction{nil, make([]TxInput, len(tx.Inputs)), tx.Outputs, tx.Replaceable}
 
-  txCopy := *tx
-  txCopy.ID = []byte{}
+  for i, in := range tx.Inputs {
+    txCopy.Inputs[i] = TxInput{ID: in.ID, Out: in.Out}
+    if tx.IsCoinbase() {
+      txCopy.Inputs[i].PubKey = in.PubKey
+    }
+  }
 
-  hash = sha256.Sum256(txCopy.Serialize())
+  hash := sha256.Sum256(txCopy.Canonical())
 
   return hash[:]
 }
 
+// ID is the hash of the content, see Hash()
+func (tx *Transaction) HasValidID() bool {
+  return bytes.Equal(tx.ID, tx.Hash())
+}
+
 /*--------------------------main---------------------------*/
 
 func CoinbaseTx(toAddress, data string) *Transaction {
+  return NewCoinbaseTx(toAddress, data, 0)
+}
+
+// Coinbase tx that also collects the fees of the other txs in the block
+func NewCoinbaseTx(toAddress, data string, fees int) *Transaction {
   // Set and print out default data
   if data == "" {
     // Create slice of byte which has a length of 24
@@ -76,56 +198,292 @@ func CoinbaseTx(toAddress, data string) *Transaction {
   // First trransaction has no previous output
   // OutputIndex is -1
   txIn := TxInput{[]byte{}, -1, nil, []byte(data)}
-  txOut := NewTXOutput(20, toAddress)
+  txOut := NewTXOutput(subsidy+fees, toAddress)
 
-  tx := Transaction{nil, []TxInput{txIn}, []TxOutput{*txOut}}
+  tx := Transaction{nil, []TxInput{txIn}, []TxOutput{*txOut}, false}
   tx.ID = tx.Hash()
 
   return &tx
 }
 
+// One recipient of a (possibly multi-recipient) transaction
+type Payment struct {
+  Address string
+  Amount  int
+}
+
+// Sum of all amounts to be paid
+func TotalPayments(payments []Payment) int {
+  total := 0
+
+  for _, p := range payments {
+    total += p.Amount
+  }
+
+  return total
+}
+
 func NewTransaction(w *wallet.Wallet, to string, amount int, UTXO *UTXOSet) *Transaction {
+  return NewPaymentsTransaction(w, []Payment{{to, amount}}, UTXO)
+}
+
+// Pay many recipients in a single transaction,
+// with one output per payment and a single change output back to the sender
+func NewPaymentsTransaction(w *wallet.Wallet, payments []Payment, UTXO *UTXOSet) *Transaction {
+  from := fmt.Sprintf("%s", w.Address())
+
+  return NewMultiSourceTransaction([]*wallet.Wallet{w}, payments, from, TxOptions{}, UTXO)
+}
+
+// Fund payments (and fee) from several wallets, wallets are drawn from in order
+// until the total is covered and any change is sent to changeAddress
+func NewMultiSourceTransaction(ws []*wallet.Wallet, payments []Payment, changeAddress string, opts TxOptions, UTXO *UTXOSet) *Transaction {
   var inputs []TxInput
   var outputs []TxOutput
 
-  pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+  if len(ws) == 0 {
+    log.Panic("Error: No source wallets given!")
+  }
 
-  // vallidOutputs is a map!!! (with stringified transaction IDs as keys)
-  spendable, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount)
+  if len(payments) == 0 {
+    log.Panic("Error: No recipients given!")
+  }
+
+  for _, p := range payments {
+    if p.Amount <= 0 {
+      log.Panicf("Error: Invalid amount %d for %s!", p.Amount, p.Address)
+    }
+  }
+
+  if opts.Fee < 0 {
+    log.Panic("Error: Fee cannot be negative!")
+  }
+
+  amount := TotalPayments(payments) + opts.Fee
+  spendable := 0
+
+  for _, w := range uniqueWallets(ws) {
+    if spendable >= amount {
+      break
+    }
+
+    pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+
+    // vallidOutputs is a map!!! (with stringified transaction IDs as keys)
+    accumulated, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount-spendable)
+    spendable += accumulated
+    inputs = append(inputs, inputsFor(w.PublicKey, validOutputs)...)
+  }
 
   if spendable < amount {
     log.Panic("Error: Not enough funds!")
   }
 
+  for _, p := range payments {
+    outputs = append(outputs, *NewTXOutput(p.Amount, p.Address))
+  }
+
+  // Send change back to sender, i.e. new UTXO
+  if spendable > amount {
+    outputs = append(outputs, *NewTXOutput(spendable-amount, changeAddress))
+  }
+
+  tx := Transaction{nil, inputs, outputs, opts.Replaceable}
+  tx.ID = tx.Hash()
+  UTXO.Blockchain.SignTransaction(&tx, SigningKeys(ws))
+
+  return &tx
+}
+
+// Drain every UTXO of the given wallets into a single output to 'to', minus the fee
+func NewSweepTransaction(ws []*wallet.Wallet, to string, opts TxOptions, UTXO *UTXOSet) *Transaction {
+  var inputs []TxInput
+  total := 0
+
+  for _, w := range uniqueWallets(ws) {
+    pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+    accumulated, validOutputs := UTXO.FindAllSpendableOutputs(pubKeyHash)
+    total += accumulated
+    inputs = append(inputs, inputsFor(w.PublicKey, validOutputs)...)
+  }
+
+  if total == 0 {
+    log.Panic("Error: Nothing to sweep!")
+  }
+
+  if opts.Fee < 0 || opts.Fee >= total {
+    log.Panic("Error: Fee must not be negative and must be less than the amount swept!")
+  }
+
+  tx := Transaction{nil, inputs, []TxOutput{*NewTXOutput(total-opts.Fee, to)}, opts.Replaceable}
+  tx.ID = tx.Hash()
+  UTXO.Blockchain.SignTransaction(&tx, SigningKeys(ws))
+
+  return &tx
+}
+
+// Wallets listed more than once would have their UTXOs spent twice in one tx
+func uniqueWallets(ws []*wallet.Wallet) []*wallet.Wallet {
+  var unique []*wallet.Wallet
+  seen := make(map[string]bool)
+
+  for _, w := range ws {
+    key := hex.EncodeToString(w.PublicKey)
+    if !seen[key] {
+      seen[key] = true
+      unique = append(unique, w)
+    }
+  }
+
+  return unique
+}
+
+// Same as uniqueWallets() for addresses
+func uniqueAddresses(addresses []string) []string {
+  var unique []string
+  seen := make(map[string]bool)
+
+  for _, address := range addresses {
+    if !seen[address] {
+      seen[address] = true
+      unique = append(unique, address)
+    }
+  }
+
+  return unique
+}
+
+// Create inputs of new transaction that points to to-be-used UTXOs of a wallet
+// pubKey can be left empty when the tx is signed later on (see PartialTx)
+func inputsFor(pubKey []byte, validOutputs map[string][]int) []TxInput {
+  var inputs []TxInput
+
   // txid is key of map (string), outs is index of output that is unspent
   for txid, outs := range validOutputs {
     // Convert stringified IDs back to slice of bytes
     txID, err := hex.DecodeString(txid)
     Handle(err)
 
-    // Create inputs of new transaction that points to to-be-used UTXOs
     for _, out := range outs {
-      input := TxInput{txID, out, nil, w.PublicKey}
-      inputs = append(inputs, input)
+      inputs = append(inputs, TxInput{txID, out, nil, pubKey})
     }
   }
 
-  from := fmt.Sprintf("%s", w.Address())
+  return inputs
+}
 
-  outputs = append(outputs, *NewTXOutput(amount, to))
+// Unsigned tx spending exactly the given inputs, e.g. for createrawtx
+// Nothing is checked against the chain, inputs are checked when signing
+func NewRawTransaction(inputs []TxInput, payments []Payment) *Transaction {
+  var outputs []TxOutput
 
-  // Send change back to sender, i.e. new UTXO
-  if spendable > amount {
-    outputs = append(outputs, *NewTXOutput(spendable-amount, from))
+  for _, p := range payments {
+    outputs = append(outputs, *NewTXOutput(p.Amount, p.Address))
   }
 
-  tx := Transaction{nil, inputs, outputs}
+  tx := Transaction{nil, inputs, outputs, false}
   tx.ID = tx.Hash()
-  UTXO.Blockchain.SignTransaction(&tx, w.PrivateKey)
 
   return &tx
 }
 
+// Replacement for a replaceable tx that pays newFee instead
+// Extra fee is taken from the change output, i.e. the last output owned by one of the wallets,
+// which is dropped if nothing is left of it. prevOutputs[i] is the output spent by input i
+func BumpFeeTransaction(orig *Transaction, prevOutputs []TxOutput, ws []*wallet.Wallet, newFee int) (*Transaction, error) {
+  if !orig.Replaceable {
+    return nil, errors.New("transaction did not opt in to replace-by-fee")
+  }
+
+  bump := newFee - orig.Fee(prevOutputs)
+  if bump <= 0 {
+    return nil, fmt.Errorf("new fee must be higher than the current fee of %d", orig.Fee(prevOutputs))
+  }
+
+  owners := walletOwners(ws)
+  change := -1
+  for i, out := range orig.Outputs {
+    if _, ok := owners[hex.EncodeToString(out.PubKeyHash)]; ok {
+      change = i
+    }
+  }
+
+  if change == -1 {
+    return nil, errors.New("transaction has no change output to take the fee from")
+  }
+
+  if orig.Outputs[change].Value < bump {
+    return nil, fmt.Errorf("change output of %d cannot cover a fee increase of %d", orig.Outputs[change].Value, bump)
+  }
+
+  tx := Transaction{nil, make([]TxInput, len(orig.Inputs)), nil, true}
+  copy(tx.Inputs, orig.Inputs)
+
+  for i, out := range orig.Outputs {
+    if i == change {
+      out.Value -= bump
+      if out.Value == 0 {
+        continue
+      }
+    }
+    tx.Outputs = append(tx.Outputs, out)
+  }
+
+  for i := range tx.Inputs {
+    tx.Inputs[i].Sig = nil
+  }
+  tx.ID = tx.Hash()
+
+  if tx.SignWith(ws, prevOutputs) != len(tx.Inputs) {
+    return nil, errors.New("not all inputs are owned by the wallet")
+  }
+
+  return &tx, nil
+}
+
+// Sign inputs owned by one of the wallets, prevOutputs[i] is the output spent by input i
+// Returns number of inputs signed, other inputs are left untouched
+func (tx *Transaction) SignWith(ws []*wallet.Wallet, prevOutputs []TxOutput) int {
+  owners := walletOwners(ws)
+  signed := 0
+
+  for i, prevOut := range prevOutputs {
+    w, ok := owners[hex.EncodeToString(prevOut.PubKeyHash)]
+    if !ok {
+      continue
+    }
+
+    tx.Inputs[i].PubKey = w.PublicKey
+    tx.Inputs[i].Sig = tx.SignInput(i, w.PrivateKey, prevOutputs)
+    signed++
+  }
+
+  return signed
+}
+
+// Wallets keyed by stringified pubKeyHash
+func walletOwners(ws []*wallet.Wallet) map[string]*wallet.Wallet {
+  owners := make(map[string]*wallet.Wallet)
+
+  for _, w := range ws {
+    owners[hex.EncodeToString(wallet.PublicKeyHash(w.PublicKey))] = w
+  }
+
+  return owners
+}
+
+// Private keys of wallets keyed by stringified pubKeyHash,
+// so each input can be signed by the owner of the output it spends
+func SigningKeys(ws []*wallet.Wallet) map[string]ecdsa.PrivateKey {
+  keys := make(map[string]ecdsa.PrivateKey)
+
+  for _, w := range ws {
+    keys[hex.EncodeToString(wallet.PublicKeyHash(w.PublicKey))] = w.PrivateKey
+  }
+
+  return keys
+}
+
 func (tx *Transaction) TrimmedCopy() Transaction {
   var inputs []TxInput
   var outputs []TxOutput
@@ -138,12 +496,12 @@ func (tx *Transaction) TrimmedCopy() Transaction {
     outputs = append(outputs, TxOutput{out.Value, out.PubKeyHash})
   }
 
-  txCopy := Transaction{tx.ID, inputs, outputs}
+  txCopy := Transaction{tx.ID, inputs, outputs, tx.Replaceable}
 
   return txCopy
 }
 
-func (tx *Transaction) Sign(privateKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+func (tx *Transaction) Sign(keys map[string]ecdsa.PrivateKey, prevTXs map[string]Transaction) {
   if tx.IsCoinbase() {
     return
   }
@@ -154,27 +512,102 @@ func (tx *Transaction) Sign(privateKey ecdsa.PrivateKey, prevTXs map[string]Tran
     }
   }
 
+  prevOutputs := tx.outputsSpent(prevTXs)
+
+  for inId, prevOut := range prevOutputs {
+    // Sign with key of the owner of the referenced output
+    privateKey, ok := keys[hex.EncodeToString(prevOut.PubKeyHash)]
+    if !ok {
+      log.Panicf("ERROR: No key for owner of input %d", inId)
+    }
+
+    tx.Inputs[inId].Sig = tx.SignInput(inId, privateKey, prevOutputs)
+  }
+}
+
+// Outputs spent by the inputs, in input order
+func (tx *Transaction) outputsSpent(prevTXs map[string]Transaction) []TxOutput {
+  var prevOutputs []TxOutput
+
+  for _, in := range tx.Inputs {
+    prevTX := prevTXs[hex.EncodeToString(in.ID)]
+    prevOutputs = append(prevOutputs, prevTX.Outputs[in.Out])
+  }
+
+  return prevOutputs
+}
+
+// Data that is signed for a single input
+// prevOutputs[i] is the output spent by input i, all of them are signed so
+// that a signer who is lied to about what the inputs are worth (and so about
+// the fee) produces a signature that does not verify
+func (tx *Transaction) dataToSign(inId int, prevOutputs []TxOutput) []byte {
   // Create copy to get sig without affecting actual tx
   txCopy := tx.TrimmedCopy()
 
-  for inId, in := range txCopy.Inputs {
-    // Get transaction that the input points to
-    prevTX := prevTXs[hex.EncodeToString(in.ID)]
-    txCopy.Inputs[inId].Sig = nil
-    // Set PubKey field for hashing
-    // Actual tx is hashed with pubKey instead of pubKeyHash and with no signature
-    txCopy.Inputs[inId].PubKey = prevTX.Outputs[in.Out].PubKeyHash
+  // Set PubKey field for hashing
+  // Actual tx is hashed with pubKey instead of pubKeyHash and with no signature
+  txCopy.Inputs[inId].PubKey = prevOutputs[inId].PubKeyHash
 
-    dataToSign := fmt.Sprintf("%x\n", txCopy)
+  // Same as formatting the whole struct with %x, the flag is only added when set
+  data := fmt.Sprintf("{%x %x %x}\n", txCopy.ID, txCopy.Inputs, txCopy.Outputs)
+  if txCopy.Replaceable {
+    data += "replaceable\n"
+  }
+  data += fmt.Sprintf("%x\n", prevOutputs)
 
-    r, s, err := ecdsa.Sign(rand.Reader, &privateKey, []byte(dataToSign))
-    Handle(err)
-    signature := append(r.Bytes(), s.Bytes()...)
+  // ECDSA only signs as many bytes as the curve is long, the rest would be left out
+  hash := sha256.Sum256([]byte(data))
+  return hash[:]
+}
 
-    tx.Inputs[inId].Sig = signature
-    // Clear PubKey field to prevent unecessary errors
-    txCopy.Inputs[inId].PubKey = nil
+// Signature of one input, only needs the outputs the tx spends instead of the whole chain
+func (tx *Transaction) SignInput(inId int, privateKey ecdsa.PrivateKey, prevOutputs []TxOutput) []byte {
+  r, s, err := ecdsa.Sign(rand.Reader, &privateKey, tx.dataToSign(inId, prevOutputs))
+  Handle(err)
+
+  // r and s take up half each, padded so that VerifyInput() splits them
+  // right when one of them starts with zero bytes
+  size := (privateKey.Curve.Params().BitSize + 7) / 8
+  sig := make([]byte, 2*size)
+  r.FillBytes(sig[:size])
+  s.FillBytes(sig[size:])
+
+  return sig
+}
+
+// Check signature of one input against the outputs the tx spends
+func (tx *Transaction) VerifyInput(inId int, prevOutputs []TxOutput) bool {
+  in := tx.Inputs[inId]
+  curve := elliptic.P256()
+
+  r := big.Int{}
+  s := big.Int{}
+
+  sigLen := len(in.Sig)
+  r.SetBytes(in.Sig[:(sigLen / 2)])
+  s.SetBytes(in.Sig[(sigLen / 2):])
+
+  x := big.Int{}
+  y := big.Int{}
+  keyLen := len(in.PubKey)
+  x.SetBytes(in.PubKey[:(keyLen / 2)])
+  y.SetBytes(in.PubKey[(keyLen / 2):])
+
+  rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
+
+  return ecdsa.Verify(&rawPubKey, tx.dataToSign(inId, prevOutputs), &r, &s)
+}
+
+// Whether every input carries a valid signature, prevOutputs[i] is the output spent by input i
+func (tx *Transaction) FullySigned(prevOutputs []TxOutput) bool {
+  for i := range prevOutputs {
+    if len(tx.Inputs[i].Sig) == 0 || !tx.VerifyInput(i, prevOutputs) {
+      return false
+    }
   }
+
+  return true
 }
 
 func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
@@ -188,35 +621,12 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
     }
   }
 
-  txCopy := tx.TrimmedCopy()
-  curve := elliptic.P256()
-
-  for inId, in := range tx.Inputs {
-    prevTx := prevTXs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Sig = nil
-		txCopy.Inputs[inId].PubKey = prevTx.Outputs[in.Out].PubKeyHash
-
-    r := big.Int{}
-    s := big.Int{}
-
-    sigLen := len(in.Sig)
-    r.SetBytes(in.Sig[:(sigLen / 2)])
-    s.SetBytes(in.Sig[(sigLen / 2):])
+  prevOutputs := tx.outputsSpent(prevTXs)
 
-    x := big.Int{}
-    y := big.Int{}
-    keyLen := len(in.PubKey)
-    x.SetBytes(in.PubKey[:(keyLen / 2)])
-		y.SetBytes(in.PubKey[(keyLen / 2):])
-
-    dataToVerify := fmt.Sprintf("%x\n", txCopy)
-
-    rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
-    if ecdsa.Verify(&rawPubKey, []byte(dataToVerify), &r, &s) == false {
+  for inId := range tx.Inputs {
+    if !tx.VerifyInput(inId, prevOutputs) {
       return false
     }
-
-    txCopy.Inputs[inId].PubKey = nil
   }
   return true
 }
@@ -16,6 +16,9 @@ type TxOutput struct {
 
 type TxOutputs struct {
   Outputs []TxOutput
+  // Original output index of each entry in Outputs,
+  // as spent outputs are removed from the UTXO set (nil = same as position)
+  Indexes []int
 }
 
 // Reference to previous TxOutput
@@ -46,6 +49,14 @@ func DeserializeOutputs(data []byte) TxOutputs {
   return outputs
 }
 
+// Get index of Outputs[i] in the transaction that created it
+func (outs TxOutputs) Index(i int) int {
+  if outs.Indexes == nil {
+    return i
+  }
+  return outs.Indexes[i]
+}
+
 // Check if unspent outputs belong to specific address
 func (out *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
   return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
@@ -2,7 +2,9 @@ package blockchain
 
 import (
   "bytes"
+  "crypto/sha256"
   "log"
+  "math"
   "encoding/hex"
   "github.com/dgraph-io/badger"
 )
@@ -74,10 +76,10 @@ func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, sendAmount int) (int, m
       Handle(err)
       txID := hex.EncodeToString(k)
 
-      for outIdx, out := range outs.Outputs {
+      for i, out := range outs.Outputs {
         if out.IsLockedWithKey(pubKeyHash) && accumulated < sendAmount {
           accumulated += out.Value
-          unspentOuts[txID] = append(unspentOuts[txID], outIdx)
+          unspentOuts[txID] = append(unspentOuts[txID], outs.Index(i))
         }
       }
     }
@@ -88,6 +90,59 @@ func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, sendAmount int) (int, m
   return accumulated, unspentOuts
 }
 
+// Look up a single unspent output, false if it doesn't exist or has been spent
+func (u UTXOSet) FindUnspentOutput(txID []byte, out int) (TxOutput, bool) {
+  var output TxOutput
+  found := false
+  db := u.Blockchain.Database
+
+  // Copy prefix so its backing array isn't shared between callers
+  key := append(append([]byte{}, utxoPrefix...), txID...)
+
+  err := db.View(func(txn *badger.Txn) error {
+    item, err := txn.Get(key)
+    if err == badger.ErrKeyNotFound {
+      return nil
+    }
+    Handle(err)
+
+    return item.Value(func(val []byte) error {
+      outs := DeserializeOutputs(val)
+      for i, o := range outs.Outputs {
+        if outs.Index(i) == out {
+          output = o
+          found = true
+        }
+      }
+      return nil
+    })
+  })
+  Handle(err)
+
+  return output, found
+}
+
+// Tx has at least one output that is not spent yet
+func (u UTXOSet) HasUnspentOutputs(txID []byte) bool {
+  key := append(append([]byte{}, utxoPrefix...), txID...)
+
+  err := u.Blockchain.Database.View(func(txn *badger.Txn) error {
+    _, err := txn.Get(key)
+    return err
+  })
+  if err == badger.ErrKeyNotFound {
+    return false
+  }
+  Handle(err)
+
+  return true
+}
+
+// Used for sweeping, i.e. every UTXO owned by pubKeyHash
+func (u UTXOSet) FindAllSpendableOutputs(pubKeyHash []byte) (int, map[string][]int) {
+  return u.FindSpendableOutputs(pubKeyHash, math.MaxInt64)
+}
+
 // Count txs with unspent outputs
 func (u UTXOSet) CountTransactions() int {
   db := u.Blockchain.Database
@@ -108,6 +163,35 @@ func (u UTXOSet) CountTransactions() int {
   return counter
 }
 
+// Digest of the whole set, equal on nodes that agree on every UTXO
+// Keys are iterated in order, so it does not depend on how the set was built
+func (u UTXOSet) Hash() []byte {
+  db := u.Blockchain.Database
+  hasher := sha256.New()
+
+  err := db.View(func(txn *badger.Txn) error {
+    it := txn.NewIterator(badger.DefaultIteratorOptions)
+    defer it.Close()
+
+    for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+      item := it.Item()
+      hasher.Write(item.Key())
+      err := item.Value(func(val []byte) error {
+        hasher.Write(val)
+        return nil
+      })
+      if err != nil {
+        return err
+      }
+    }
+
+    return nil
+  })
+  Handle(err)
+
+  return hasher.Sum(nil)
+}
+
 func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
   deleteKeys := func(keysForDelete [][]byte) error {
     // Run Update() func first and return err if there is one
@@ -212,11 +296,12 @@ func (u *UTXOSet) Update(block *Block) {
           })
           Handle(err)
 
-          for outIdx, out := range outs.Outputs {
-            // Potential conflict solved by reindexing
-            if outIdx != in.Out {
+          for i, out := range outs.Outputs {
+            // Compare with original index as spent outputs have been removed
+            if outs.Index(i) != in.Out {
               // Add ouput to updatedOuts if it remains unspent after new transaction
               updatedOuts.Outputs = append (updatedOuts.Outputs, out)
+              updatedOuts.Indexes = append(updatedOuts.Indexes, outs.Index(i))
             }
           }
 
@@ -238,8 +323,9 @@ func (u *UTXOSet) Update(block *Block) {
       newOutputs:= TxOutputs{}
       // Output must be unspent for coinbase tx
       // No checking is needed
-      for _, out := range tx.Outputs {
+      for outIdx, out := range tx.Outputs {
         newOutputs.Outputs = append(newOutputs.Outputs, out)
+        newOutputs.Indexes = append(newOutputs.Indexes, outIdx)
       }
 
       txID := append(utxoPrefix, tx.ID...)
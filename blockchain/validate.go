@@ -0,0 +1,189 @@
+package blockchain
+
+import (
+  "bytes"
+  "encoding/hex"
+  "fmt"
+  "github.com/LidoKing/learnBlockchain/blockchain/wallet"
+)
+
+// New coins a coinbase tx may create on top of the fees of its block
+const subsidy = 20
+
+/*-------------------------------utils-------------------------------*/
+
+func outpointKey(txID []byte, out int) string {
+  return fmt.Sprintf("%x:%d", txID, out)
+}
+
+/*-------------------------------main-------------------------------*/
+
+// Check txs of block against the branch it extends, its parent must be stored
+//   - its height is one above that of its parent
+//   - every tx ID is the hash of the tx and is used once in the block
+//   - the first tx and only the first tx is a coinbase, paying out at most
+//     the subsidy plus the fees of the other txs
+//   - every other tx has inputs and outputs of positive value
+//   - every input spends an output of an earlier tx of the branch or of the
+//     block which is not spent in between
+//   - every input is signed by the owner of the output it spends
+//   - no tx pays out more than its inputs bring in
+func (chain *BlockChain) CheckBlockTxs(block *Block) error {
+  parent, err := chain.GetBlock(block.PrevHash)
+  if err != nil {
+    return fmt.Errorf("Parent of block %x: %s", block.Hash, err)
+  }
+  if block.Height != parent.Height+1 {
+    return fmt.Errorf("Block %x has height %d, its parent has %d", block.Hash, block.Height, parent.Height)
+  }
+
+  if len(block.Transactions) == 0 || !block.Transactions[0].IsCoinbase() {
+    return fmt.Errorf("Block %x does not start with a coinbase transaction", block.Hash)
+  }
+
+  // Outputs are stored by tx ID, a reused one would overwrite or mix with
+  // those of another tx. Txs earlier on the branch are covered by
+  // UTXOSet.CheckTxIDs().
+  ids := make(map[string]bool)
+
+  for _, tx := range block.Transactions {
+    if !tx.HasValidID() {
+      return fmt.Errorf("Transaction %x does not hash to its ID", tx.ID)
+    }
+
+    id := hex.EncodeToString(tx.ID)
+    if ids[id] {
+      return fmt.Errorf("Transaction %s is in block %x twice", id, block.Hash)
+    }
+    ids[id] = true
+  }
+
+  // Outputs spent by the block
+  spent := make(map[string]bool)
+  // Txs of the block so far, later txs may spend their outputs
+  inBlock := make(map[string]Transaction)
+  // Txs spent from that have to be found in the branch
+  wanted := make(map[string]bool)
+
+  for _, tx := range block.Transactions[1:] {
+    if tx.IsCoinbase() {
+      return fmt.Errorf("Block %x has more than one coinbase transaction", block.Hash)
+    }
+    if len(tx.Inputs) == 0 || len(tx.Outputs) == 0 {
+      return fmt.Errorf("Transaction %x has no inputs or no outputs", tx.ID)
+    }
+    for i, out := range tx.Outputs {
+      if out.Value <= 0 {
+        return fmt.Errorf("Output %d of transaction %x has a non-positive value", i, tx.ID)
+      }
+    }
+
+    for _, in := range tx.Inputs {
+      key := outpointKey(in.ID, in.Out)
+      if spent[key] {
+        return fmt.Errorf("Output %s is spent twice in block %x", key, block.Hash)
+      }
+      spent[key] = true
+
+      if _, ok := inBlock[hex.EncodeToString(in.ID)]; !ok {
+        wanted[hex.EncodeToString(in.ID)] = true
+      }
+    }
+
+    inBlock[hex.EncodeToString(tx.ID)] = *tx
+  }
+
+  // Walk the branch down until every tx spent from is found, outputs can
+  // only be spent again in blocks after the one holding their tx
+  prevTXs := make(map[string]Transaction)
+  hash := block.PrevHash
+  for len(wanted) > 0 && len(hash) > 0 {
+    ancestor, err := chain.GetBlock(hash)
+    if err != nil {
+      return fmt.Errorf("Block %x: %s", hash, err)
+    }
+
+    for _, tx := range ancestor.Transactions {
+      for _, in := range tx.Inputs {
+        if key := outpointKey(in.ID, in.Out); spent[key] && !tx.IsCoinbase() {
+          return fmt.Errorf("Output %s is already spent in block %x", key, ancestor.Hash)
+        }
+      }
+
+      id := hex.EncodeToString(tx.ID)
+      if wanted[id] {
+        prevTXs[id] = *tx
+        delete(wanted, id)
+      }
+    }
+
+    hash = ancestor.PrevHash
+  }
+
+  for id := range wanted {
+    return fmt.Errorf("Transaction %s spent in block %x does not exist", id, block.Hash)
+  }
+
+  fees := 0
+  for _, tx := range block.Transactions[1:] {
+    var prevOutputs []TxOutput
+
+    for i, in := range tx.Inputs {
+      prevTX, ok := inBlock[hex.EncodeToString(in.ID)]
+      if !ok {
+        prevTX = prevTXs[hex.EncodeToString(in.ID)]
+      }
+      if in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+        return fmt.Errorf("Output %d of transaction %x does not exist", in.Out, in.ID)
+      }
+      prevOut := prevTX.Outputs[in.Out]
+
+      if len(in.PubKey) == 0 || !bytes.Equal(wallet.PublicKeyHash(in.PubKey), prevOut.PubKeyHash) {
+        return fmt.Errorf("Input %d of transaction %x is not from the owner of the output it spends", i, tx.ID)
+      }
+
+      prevOutputs = append(prevOutputs, prevOut)
+    }
+
+    // Signatures cover every output spent, so they are checked once all are known
+    for i := range tx.Inputs {
+      if !tx.VerifyInput(i, prevOutputs) {
+        return fmt.Errorf("Signature of input %d of transaction %x is invalid", i, tx.ID)
+      }
+    }
+
+    fee := tx.Fee(prevOutputs)
+    if fee < 0 {
+      return fmt.Errorf("Transaction %x spends more than its inputs", tx.ID)
+    }
+    fees += fee
+  }
+
+  coinbase := block.Transactions[0]
+  paid := 0
+  for i, out := range coinbase.Outputs {
+    if out.Value <= 0 {
+      return fmt.Errorf("Output %d of coinbase %x has a non-positive value", i, coinbase.ID)
+    }
+    paid += out.Value
+  }
+  if paid > subsidy+fees {
+    return fmt.Errorf("Coinbase of block %x pays %d, max is %d", block.Hash, paid, subsidy+fees)
+  }
+
+  return nil
+}
+
+// No tx of block, which extends the tip the UTXO set is at, reuses the ID of
+// a tx with unspent outputs. Other txs earlier on the branch would have to
+// spend outputs spent already, so only a coinbase could get past
+// CheckBlockTxs() with such an ID.
+func (u UTXOSet) CheckTxIDs(block *Block) error {
+  for _, tx := range block.Transactions {
+    if u.HasUnspentOutputs(tx.ID) {
+      return fmt.Errorf("Transaction %x already has unspent outputs", tx.ID)
+    }
+  }
+
+  return nil
+}
@@ -32,8 +32,12 @@ func NewKeyPair() (ecdsa.PrivateKey, []byte) {
   private, err := ecdsa.GenerateKey(curve, rand.Reader)
   Handle(err)
 
-  // concatenate two slices of bytes, append(x, y...)
-  public := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+  // X and Y take up half each, padded so that keys split right when one of
+  // them starts with zero bytes
+  size := (curve.Params().BitSize + 7) / 8
+  public := make([]byte, 2*size)
+  private.PublicKey.X.FillBytes(public[:size])
+  private.PublicKey.Y.FillBytes(public[size:])
 
   return *private, public
 }
@@ -71,13 +75,25 @@ func Checksum(versionedHash []byte) []byte {
 func (w Wallet) Address() []byte {
    pubKeyHash := PublicKeyHash(w.PublicKey)
 
+   return []byte(AddressFromPubKeyHash(pubKeyHash))
+}
+
+// Address that 'owns' outputs locked with pubKeyHash
+func AddressFromPubKeyHash(pubKeyHash []byte) string {
    versionedHash := append([]byte{version}, pubKeyHash...)
    checksum := Checksum(versionedHash)
 
    fullHash := append(versionedHash, checksum...)
    address := Base58Encode(fullHash)
 
-   return address
+   return string(address)
+}
+
+// Reverse of Address(), strip version and checksum off decoded address
+func PubKeyHashFromAddress(address string) []byte {
+  fullHash := Base58Decode([]byte(address))
+
+  return fullHash[1:len(fullHash)-checksumLength]
 }
 
 // Validation process:
@@ -71,8 +71,14 @@ func (ws *Wallets) AddWallet() string {
   return address
 }
 
-func (ws Wallets) GetWallet(address string) Wallet {
-  return *ws.Wallets[address]
+// Error if address is not 'managed' by the node
+func (ws Wallets) GetWallet(address string) (Wallet, error) {
+  w, ok := ws.Wallets[address]
+  if !ok {
+    return Wallet{}, fmt.Errorf("address %s is not in the wallet file", address)
+  }
+
+  return *w, nil
 }
 
 func (ws *Wallets) GetAllAddresses() []string {
@@ -0,0 +1,65 @@
+package blockchain
+
+import (
+  "bytes"
+  "encoding/gob"
+  "encoding/hex"
+  "fmt"
+  "io/ioutil"
+  "os"
+)
+
+const walletTxsFile = "./tmp/wallettxs_%s.data"
+
+// Txs sent by the node's wallets that may still be unconfirmed,
+// kept so they can be fee-bumped (and rebroadcast) later on
+type WalletTxs struct {
+  Txs map[string]Transaction
+}
+
+func (wt *WalletTxs) SaveFile(nodeID string) {
+  var content bytes.Buffer
+  file := fmt.Sprintf(walletTxsFile, nodeID)
+
+  enc := gob.NewEncoder(&content)
+  err := enc.Encode(wt)
+  Handle(err)
+
+  err = ioutil.WriteFile(file, content.Bytes(), 0644)
+  Handle(err)
+}
+
+// Empty store is returned if the file does not exist yet
+func LoadWalletTxs(nodeID string) (*WalletTxs, error) {
+  wt := WalletTxs{make(map[string]Transaction)}
+  file := fmt.Sprintf(walletTxsFile, nodeID)
+
+  if _, err := os.Stat(file); os.IsNotExist(err) {
+    return &wt, nil
+  }
+
+  fileContent, err := ioutil.ReadFile(file)
+  if err != nil {
+    return &wt, err
+  }
+
+  dec := gob.NewDecoder(bytes.NewReader(fileContent))
+  if err := dec.Decode(&wt); err != nil {
+    return &wt, err
+  }
+
+  return &wt, nil
+}
+
+func (wt *WalletTxs) Add(tx *Transaction) {
+  wt.Txs[hex.EncodeToString(tx.ID)] = *tx
+}
+
+func (wt *WalletTxs) Remove(txID string) {
+  delete(wt.Txs, txID)
+}
+
+func (wt *WalletTxs) Get(txID string) (Transaction, bool) {
+  tx, ok := wt.Txs[txID]
+  return tx, ok
+}
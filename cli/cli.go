@@ -1,15 +1,22 @@
 package cli
 
 import (
+  "context"
   "fmt"
   "strconv"
   "runtime"
   "flag"
   "os"
+  "os/signal"
+  "syscall"
   "log"
+  "strings"
   "github.com/LidoKing/learnBlockchain/blockchain"
   "github.com/LidoKing/learnBlockchain/blockchain/wallet"
+  "github.com/LidoKing/learnBlockchain/mempool"
+  "github.com/LidoKing/learnBlockchain/mining"
   "github.com/LidoKing/learnBlockchain/network"
+  "github.com/LidoKing/learnBlockchain/rpc"
 )
 
 type CommandLine struct {
@@ -24,7 +31,10 @@ func (cli *CommandLine) printUsage() {
   // Creates a blockchain and rewards the mining fee
   fmt.Println(" 2. createchain -a ADDRESS")
   // Send coins from one address to another, -mine allows sender to mine own block
-  fmt.Println(" 3. send -f FROM -t TO -amount AMOUNT -mine")
+  // -t can be repeated as -t ADDR:AMOUNT, -file reads recipients from a CSV/JSON payout file
+  // -f can be repeated to fund the tx from several addresses, change goes to first -f unless -change is given
+  // -rbf lets the tx be replaced by one paying a higher fee later on, see bumpfee
+  fmt.Println(" 3. send -f FROM [-f FROM ...] -t TO -amount AMOUNT [-t ADDR:AMOUNT ...] [-file PAYOUTS] [-change ADDRESS] [-fee FEE] -rbf -mine")
   // Prints the blocks in the chain
   fmt.Println(" 4. print")
   // Creates new wallets
@@ -33,8 +43,37 @@ func (cli *CommandLine) printUsage() {
   fmt.Println(" 6. listaddresses")
   // Rebuilds the UTXO set
   // fmt.Println(" 7. reindexutxo")
-  // Start node with ID specified in NODE_ID env. var., -miner indicates that the node is a miner node
-  fmt.Println(" 8. startnode -miner ADDRESS")
+  // Start node with the data of NODE_ID env. var., -miner indicates that the node is a miner node
+  // Listen address, seeds etc. come from tmp/node_NODE_ID.json, flags override it
+  fmt.Println(" 8. startnode -miner ADDRESS [-interval 10s] [-blocksize BYTES] [-encrypt] [-allow KEY,KEY]")
+  fmt.Println("    [-listen HOST:PORT] [-externalip HOST] [-connect ADDR ...] [-addnode ADDR ...]")
+  // While the node runs, the other commands go through its RPC server (credentials in tmp/rpc_NODE_ID.json)
+  // -rest serves GET /block/HASH, /block-height/N, /tx/TXID, /address/ADDRESS/utxos and /chaininfo as JSON
+  fmt.Println("    [-rpclisten HOST:PORT] [-rpcuser USER] [-rpcpassword PASSWORD] -rest")
+  // Move all coins of the given addresses to TO
+  fmt.Println(" 9. sweep -f FROM [-f FROM ...] -t TO [-fee FEE] -rbf -mine")
+  // Partially signed transactions for offline/multi-party signing, same recipient options as send
+  fmt.Println(" 10. createpsbt -f FROM [-f FROM ...] -t ADDR:AMOUNT [-file PAYOUTS] [-change ADDRESS] [-fee FEE] -rbf -out FILE")
+  // Sign inputs owned by this node's wallets, works without a chain
+  fmt.Println(" 11. signpsbt -in FILE -out FILE")
+  fmt.Println(" 12. combinepsbt -in FILE -in FILE [...] -out FILE")
+  // Print fully signed tx as hex
+  fmt.Println(" 13. finalizepsbt -in FILE [-out FILE]")
+  fmt.Println(" 14. broadcast -in FILE")
+  // Hand-crafted raw txs (hex), raw txs are given with -hex or read from -in FILE
+  fmt.Println(" 15. createrawtx -input TXID:OUT [-input TXID:OUT ...] -t ADDR:AMOUNT [-t ADDR:AMOUNT ...]")
+  fmt.Println(" 16. decoderawtx -hex HEX | -in FILE")
+  // Sign inputs owned by this node's wallets
+  fmt.Println(" 17. signrawtx -hex HEX | -in FILE")
+  // Hand raw tx to the local node's mempool
+  fmt.Println(" 18. sendrawtx -hex HEX | -in FILE")
+  // Replace an unconfirmed tx sent with -rbf by one paying FEE (default: minimum increase)
+  fmt.Println(" 19. bumpfee -txid TXID [-fee FEE]")
+  // Height, sync progress and peers of a running node (default: this NODE_ID's)
+  fmt.Println(" 20. status [-node ADDR]")
+  // Follow events of the running node as JSON lines, topics: tip, blockconnected, blockdisconnected, tx, payment
+  // -address limits payment events to the given addresses
+  fmt.Println(" 21. watch [-topic TOPIC ...] [-address ADDRESS ...]")
 }
 
 // Ensure valid input is given
@@ -63,6 +102,12 @@ func (cli *CommandLine) createBlockChain(address, nodeID string) {
     log.Panic("Address is not valid.")
   }
 
+  // The node holds the database, which it could only have opened with a chain in it
+  if nodeClient(nodeID) != nil {
+    fmt.Printf("Node %s is running, so its blockchain exists already\n", nodeID)
+    runtime.Goexit()
+  }
+
   newChain := blockchain.InitBlockChain(address, nodeID)
   defer newChain.Database.Close()
 
@@ -77,6 +122,11 @@ func (cli *CommandLine) getBalance(address, nodeID string) {
     log.Panic("Address is not valid.")
   }
 
+  if client := nodeClient(nodeID); client != nil {
+    rpcGetBalance(client, address)
+    return
+  }
+
   chain := blockchain.ContinueBlockChain(nodeID)
   UTXOSet := blockchain.UTXOSet{chain}
   defer chain.Database.Close()
@@ -95,48 +145,219 @@ func (cli *CommandLine) getBalance(address, nodeID string) {
   fmt.Println()
 }
 
-func (cli *CommandLine) send(from, to string, amount int, nodeID string, mineNow bool) {
-  if !wallet.ValidateAddress(from) {
-    log.Panic("Address is not valid.")
+// Get wallets of all source addresses, which must be 'managed' by the node
+func loadSourceWallets(addresses []string, nodeID string) []*wallet.Wallet {
+  wallets, err := wallet.LoadWallets(nodeID)
+  if err != nil {
+    log.Panic(err)
   }
 
-  if !wallet.ValidateAddress(to) {
+  var sources []*wallet.Wallet
+  for _, address := range addresses {
+    if !wallet.ValidateAddress(address) {
+      log.Panic("Address is not valid.")
+    }
+
+    w, err := wallets.GetWallet(address)
+    if err != nil {
+      fmt.Println(err)
+      runtime.Goexit()
+    }
+    sources = append(sources, &w)
+  }
+
+  return sources
+}
+
+// Address of the node at NODE_ID, from its config, see network.NodeAddress()
+func nodeAddress(nodeID string) string {
+  addr, err := network.NodeAddress(nodeID)
+  if err != nil {
+    fmt.Printf("Could not read node config: %s\n", err)
+    runtime.Goexit()
+  }
+  return addr
+}
+
+// Node CLI commands send txs to, see network.SeedNode()
+func seedNode(nodeID string) string {
+  addr, err := network.SeedNode(nodeID)
+  if err != nil {
+    fmt.Printf("Could not read node config: %s\n", err)
+    runtime.Goexit()
+  }
+  return addr
+}
+
+func (cli *CommandLine) send(from []string, change string, payments []blockchain.Payment, opts blockchain.TxOptions, nodeID string, mineNow bool) {
+  if change == "" {
+    change = from[0]
+  }
+
+  if !wallet.ValidateAddress(change) {
     log.Panic("Address is not valid.")
   }
 
+  if client := nodeClient(nodeID); client != nil {
+    if mineNow {
+      rejectMine()
+    }
+    rpcSend(client, from, change, payments, opts)
+    return
+  }
+
+  // Retrieve wallets 'managed' by the node
+  sources := loadSourceWallets(from, nodeID)
+
   chain := blockchain.ContinueBlockChain(nodeID)
   UTXOSet := blockchain.UTXOSet{chain}
   defer chain.Database.Close()
 
-  // Retrieve wallets 'managed' by the node
-  wallets, err := wallet.LoadWallets(nodeID)
-  if err != nil {
-    log.Panic(err)
+  tx := blockchain.NewMultiSourceTransaction(sources, payments, change, opts, &UTXOSet)
+
+  cli.submitTx(chain, &UTXOSet, tx, from[0], nodeID, mineNow)
+
+  fmt.Println()
+  fmt.Println("Success. Details:")
+  for _, address := range from {
+    fmt.Printf("  From: %s\n", address)
   }
-  fromWallet := wallets.GetWallet(from)
+  for _, p := range payments {
+    fmt.Printf("  To: %s  Amount: %d\n", p.Address, p.Amount)
+  }
+  fmt.Printf("  Recipients: %d\n", len(payments))
+  fmt.Printf("  Total: %d\n", blockchain.TotalPayments(payments))
+  fmt.Printf("  Fee: %d\n", opts.Fee)
+  fmt.Printf("  TXID: %x\n", tx.ID)
+  fmt.Println()
+}
 
-  tx := blockchain.NewTransaction(&fromWallet, to, amount, &UTXOSet)
+// Move all funds of the given addresses to one destination
+func (cli *CommandLine) sweep(from []string, to string, opts blockchain.TxOptions, nodeID string, mineNow bool) {
+  if !wallet.ValidateAddress(to) {
+    log.Panic("Address is not valid.")
+  }
+
+  if client := nodeClient(nodeID); client != nil {
+    if mineNow {
+      rejectMine()
+    }
+    rpcSweep(client, from, to, opts)
+    return
+  }
+
+  sources := loadSourceWallets(from, nodeID)
 
+  chain := blockchain.ContinueBlockChain(nodeID)
+  UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+  defer chain.Database.Close()
+
+  tx := blockchain.NewSweepTransaction(sources, to, opts, &UTXOSet)
+
+  cli.submitTx(chain, &UTXOSet, tx, from[0], nodeID, mineNow)
+
+  fmt.Println()
+  fmt.Println("Success. Details:")
+  for _, address := range from {
+    fmt.Printf("  From: %s\n", address)
+  }
+  fmt.Printf("  To: %s\n", to)
+  fmt.Printf("  Inputs swept: %d\n", len(tx.Inputs))
+  fmt.Printf("  Total: %d\n", tx.Outputs[0].Value)
+  fmt.Printf("  Fee: %d\n", opts.Fee)
+  fmt.Printf("  TXID: %x\n", tx.ID)
+  fmt.Println()
+}
+
+// Mine tx into a block right away or hand it to the network
+// Txs sent to the network are remembered for bumpfee until they are mined
+func (cli *CommandLine) submitTx(chain *blockchain.BlockChain, UTXOSet *blockchain.UTXOSet, tx *blockchain.Transaction, minerAddress, nodeID string, mineNow bool) {
   if mineNow {
+    prevOutputs, err := chain.PrevOutputs(tx)
+    blockchain.Handle(err)
+
     // Tx for rewarding miner
-    cbtx := blockchain.CoinbaseTx(from, "")
+    cbtx := blockchain.NewCoinbaseTx(minerAddress, "", tx.Fee(prevOutputs))
     txs := []*blockchain.Transaction{cbtx, tx}
     block := chain.MineBlock(txs)
     UTXOSet.Update(block)
   } else {
-    network.SendTx(network.KnownNodes[0], tx)
+    network.SendTx(seedNode(nodeID), tx)
     fmt.Println("Tx sent")
+
+    walletTxs, err := blockchain.LoadWalletTxs(nodeID)
+    blockchain.Handle(err)
+    walletTxs.Add(tx)
+    walletTxs.SaveFile(nodeID)
+  }
+}
+
+// Replace an unconfirmed replaceable tx sent by this node with one paying newFee
+// newFee of 0 means the current fee plus the minimum bump
+func (cli *CommandLine) bumpFee(txID string, newFee int, nodeID string) {
+  if client := nodeClient(nodeID); client != nil {
+    rpcBumpFee(client, txID, newFee)
+    return
+  }
+
+  walletTxs, err := blockchain.LoadWalletTxs(nodeID)
+  blockchain.Handle(err)
+
+  orig, ok := walletTxs.Get(txID)
+  if !ok {
+    fmt.Printf("Tx %s was not sent by this node's wallets\n", txID)
+    runtime.Goexit()
+  }
+
+  wallets, err := wallet.LoadWallets(nodeID)
+  if err != nil {
+    log.Panic(err)
   }
 
+  var ws []*wallet.Wallet
+  for _, w := range wallets.Wallets {
+    ws = append(ws, w)
+  }
+
+  chain := blockchain.ContinueBlockChain(nodeID)
+  defer chain.Database.Close()
+
+  prevOutputs, err := chain.PrevOutputs(&orig)
+  if err != nil {
+    fmt.Println(err)
+    runtime.Goexit()
+  }
+
+  oldFee := orig.Fee(prevOutputs)
+  if newFee == 0 {
+    newFee = oldFee + mempool.MinReplacementBump
+  }
+
+  tx, err := blockchain.BumpFeeTransaction(&orig, prevOutputs, ws, newFee)
+  if err != nil {
+    fmt.Println(err)
+    runtime.Goexit()
+  }
+
+  network.SendTx(seedNode(nodeID), tx)
+
+  walletTxs.Remove(txID)
+  walletTxs.Add(tx)
+  walletTxs.SaveFile(nodeID)
+
   fmt.Println()
-  fmt.Println("Success. Details:")
-  fmt.Printf("  From: %s\n", from)
-  fmt.Printf("  To: %s\n", to)
-  fmt.Printf("  Amount: %d\n", amount)
+  fmt.Printf("Replaced %s\n", txID)
+  fmt.Printf("  New TXID: %x\n", tx.ID)
+  fmt.Printf("  Fee: %d -> %d\n", oldFee, newFee)
   fmt.Println()
 }
 
 func (cli *CommandLine) printChain(nodeID string) {
+  if client := nodeClient(nodeID); client != nil {
+    rpcPrintChain(client)
+    return
+  }
+
   chain := blockchain.ContinueBlockChain(nodeID)
   defer chain.Database.Close()
   iter := chain.Iterator()
@@ -169,6 +390,11 @@ func (cli *CommandLine) printChain(nodeID string) {
 }
 
 func (cli *CommandLine) listAddresses(nodeID string) {
+  if client := nodeClient(nodeID); client != nil {
+    rpcListAddresses(client)
+    return
+  }
+
   wallets, _ := wallet.LoadWallets(nodeID)
   addresses := wallets.GetAllAddresses()
 
@@ -181,6 +407,12 @@ func (cli *CommandLine) listAddresses(nodeID string) {
 }
 
 func (cli *CommandLine) createWallet(nodeID string, num int) {
+  // The running node would not know about wallets added to the file
+  if client := nodeClient(nodeID); client != nil {
+    rpcCreateWallet(client, num)
+    return
+  }
+
   wallets, _ := wallet.LoadWallets(nodeID)
 
   for i := 0; i < num; i++ {
@@ -206,18 +438,66 @@ func (cli *CommandLine) createWallet(nodeID string, num int) {
   fmt.Println()
 }*/
 
-func (cli *CommandLine) startNode(nodeID, minerAddress string) {
-  fmt.Printf("Starting Node %s\n", nodeID)
+func (cli *CommandLine) startNode(cfg network.Config, rpcCfg rpc.Config) {
+  fmt.Printf("Starting Node %s\n", cfg.NodeID)
 
-  if len(minerAddress) != 0 {
-    if wallet.ValidateAddress(minerAddress) {
-      fmt.Printf("Mining is on. Address to receive rewards: %s\n", minerAddress)
+  if len(cfg.MinerAddress) != 0 {
+    if wallet.ValidateAddress(cfg.MinerAddress) {
+      fmt.Printf("Mining is on. Address to receive rewards: %s\n", cfg.MinerAddress)
     } else {
       log.Panic("Wrong miner address!")
     }
   }
 
-  network.StartServer(nodeID, minerAddress)
+  chain := blockchain.ContinueBlockChain(cfg.NodeID)
+
+  // A node without wallets gets an empty set
+  wallets, _ := wallet.LoadWallets(cfg.NodeID)
+
+  node, err := network.NewNode(cfg, chain, wallets)
+  blockchain.Handle(err)
+
+  // Runs until interrupted or stopped over RPC, then shuts down and exits 0
+  sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+  defer stop()
+  ctx, cancel := context.WithCancel(sigCtx)
+  defer cancel()
+
+  err = node.Start(ctx)
+  blockchain.Handle(err)
+
+  server := rpc.NewServer(rpcCfg, node, cancel)
+  err = server.Start(ctx)
+  blockchain.Handle(err)
+
+  go func() {
+    <-ctx.Done()
+    // A second interrupt kills the process the usual way
+    stop()
+    fmt.Println("Shutting down, interrupt again to force")
+  }()
+
+  <-server.Done()
+  <-node.Done()
+  chain.Database.Close()
+  fmt.Println("Database closed")
+}
+
+// Status of the node at node, the one at NODE_ID if it is empty
+func (cli *CommandLine) status(node, nodeID string) {
+  if node == "" {
+    node = nodeAddress(nodeID)
+  }
+
+  st, err := network.RequestStatus(node)
+  if err != nil {
+    fmt.Printf("Could not get status of %s: %s\n", node, err)
+    runtime.Goexit()
+  }
+
+  fmt.Println()
+  st.Print()
+  fmt.Println()
 }
 
 func (cli *CommandLine) Run() {
@@ -228,6 +508,8 @@ func (cli *CommandLine) Run() {
     fmt.Println("NODE_ID env is not set")
     runtime.Goexit()
   }
+  // One-shot commands to the node authenticate with its key
+  network.UseNodeKey(nodeID)
 
   getBalanceCmd := flag.NewFlagSet("balance", flag.ExitOnError)
   createBlockchainCmd := flag.NewFlagSet("createchain", flag.ExitOnError)
@@ -237,16 +519,86 @@ func (cli *CommandLine) Run() {
   listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
   // reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
   startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+  sweepCmd := flag.NewFlagSet("sweep", flag.ExitOnError)
+  createPSBTCmd := flag.NewFlagSet("createpsbt", flag.ExitOnError)
+  signPSBTCmd := flag.NewFlagSet("signpsbt", flag.ExitOnError)
+  combinePSBTCmd := flag.NewFlagSet("combinepsbt", flag.ExitOnError)
+  finalizePSBTCmd := flag.NewFlagSet("finalizepsbt", flag.ExitOnError)
+  broadcastCmd := flag.NewFlagSet("broadcast", flag.ExitOnError)
+  createRawTxCmd := flag.NewFlagSet("createrawtx", flag.ExitOnError)
+  decodeRawTxCmd := flag.NewFlagSet("decoderawtx", flag.ExitOnError)
+  signRawTxCmd := flag.NewFlagSet("signrawtx", flag.ExitOnError)
+  sendRawTxCmd := flag.NewFlagSet("sendrawtx", flag.ExitOnError)
+  bumpFeeCmd := flag.NewFlagSet("bumpfee", flag.ExitOnError)
+  statusCmd := flag.NewFlagSet("status", flag.ExitOnError)
+  watchCmd := flag.NewFlagSet("watch", flag.ExitOnError)
 
   // String() params: name, value, usage
   getBalanceAddress := getBalanceCmd.String("a", "", "The address to get balance for")
   createBlockchainAddress := createBlockchainCmd.String("a", "", "The address to send genesis block reward to")
-  sendFrom := sendCmd.String("f", "", "Sender wallet address")
-  sendTo := sendCmd.String("t", "", "Receiver wallet address")
-  sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+  var sendFrom listFlag
+  sendCmd.Var(&sendFrom, "f", "Sender wallet address (repeatable)")
+  sendChange := sendCmd.String("change", "", "Address to send change to, defaults to first sender")
+  var sendTo listFlag
+  sendCmd.Var(&sendTo, "t", "Receiver wallet address, or ADDR:AMOUNT (repeatable)")
+  sendAmount := sendCmd.Int("amount", 0, "Amount to send to receivers given without an amount")
+  sendFile := sendCmd.String("file", "", "CSV (address,amount) or JSON payout file")
   sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+  sendFee := sendCmd.Int("fee", 0, "Fee paid to the miner")
+  sendRBF := sendCmd.Bool("rbf", false, "Allow replacing the tx with a higher fee one (see bumpfee)")
   numOfWallets := createWalletCmd.Int("n", 1, "Number of wallets to be created")
   startNodeMiner := startNodeCmd.String("miner", "", "Enable mining node and send reward to ADDRESS")
+  startNodeInterval := startNodeCmd.Duration("interval", mining.DefaultConfig.MinInterval, "Least time between two mined blocks")
+  startNodeBlockSize := startNodeCmd.Int("blocksize", mining.DefaultConfig.MaxBlockSize, "Largest block to mine in bytes")
+  startNodeEncrypt := startNodeCmd.Bool("encrypt", false, "Only accept encrypted connections and encrypt outgoing ones")
+  startNodeAllow := startNodeCmd.String("allow", "", "Comma separated node keys allowed to connect, implies -encrypt")
+  startNodeListen := startNodeCmd.String("listen", "", "Address to listen on, HOST:PORT or :PORT for all interfaces")
+  startNodeExternalIP := startNodeCmd.String("externalip", "", "Host other nodes reach this one at")
+  var startNodeConnect, startNodeAddNode listFlag
+  startNodeCmd.Var(&startNodeConnect, "connect", "Only connect to this node (repeatable)")
+  startNodeCmd.Var(&startNodeAddNode, "addnode", "Also connect to this node (repeatable)")
+  startNodeRPCListen := startNodeCmd.String("rpclisten", "", "Address to serve RPC on, defaults to a free localhost port")
+  startNodeRPCUser := startNodeCmd.String("rpcuser", "", "RPC user name")
+  startNodeRPCPassword := startNodeCmd.String("rpcpassword", "", "RPC password, a new one each start unless given")
+  startNodeREST := startNodeCmd.Bool("rest", false, "Serve read-only REST endpoints on the RPC address, without auth")
+  var sweepFrom listFlag
+  sweepCmd.Var(&sweepFrom, "f", "Wallet address to sweep (repeatable)")
+  sweepTo := sweepCmd.String("t", "", "Destination address")
+  sweepMine := sweepCmd.Bool("mine", false, "Mine immediately on the same node")
+  sweepFee := sweepCmd.Int("fee", 0, "Fee paid to the miner, taken from the swept amount")
+  sweepRBF := sweepCmd.Bool("rbf", false, "Allow replacing the tx with a higher fee one (see bumpfee)")
+  var createPSBTFrom, createPSBTTo listFlag
+  createPSBTCmd.Var(&createPSBTFrom, "f", "Source address (repeatable)")
+  createPSBTCmd.Var(&createPSBTTo, "t", "Receiver wallet address, or ADDR:AMOUNT (repeatable)")
+  createPSBTAmount := createPSBTCmd.Int("amount", 0, "Amount to send to receivers given without an amount")
+  createPSBTFile := createPSBTCmd.String("file", "", "CSV (address,amount) or JSON payout file")
+  createPSBTChange := createPSBTCmd.String("change", "", "Address to send change to, defaults to first source")
+  createPSBTOut := createPSBTCmd.String("out", "", "File to write to")
+  createPSBTFee := createPSBTCmd.Int("fee", 0, "Fee paid to the miner")
+  createPSBTRBF := createPSBTCmd.Bool("rbf", false, "Allow replacing the tx with a higher fee one")
+  signPSBTIn := signPSBTCmd.String("in", "", "Partially signed transaction file")
+  signPSBTOut := signPSBTCmd.String("out", "", "File to write to")
+  var combinePSBTIn listFlag
+  combinePSBTCmd.Var(&combinePSBTIn, "in", "Partially signed transaction file (repeatable)")
+  combinePSBTOut := combinePSBTCmd.String("out", "", "File to write to")
+  finalizePSBTIn := finalizePSBTCmd.String("in", "", "Partially signed transaction file")
+  finalizePSBTOut := finalizePSBTCmd.String("out", "", "File to write raw tx hex to")
+  broadcastIn := broadcastCmd.String("in", "", "Partially signed transaction file")
+  var createRawTxInputs, createRawTxTo listFlag
+  createRawTxCmd.Var(&createRawTxInputs, "input", "Output to spend as TXID:OUT (repeatable)")
+  createRawTxCmd.Var(&createRawTxTo, "t", "Receiver as ADDR:AMOUNT (repeatable)")
+  decodeRawTxHex := decodeRawTxCmd.String("hex", "", "Raw transaction hex")
+  decodeRawTxIn := decodeRawTxCmd.String("in", "", "File containing raw transaction hex")
+  signRawTxHex := signRawTxCmd.String("hex", "", "Raw transaction hex")
+  signRawTxIn := signRawTxCmd.String("in", "", "File containing raw transaction hex")
+  sendRawTxHex := sendRawTxCmd.String("hex", "", "Raw transaction hex")
+  sendRawTxIn := sendRawTxCmd.String("in", "", "File containing raw transaction hex")
+  bumpFeeTxID := bumpFeeCmd.String("txid", "", "ID of the tx to replace")
+  bumpFeeFee := bumpFeeCmd.Int("fee", 0, "New total fee")
+  statusNode := statusCmd.String("node", "", "Address of the node (default the one at NODE_ID)")
+  var watchTopics, watchAddresses listFlag
+  watchCmd.Var(&watchTopics, "topic", "Topic to follow, all if none given (repeatable)")
+  watchCmd.Var(&watchAddresses, "address", "Address to follow payments to (repeatable)")
 
   // Parse arguments for checking afterwards
   switch os.Args[1] {
@@ -282,6 +634,58 @@ func (cli *CommandLine) Run() {
     err := startNodeCmd.Parse(os.Args[2:])
     blockchain.Handle(err)
 
+  case "sweep":
+    err := sweepCmd.Parse(os.Args[2:])
+    blockchain.Handle(err)
+
+  case "createpsbt":
+    err := createPSBTCmd.Parse(os.Args[2:])
+    blockchain.Handle(err)
+
+  case "signpsbt":
+    err := signPSBTCmd.Parse(os.Args[2:])
+    blockchain.Handle(err)
+
+  case "combinepsbt":
+    err := combinePSBTCmd.Parse(os.Args[2:])
+    blockchain.Handle(err)
+
+  case "finalizepsbt":
+    err := finalizePSBTCmd.Parse(os.Args[2:])
+    blockchain.Handle(err)
+
+  case "broadcast":
+    err := broadcastCmd.Parse(os.Args[2:])
+    blockchain.Handle(err)
+
+  case "createrawtx":
+    err := createRawTxCmd.Parse(os.Args[2:])
+    blockchain.Handle(err)
+
+  case "decoderawtx":
+    err := decodeRawTxCmd.Parse(os.Args[2:])
+    blockchain.Handle(err)
+
+  case "signrawtx":
+    err := signRawTxCmd.Parse(os.Args[2:])
+    blockchain.Handle(err)
+
+  case "sendrawtx":
+    err := sendRawTxCmd.Parse(os.Args[2:])
+    blockchain.Handle(err)
+
+  case "bumpfee":
+    err := bumpFeeCmd.Parse(os.Args[2:])
+    blockchain.Handle(err)
+
+  case "status":
+    err := statusCmd.Parse(os.Args[2:])
+    blockchain.Handle(err)
+
+  case "watch":
+    err := watchCmd.Parse(os.Args[2:])
+    blockchain.Handle(err)
+
   default:
     cli.printUsage()
     runtime.Goexit()
@@ -309,11 +713,128 @@ func (cli *CommandLine) Run() {
   }
 
   if sendCmd.Parsed() {
-    if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+    if len(sendFrom) == 0 || (len(sendTo) == 0 && *sendFile == "") {
+      sendCmd.Usage()
+      runtime.Goexit()
+    }
+    payments, err := collectPayments(sendTo, *sendAmount, *sendFile)
+    if err != nil {
+      fmt.Println(err)
       sendCmd.Usage()
       runtime.Goexit()
     }
-    cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+    opts := blockchain.TxOptions{Fee: *sendFee, Replaceable: *sendRBF}
+    cli.send(sendFrom, *sendChange, payments, opts, nodeID, *sendMine)
+  }
+
+  if sweepCmd.Parsed() {
+    if len(sweepFrom) == 0 || *sweepTo == "" {
+      sweepCmd.Usage()
+      runtime.Goexit()
+    }
+    opts := blockchain.TxOptions{Fee: *sweepFee, Replaceable: *sweepRBF}
+    cli.sweep(sweepFrom, *sweepTo, opts, nodeID, *sweepMine)
+  }
+
+  if createPSBTCmd.Parsed() {
+    if len(createPSBTFrom) == 0 || (len(createPSBTTo) == 0 && *createPSBTFile == "") {
+      createPSBTCmd.Usage()
+      runtime.Goexit()
+    }
+    payments, err := collectPayments(createPSBTTo, *createPSBTAmount, *createPSBTFile)
+    if err != nil {
+      fmt.Println(err)
+      createPSBTCmd.Usage()
+      runtime.Goexit()
+    }
+    opts := blockchain.TxOptions{Fee: *createPSBTFee, Replaceable: *createPSBTRBF}
+    cli.createPSBT(createPSBTFrom, *createPSBTChange, payments, opts, *createPSBTOut, nodeID)
+  }
+
+  if signPSBTCmd.Parsed() {
+    if *signPSBTIn == "" {
+      signPSBTCmd.Usage()
+      runtime.Goexit()
+    }
+    cli.signPSBT(*signPSBTIn, *signPSBTOut, nodeID)
+  }
+
+  if combinePSBTCmd.Parsed() {
+    if len(combinePSBTIn) < 2 {
+      combinePSBTCmd.Usage()
+      runtime.Goexit()
+    }
+    cli.combinePSBT(combinePSBTIn, *combinePSBTOut)
+  }
+
+  if finalizePSBTCmd.Parsed() {
+    if *finalizePSBTIn == "" {
+      finalizePSBTCmd.Usage()
+      runtime.Goexit()
+    }
+    cli.finalizePSBT(*finalizePSBTIn, *finalizePSBTOut)
+  }
+
+  if broadcastCmd.Parsed() {
+    if *broadcastIn == "" {
+      broadcastCmd.Usage()
+      runtime.Goexit()
+    }
+    cli.broadcastPSBT(*broadcastIn, nodeID)
+  }
+
+  if createRawTxCmd.Parsed() {
+    if len(createRawTxInputs) == 0 || len(createRawTxTo) == 0 {
+      createRawTxCmd.Usage()
+      runtime.Goexit()
+    }
+    payments, err := collectPayments(createRawTxTo, 0, "")
+    if err != nil {
+      fmt.Println(err)
+      createRawTxCmd.Usage()
+      runtime.Goexit()
+    }
+    cli.createRawTx(createRawTxInputs, payments)
+  }
+
+  if decodeRawTxCmd.Parsed() {
+    if *decodeRawTxHex == "" && *decodeRawTxIn == "" {
+      decodeRawTxCmd.Usage()
+      runtime.Goexit()
+    }
+    cli.decodeRawTx(*decodeRawTxHex, *decodeRawTxIn)
+  }
+
+  if signRawTxCmd.Parsed() {
+    if *signRawTxHex == "" && *signRawTxIn == "" {
+      signRawTxCmd.Usage()
+      runtime.Goexit()
+    }
+    cli.signRawTx(*signRawTxHex, *signRawTxIn, nodeID)
+  }
+
+  if sendRawTxCmd.Parsed() {
+    if *sendRawTxHex == "" && *sendRawTxIn == "" {
+      sendRawTxCmd.Usage()
+      runtime.Goexit()
+    }
+    cli.sendRawTx(*sendRawTxHex, *sendRawTxIn, nodeID)
+  }
+
+  if bumpFeeCmd.Parsed() {
+    if *bumpFeeTxID == "" || *bumpFeeFee < 0 {
+      bumpFeeCmd.Usage()
+      runtime.Goexit()
+    }
+    cli.bumpFee(*bumpFeeTxID, *bumpFeeFee, nodeID)
+  }
+
+  if statusCmd.Parsed() {
+    cli.status(*statusNode, nodeID)
+  }
+
+  if watchCmd.Parsed() {
+    cli.watch(watchTopics, watchAddresses, nodeID)
   }
 
   if createWalletCmd.Parsed() {
@@ -334,6 +855,40 @@ func (cli *CommandLine) Run() {
       fmt.Println("NODE_ID env is not set")
       runtime.Goexit()
     }
-    cli.startNode(nodeID, *startNodeMiner)
+    cfg := network.DefaultConfig
+    cfg.NodeID = nodeID
+    cfg.MinerAddress = *startNodeMiner
+    cfg.Mining = mining.Config{MaxBlockSize: *startNodeBlockSize, MinInterval: *startNodeInterval}
+    cfg.Transport.Encrypt = *startNodeEncrypt
+    if *startNodeAllow != "" {
+      cfg.Transport.AllowList = strings.Split(*startNodeAllow, ",")
+    }
+
+    // Flags override the config file in the data dir
+    netCfg, err := network.LoadNetConfig(nodeID)
+    blockchain.Handle(err)
+    if *startNodeListen != "" {
+      netCfg.Listen = *startNodeListen
+    }
+    if *startNodeExternalIP != "" {
+      netCfg.ExternalIP = *startNodeExternalIP
+    }
+    if len(startNodeConnect) > 0 {
+      netCfg.Connect = startNodeConnect
+    }
+    netCfg.AddNodes = append(netCfg.AddNodes, startNodeAddNode...)
+    cfg.Net = netCfg
+
+    rpcCfg := rpc.DefaultConfig
+    if *startNodeRPCListen != "" {
+      rpcCfg.Listen = *startNodeRPCListen
+    }
+    if *startNodeRPCUser != "" {
+      rpcCfg.User = *startNodeRPCUser
+    }
+    rpcCfg.Password = *startNodeRPCPassword
+    rpcCfg.REST = *startNodeREST
+
+    cli.startNode(cfg, rpcCfg)
   }
 }
@@ -0,0 +1,153 @@
+package cli
+
+import (
+  "encoding/csv"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "github.com/LidoKing/learnBlockchain/blockchain"
+  "github.com/LidoKing/learnBlockchain/blockchain/wallet"
+)
+
+// Repeatable flag, e.g. -t ADDR1:10 -t ADDR2:25
+type listFlag []string
+
+func (l *listFlag) String() string {
+  return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+  *l = append(*l, value)
+  return nil
+}
+
+// Turn "ADDR:AMOUNT" (or plain "ADDR" paid with defaultAmount) into a payment
+func parseRecipient(value string, defaultAmount int) (blockchain.Payment, error) {
+  address := value
+  amount := defaultAmount
+
+  if i := strings.LastIndex(value, ":"); i != -1 {
+    address = value[:i]
+    parsed, err := strconv.Atoi(value[i+1:])
+    if err != nil {
+      return blockchain.Payment{}, fmt.Errorf("invalid amount in %q", value)
+    }
+    amount = parsed
+  }
+
+  return newPayment(address, amount)
+}
+
+func newPayment(address string, amount int) (blockchain.Payment, error) {
+  address = strings.TrimSpace(address)
+
+  if amount <= 0 {
+    return blockchain.Payment{}, fmt.Errorf("amount for %s must be positive", address)
+  }
+  if !wallet.ValidateAddress(address) {
+    return blockchain.Payment{}, fmt.Errorf("address %s is not valid", address)
+  }
+
+  return blockchain.Payment{Address: address, Amount: amount}, nil
+}
+
+// Payout files are either JSON, i.e. [{"address": "...", "amount": 10}, ...]
+// or CSV with one "address,amount" row per recipient (header row optional)
+func loadPaymentsFile(path string) ([]blockchain.Payment, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+
+  if strings.ToLower(filepath.Ext(path)) == ".json" {
+    return decodePaymentsJSON(f)
+  }
+
+  return decodePaymentsCSV(f)
+}
+
+func decodePaymentsJSON(r io.Reader) ([]blockchain.Payment, error) {
+  var rows []struct {
+    Address string `json:"address"`
+    Amount  int    `json:"amount"`
+  }
+
+  if err := json.NewDecoder(r).Decode(&rows); err != nil {
+    return nil, err
+  }
+
+  var payments []blockchain.Payment
+  for _, row := range rows {
+    p, err := newPayment(row.Address, row.Amount)
+    if err != nil {
+      return nil, err
+    }
+    payments = append(payments, p)
+  }
+
+  return payments, nil
+}
+
+func decodePaymentsCSV(r io.Reader) ([]blockchain.Payment, error) {
+  reader := csv.NewReader(r)
+  reader.FieldsPerRecord = 2
+  reader.TrimLeadingSpace = true
+
+  records, err := reader.ReadAll()
+  if err != nil {
+    return nil, err
+  }
+
+  var payments []blockchain.Payment
+  for line, record := range records {
+    amount, err := strconv.Atoi(strings.TrimSpace(record[1]))
+    if err != nil {
+      // Skip header row
+      if line == 0 {
+        continue
+      }
+      return nil, fmt.Errorf("line %d: invalid amount %q", line+1, record[1])
+    }
+
+    p, err := newPayment(record[0], amount)
+    if err != nil {
+      return nil, fmt.Errorf("line %d: %s", line+1, err)
+    }
+    payments = append(payments, p)
+  }
+
+  return payments, nil
+}
+
+// Collect payments from -t flags and the payout file
+func collectPayments(recipients listFlag, amount int, file string) ([]blockchain.Payment, error) {
+  var payments []blockchain.Payment
+
+  for _, r := range recipients {
+    p, err := parseRecipient(r, amount)
+    if err != nil {
+      return nil, err
+    }
+    payments = append(payments, p)
+  }
+
+  if file != "" {
+    filePayments, err := loadPaymentsFile(file)
+    if err != nil {
+      return nil, err
+    }
+    payments = append(payments, filePayments...)
+  }
+
+  if len(payments) == 0 {
+    return nil, errors.New("no recipients given")
+  }
+
+  return payments, nil
+}
@@ -0,0 +1,158 @@
+package cli
+
+import (
+  "encoding/hex"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "runtime"
+  "github.com/LidoKing/learnBlockchain/blockchain"
+  "github.com/LidoKing/learnBlockchain/blockchain/wallet"
+  "github.com/LidoKing/learnBlockchain/network"
+)
+
+// Partially signed transactions are passed around as base64 text files
+
+func readPSBT(path string) *blockchain.PartialTx {
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    log.Panic(err)
+  }
+
+  psbt, err := blockchain.DecodePartialTx(string(data))
+  if err != nil {
+    fmt.Printf("%s: %s\n", path, err)
+    runtime.Goexit()
+  }
+
+  return psbt
+}
+
+// Write to file, or print when no file is given
+func writePSBT(path string, psbt *blockchain.PartialTx) {
+  if path == "" {
+    fmt.Println(psbt.Encode())
+    return
+  }
+
+  err := ioutil.WriteFile(path, []byte(psbt.Encode()+"\n"), 0644)
+  if err != nil {
+    log.Panic(err)
+  }
+  fmt.Printf("Written to %s\n", path)
+}
+
+// Input values are taken from the file, they are covered by the signatures,
+// so a tx built on wrong ones is refused by the network
+func printPSBTStatus(psbt *blockchain.PartialTx) {
+  fmt.Printf("Transaction %x\n", psbt.Tx.ID)
+  fmt.Printf("  Inputs: %d (%d unsigned), value %d, fee %d\n", len(psbt.Tx.Inputs), psbt.Missing(), psbt.InputValue(), psbt.Tx.Fee(psbt.PrevOutputs))
+  for i, out := range psbt.Tx.Outputs {
+    fmt.Printf("  Output %d: %d\n", i, out.Value)
+  }
+}
+
+// Online step, select UTXOs of the source addresses without needing their keys
+func (cli *CommandLine) createPSBT(from []string, change string, payments []blockchain.Payment, opts blockchain.TxOptions, out, nodeID string) {
+  for _, address := range from {
+    if !wallet.ValidateAddress(address) {
+      log.Panic("Address is not valid.")
+    }
+  }
+
+  if change == "" {
+    change = from[0]
+  }
+
+  if !wallet.ValidateAddress(change) {
+    log.Panic("Address is not valid.")
+  }
+
+  if client := nodeClient(nodeID); client != nil {
+    psbt := rpcCreatePSBT(client, from, change, payments, opts)
+
+    printPSBTStatus(psbt)
+    writePSBT(out, psbt)
+    return
+  }
+
+  chain := blockchain.ContinueBlockChain(nodeID)
+  UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+  defer chain.Database.Close()
+
+  psbt := blockchain.CreatePartialTx(from, payments, change, opts, &UTXOSet)
+
+  printPSBTStatus(psbt)
+  writePSBT(out, psbt)
+}
+
+// Offline step, only the wallet file is needed
+func (cli *CommandLine) signPSBT(in, out, nodeID string) {
+  psbt := readPSBT(in)
+
+  wallets, err := wallet.LoadWallets(nodeID)
+  if err != nil {
+    log.Panic(err)
+  }
+
+  var ws []*wallet.Wallet
+  for _, w := range wallets.Wallets {
+    ws = append(ws, w)
+  }
+
+  signed := psbt.Sign(ws)
+  fmt.Printf("Signed %d input(s)\n", signed)
+
+  printPSBTStatus(psbt)
+  writePSBT(out, psbt)
+}
+
+func (cli *CommandLine) combinePSBT(in []string, out string) {
+  psbt := readPSBT(in[0])
+
+  for _, path := range in[1:] {
+    if err := psbt.Combine(readPSBT(path)); err != nil {
+      fmt.Printf("%s: %s\n", path, err)
+      runtime.Goexit()
+    }
+  }
+
+  printPSBTStatus(psbt)
+  writePSBT(out, psbt)
+}
+
+func finalizePSBT(in string) *blockchain.Transaction {
+  psbt := readPSBT(in)
+
+  tx, err := psbt.Finalize()
+  if err != nil {
+    fmt.Println(err)
+    runtime.Goexit()
+  }
+
+  return tx
+}
+
+// Print fully signed tx as hex
+func (cli *CommandLine) finalizePSBT(in, out string) {
+  tx := finalizePSBT(in)
+  raw := hex.EncodeToString(tx.Serialize())
+
+  if out == "" {
+    fmt.Println(raw)
+    return
+  }
+
+  err := ioutil.WriteFile(out, []byte(raw+"\n"), 0644)
+  if err != nil {
+    log.Panic(err)
+  }
+  fmt.Printf("Written to %s\n", out)
+}
+
+func (cli *CommandLine) broadcastPSBT(in, nodeID string) {
+  tx := finalizePSBT(in)
+
+  network.SendTx(seedNode(nodeID), tx)
+  fmt.Printf("Tx %x sent\n", tx.ID)
+}
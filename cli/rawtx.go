@@ -0,0 +1,143 @@
+package cli
+
+import (
+  "encoding/hex"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "runtime"
+  "strconv"
+  "strings"
+  "github.com/LidoKing/learnBlockchain/blockchain"
+  "github.com/LidoKing/learnBlockchain/blockchain/wallet"
+  "github.com/LidoKing/learnBlockchain/network"
+)
+
+// Raw txs are hex-encoded serialized transactions, given with -hex or read from -in FILE
+
+// Turn "TXID:OUT" into an (unsigned) input
+func parseOutpoint(value string) (blockchain.TxInput, error) {
+  i := strings.LastIndex(value, ":")
+  if i == -1 {
+    return blockchain.TxInput{}, fmt.Errorf("input %q is not in the form TXID:OUT", value)
+  }
+
+  txID, err := hex.DecodeString(value[:i])
+  if err != nil {
+    return blockchain.TxInput{}, fmt.Errorf("invalid txid in %q", value)
+  }
+
+  out, err := strconv.Atoi(value[i+1:])
+  if err != nil || out < 0 {
+    return blockchain.TxInput{}, fmt.Errorf("invalid output index in %q", value)
+  }
+
+  return blockchain.TxInput{ID: txID, Out: out}, nil
+}
+
+func readRawTx(rawHex, in string) *blockchain.Transaction {
+  if in != "" {
+    data, err := ioutil.ReadFile(in)
+    if err != nil {
+      log.Panic(err)
+    }
+    rawHex = string(data)
+  }
+
+  tx, err := blockchain.TransactionFromHex(rawHex)
+  if err != nil {
+    fmt.Printf("Invalid raw transaction: %s\n", err)
+    runtime.Goexit()
+  }
+
+  return tx
+}
+
+func (cli *CommandLine) createRawTx(outpoints []string, payments []blockchain.Payment) {
+  var inputs []blockchain.TxInput
+
+  for _, o := range outpoints {
+    input, err := parseOutpoint(o)
+    if err != nil {
+      fmt.Println(err)
+      runtime.Goexit()
+    }
+    inputs = append(inputs, input)
+  }
+
+  tx := blockchain.NewRawTransaction(inputs, payments)
+
+  fmt.Println(tx.Hex())
+}
+
+func (cli *CommandLine) decodeRawTx(rawHex, in string) {
+  tx := readRawTx(rawHex, in)
+
+  total := 0
+  for _, out := range tx.Outputs {
+    total += out.Value
+  }
+
+  fmt.Println()
+  fmt.Printf("TXID: %x\n", tx.ID)
+  fmt.Printf("Size: %d bytes\n", len(tx.Serialize()))
+  fmt.Printf("Coinbase: %s\n", strconv.FormatBool(tx.IsCoinbase()))
+
+  for i, input := range tx.Inputs {
+    signed := len(input.Sig) > 0
+    fmt.Printf("  Input %d: %x:%d signed: %s\n", i, input.ID, input.Out, strconv.FormatBool(signed))
+  }
+
+  for i, output := range tx.Outputs {
+    fmt.Printf("  Output %d: %d to %s\n", i, output.Value, wallet.AddressFromPubKeyHash(output.PubKeyHash))
+  }
+
+  fmt.Printf("Total output: %d\n", total)
+  fmt.Println()
+  fmt.Println(tx)
+  fmt.Println()
+}
+
+// Sign every input owned by this node's wallets
+func (cli *CommandLine) signRawTx(rawHex, in, nodeID string) {
+  tx := readRawTx(rawHex, in)
+
+  if client := nodeClient(nodeID); client != nil {
+    rpcSignRawTx(client, tx)
+    return
+  }
+
+  wallets, err := wallet.LoadWallets(nodeID)
+  if err != nil {
+    log.Panic(err)
+  }
+
+  var ws []*wallet.Wallet
+  for _, w := range wallets.Wallets {
+    ws = append(ws, w)
+  }
+
+  // Spent outputs are needed to know the owner of each input
+  chain := blockchain.ContinueBlockChain(nodeID)
+  defer chain.Database.Close()
+
+  prevOutputs, err := chain.PrevOutputs(tx)
+  if err != nil {
+    fmt.Println(err)
+    runtime.Goexit()
+  }
+
+  signed := tx.SignWith(ws, prevOutputs)
+  complete := tx.FullySigned(prevOutputs)
+
+  fmt.Printf("Signed %d input(s), complete: %s\n", signed, strconv.FormatBool(complete))
+  fmt.Println(tx.Hex())
+}
+
+// Hand tx to the mempool of the local node, i.e. the one at NODE_ID
+func (cli *CommandLine) sendRawTx(rawHex, in, nodeID string) {
+  tx := readRawTx(rawHex, in)
+
+  network.SendTx(nodeAddress(nodeID), tx)
+  fmt.Printf("Tx %x sent\n", tx.ID)
+}
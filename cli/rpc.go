@@ -0,0 +1,210 @@
+package cli
+
+import (
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "os"
+  "runtime"
+  "strconv"
+  "github.com/LidoKing/learnBlockchain/blockchain"
+  "github.com/LidoKing/learnBlockchain/rpc"
+)
+
+// A running node holds the database and wallets, commands then go through its RPC server
+
+// Client of the node NODE_ID if it is running, otherwise nil
+func nodeClient(nodeID string) *rpc.Client {
+  client, err := rpc.Dial(nodeID)
+  if err != nil {
+    return nil
+  }
+  return client
+}
+
+// Make an RPC call, a failed call ends the command
+func call(client *rpc.Client, method string, result interface{}, params ...interface{}) {
+  if err := client.Call(method, result, params...); err != nil {
+    fmt.Println(err)
+    runtime.Goexit()
+  }
+}
+
+func rpcGetBalance(client *rpc.Client, address string) {
+  var balance int
+  call(client, "getbalance", &balance, address)
+
+  fmt.Println()
+  fmt.Printf("Balance of %s: %d\n", address, balance)
+  fmt.Println()
+}
+
+func rpcSend(client *rpc.Client, from []string, change string, payments []blockchain.Payment, opts blockchain.TxOptions) {
+  var txID string
+  call(client, "sendmany", &txID, from, payments, change, opts.Fee, opts.Replaceable)
+  fmt.Println("Tx sent")
+
+  fmt.Println()
+  fmt.Println("Success. Details:")
+  for _, address := range from {
+    fmt.Printf("  From: %s\n", address)
+  }
+  for _, p := range payments {
+    fmt.Printf("  To: %s  Amount: %d\n", p.Address, p.Amount)
+  }
+  fmt.Printf("  Recipients: %d\n", len(payments))
+  fmt.Printf("  Total: %d\n", blockchain.TotalPayments(payments))
+  fmt.Printf("  Fee: %d\n", opts.Fee)
+  fmt.Printf("  TXID: %s\n", txID)
+  fmt.Println()
+}
+
+func rpcSweep(client *rpc.Client, from []string, to string, opts blockchain.TxOptions) {
+  var txID string
+  call(client, "sweep", &txID, from, to, opts.Fee, opts.Replaceable)
+  fmt.Println("Tx sent")
+
+  var tx rpc.TxInfo
+  call(client, "gettransaction", &tx, txID)
+
+  fmt.Println()
+  fmt.Println("Success. Details:")
+  for _, address := range from {
+    fmt.Printf("  From: %s\n", address)
+  }
+  fmt.Printf("  To: %s\n", to)
+  fmt.Printf("  Inputs swept: %d\n", len(tx.Inputs))
+  fmt.Printf("  Total: %d\n", tx.Outputs[0].Value)
+  fmt.Printf("  Fee: %d\n", opts.Fee)
+  fmt.Printf("  TXID: %s\n", txID)
+  fmt.Println()
+}
+
+func rpcBumpFee(client *rpc.Client, txID string, newFee int) {
+  var newTxID string
+  call(client, "bumpfee", &newTxID, txID, newFee)
+
+  fmt.Println()
+  fmt.Printf("Replaced %s\n", txID)
+  fmt.Printf("  New TXID: %s\n", newTxID)
+  fmt.Println()
+}
+
+// Same output as printChain(), blocks are fetched raw and decoded here
+func rpcPrintChain(client *rpc.Client) {
+  var best rpc.BestBlock
+  call(client, "getbestblock", &best)
+
+  hash := best.Hash
+  for {
+    var blockHex string
+    call(client, "getblock", &blockHex, hash, false)
+
+    data, err := hex.DecodeString(blockHex)
+    blockchain.Handle(err)
+    block, err := blockchain.DecodeBlock(data)
+    blockchain.Handle(err)
+
+    // Block info
+    fmt.Println()
+    fmt.Printf("Previous hash: %x\n", block.PrevHash)
+    fmt.Printf("hash: %x\n", block.Hash)
+    fmt.Printf("nonce: %d\n", block.Nonce)
+
+    // PoW validation
+    pow := blockchain.NewProofOfWork(block)
+    fmt.Printf("Pow: %s\n", strconv.FormatBool(pow.Validate()))
+
+    // Transactoins
+    for _, tx := range block.Transactions {
+      fmt.Println(tx)
+      fmt.Println()
+    }
+
+    if len(block.PrevHash) == 0 {
+      break
+    }
+    hash = hex.EncodeToString(block.PrevHash)
+  }
+}
+
+func rpcListAddresses(client *rpc.Client) {
+  var addresses []string
+  call(client, "listaddresses", &addresses)
+
+  fmt.Println()
+  for index, address := range addresses {
+    fmt.Printf("%d: %s\n", index + 1, address)
+  }
+  fmt.Println()
+}
+
+func rpcCreateWallet(client *rpc.Client, num int) {
+  var addresses []string
+  call(client, "createwallet", &addresses, num)
+
+  for _, address := range addresses {
+    fmt.Println()
+    fmt.Printf("New address created: %s\n", address)
+    fmt.Println()
+  }
+}
+
+func rpcCreatePSBT(client *rpc.Client, from []string, change string, payments []blockchain.Payment, opts blockchain.TxOptions) *blockchain.PartialTx {
+  var encoded string
+  call(client, "createpsbt", &encoded, from, payments, change, opts.Fee, opts.Replaceable)
+
+  psbt, err := blockchain.DecodePartialTx(encoded)
+  blockchain.Handle(err)
+
+  return psbt
+}
+
+func rpcSignRawTx(client *rpc.Client, tx *blockchain.Transaction) {
+  var result rpc.SignedTx
+  call(client, "signrawtransaction", &result, tx.Hex())
+
+  fmt.Printf("Signed %d input(s), complete: %s\n", result.Signed, strconv.FormatBool(result.Complete))
+  fmt.Println(result.Hex)
+}
+
+// Mining on the spot needs the database, which the node holds
+func rejectMine() {
+  fmt.Println("Node is running, send without -mine or stop it first")
+  runtime.Goexit()
+}
+
+// Print events of the running node as JSON lines until it stops
+// A payment processor can follow -topic payment -address ADDR instead of polling print
+func (cli *CommandLine) watch(topics, addresses []string, nodeID string) {
+  client := nodeClient(nodeID)
+  if client == nil {
+    fmt.Printf("Node %s is not running\n", nodeID)
+    runtime.Goexit()
+  }
+
+  if topics == nil {
+    topics = []string{}
+  }
+  if addresses == nil {
+    addresses = []string{}
+  }
+
+  // Only events from now on at first, then those after the last one seen
+  var since *uint64
+  for {
+    var result rpc.Events
+    call(client, "waitforevents", &result, since, topics, addresses)
+
+    if result.Missed {
+      fmt.Fprintln(os.Stderr, "Some events were missed, the node no longer has them")
+    }
+    for _, e := range result.Events {
+      line, err := json.Marshal(e)
+      blockchain.Handle(err)
+      fmt.Println(string(line))
+    }
+
+    since = &result.Next
+  }
+}
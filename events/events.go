@@ -0,0 +1,140 @@
+// Package events passes changes of a node's chain and mempool to whoever
+// subscribed to them, like the RPC server streaming them to clients.
+//
+// Publishing never blocks, a subscriber that does not keep up loses events,
+// see Subscription.Dropped().
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/LidoKing/learnBlockchain/blockchain"
+)
+
+type Topic string
+
+const (
+	// The best chain has a new tip, after the blocks connected to reach it
+	Tip Topic = "tip"
+	// Block became part of the best chain
+	BlockConnected Topic = "blockconnected"
+	// Block left the best chain in a reorg, sent tip first
+	BlockDisconnected Topic = "blockdisconnected"
+	// Tx entered the mempool
+	TxAccepted Topic = "tx"
+	// Output paying an address, once when its tx enters the mempool and
+	// again when it is mined
+	Payment Topic = "payment"
+)
+
+var Topics = []Topic{Tip, BlockConnected, BlockDisconnected, TxAccepted, Payment}
+
+type Event struct {
+	// Numbers events of a bus one after another, starting at 1
+	Seq   uint64
+	Topic Topic
+	Time  time.Time
+	// Set for block and tip events, and for payments that were mined
+	Block *blockchain.Block
+	// Set for tx and payment events
+	Tx *blockchain.Transaction
+	// Set for payment events
+	Payment *PaymentOut
+}
+
+// Output of Event.Tx paying Address
+type PaymentOut struct {
+	Address string
+	Out     int
+	Value   int
+}
+
+type Bus struct {
+	mu   sync.Mutex
+	seq  uint64
+	subs map[*Subscription]bool
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*Subscription]bool)}
+}
+
+// Events of the topics subscribed to, all topics if none were given
+type Subscription struct {
+	C <-chan Event
+
+	c      chan Event
+	topics map[Topic]bool
+	bus    *Bus
+	// Guarded by bus.mu
+	dropped uint64
+}
+
+// Subscribe to topics, size events are buffered for a slow subscriber
+func (b *Bus) Subscribe(size int, topics ...Topic) *Subscription {
+	c := make(chan Event, size)
+	s := &Subscription{C: c, c: c, bus: b}
+
+	if len(topics) > 0 {
+		s.topics = make(map[Topic]bool)
+		for _, topic := range topics {
+			s.topics[topic] = true
+		}
+	}
+
+	b.mu.Lock()
+	b.subs[s] = true
+	b.mu.Unlock()
+
+	return s
+}
+
+// Stop receiving and close C
+func (s *Subscription) Unsubscribe() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	if s.bus.subs[s] {
+		delete(s.bus.subs, s)
+		close(s.c)
+	}
+}
+
+// Number of events lost because C was full
+func (s *Subscription) Dropped() uint64 {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	return s.dropped
+}
+
+// Number e and hand it to the subscribers of its topic
+func (b *Bus) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	e.Seq = b.seq
+	e.Time = time.Now()
+
+	for s := range b.subs {
+		if s.topics != nil && !s.topics[e.Topic] {
+			continue
+		}
+
+		select {
+		case s.c <- e:
+		default:
+			s.dropped++
+		}
+	}
+}
+
+// Sequence number of the last event published
+func (b *Bus) Seq() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.seq
+}
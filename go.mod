@@ -5,6 +5,5 @@ go 1.16
 require (
 	github.com/dgraph-io/badger v1.6.2
 	github.com/mr-tron/base58 v1.2.0 // indirect
-	github.com/vrecan/death/v3 v3.0.3 // indirect
 	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2 // indirect
 )
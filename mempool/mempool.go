@@ -0,0 +1,464 @@
+package mempool
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/LidoKing/learnBlockchain/blockchain"
+)
+
+type Config struct {
+	// Total size of serialized pool txs in bytes, lowest fee rate txs are evicted beyond it
+	MaxSize int
+	// Txs not mined within MaxAge are dropped
+	MaxAge time.Duration
+	// Fee per 1000 bytes a tx must pay to be accepted, see blockchain.FeeRate()
+	MinFeeRate int
+}
+
+var DefaultConfig = Config{
+	MaxSize:    1 << 20,
+	MaxAge:     14 * 24 * time.Hour,
+	MinFeeRate: 0,
+}
+
+// Pool tx with what was worked out when it was accepted
+type TxDesc struct {
+	Tx    blockchain.Transaction
+	Added time.Time
+	Fee   int
+	Size  int
+}
+
+func (d *TxDesc) FeeRate() int {
+	return blockchain.FeeRate(d.Fee, d.Size)
+}
+
+// Unconfirmed txs, safe for use from several goroutines
+type Pool struct {
+	mu     sync.RWMutex
+	cfg    Config
+	UTXO   blockchain.UTXOSet
+	txs    map[string]*TxDesc
+	spends map[string]string // "txid:out" -> id of pool tx spending it
+	size   int
+	// Bumped on every add or remove, lets users tell whether the pool changed
+	updates uint64
+}
+
+func New(chain *blockchain.BlockChain, cfg Config) *Pool {
+	return &Pool{
+		cfg:    cfg,
+		UTXO:   blockchain.UTXOSet{Blockchain: chain},
+		txs:    make(map[string]*TxDesc),
+		spends: make(map[string]string),
+	}
+}
+
+func outpoint(txID []byte, out int) string {
+	return fmt.Sprintf("%x:%d", txID, out)
+}
+
+/*-------------------------------queries-------------------------------*/
+
+func (p *Pool) Has(txID []byte) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	_, ok := p.txs[hex.EncodeToString(txID)]
+	return ok
+}
+
+func (p *Pool) Get(txID []byte) (blockchain.Transaction, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	desc, ok := p.txs[hex.EncodeToString(txID)]
+	if !ok {
+		return blockchain.Transaction{}, false
+	}
+	return desc.Tx, true
+}
+
+// Number of txs in the pool
+func (p *Pool) Count() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return len(p.txs)
+}
+
+// Total size of pool txs in bytes
+func (p *Pool) Size() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.size
+}
+
+// Changes whenever a tx is added or removed
+func (p *Pool) Updates() uint64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.updates
+}
+
+// All pool txs, highest fee rate first
+func (p *Pool) Descs() []TxDesc {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var descs []TxDesc
+	for _, desc := range p.txs {
+		descs = append(descs, *desc)
+	}
+
+	sort.Slice(descs, func(i, j int) bool {
+		if descs[i].FeeRate() != descs[j].FeeRate() {
+			return descs[i].FeeRate() > descs[j].FeeRate()
+		}
+		return descs[i].Added.Before(descs[j].Added)
+	})
+
+	return descs
+}
+
+// Pool txs ordered for mining, best ancestor package fee rate first and
+// every tx after the unconfirmed parents it spends from
+func (p *Pool) TxsByPackageFeeRate() []*blockchain.Transaction {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var ids []string
+	rates := make(map[string]int)
+
+	for id := range p.txs {
+		ids = append(ids, id)
+		rates[id] = p.ancestorFeeRate(id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		if rates[ids[i]] != rates[ids[j]] {
+			return rates[ids[i]] > rates[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+
+	var txs []*blockchain.Transaction
+	added := make(map[string]bool)
+
+	var add func(id string)
+	add = func(id string) {
+		if added[id] {
+			return
+		}
+		added[id] = true
+
+		tx := p.txs[id].Tx
+		for _, in := range tx.Inputs {
+			parent := hex.EncodeToString(in.ID)
+			if _, ok := p.txs[parent]; ok {
+				add(parent)
+			}
+		}
+		txs = append(txs, &tx)
+	}
+
+	for _, id := range ids {
+		add(id)
+	}
+
+	return txs
+}
+
+// Fee of a pool tx, 0 if it is not in the pool
+func (p *Pool) Fee(txID []byte) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if desc, ok := p.txs[hex.EncodeToString(txID)]; ok {
+		return desc.Fee
+	}
+	return 0
+}
+
+// Pool txs as a map keyed by stringified ID, for looking up unconfirmed parents
+func (p *Pool) TxMap() map[string]blockchain.Transaction {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	txs := make(map[string]blockchain.Transaction)
+	for id, desc := range p.txs {
+		txs[id] = desc.Tx
+	}
+
+	return txs
+}
+
+/*-------------------------------relations-------------------------------*/
+
+// Pool txs spending outputs of txID, recursively
+func (p *Pool) descendants(txID string) []string {
+	var found []string
+	seen := map[string]bool{txID: true}
+	queue := []string{txID}
+
+	for len(queue) > 0 {
+		parent, ok := p.txs[queue[0]]
+		queue = queue[1:]
+		if !ok {
+			continue
+		}
+
+		for i := range parent.Tx.Outputs {
+			child, ok := p.spends[outpoint(parent.Tx.ID, i)]
+			if ok && !seen[child] {
+				seen[child] = true
+				found = append(found, child)
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	return found
+}
+
+// Pool txs that txID spends from, recursively
+func (p *Pool) ancestors(txID string) []string {
+	var found []string
+	seen := map[string]bool{txID: true}
+	queue := []string{txID}
+
+	for len(queue) > 0 {
+		desc, ok := p.txs[queue[0]]
+		queue = queue[1:]
+		if !ok {
+			continue
+		}
+
+		for _, in := range desc.Tx.Inputs {
+			parent := hex.EncodeToString(in.ID)
+			if _, ok := p.txs[parent]; ok && !seen[parent] {
+				seen[parent] = true
+				found = append(found, parent)
+				queue = append(queue, parent)
+			}
+		}
+	}
+
+	return found
+}
+
+// Fee rate of tx together with all of its unconfirmed ancestors, as a miner
+// has to include the whole package to get the fee of tx (child-pays-for-parent)
+func (p *Pool) ancestorFeeRate(txID string) int {
+	desc := p.txs[txID]
+	fee, size := desc.Fee, desc.Size
+
+	for _, id := range p.ancestors(txID) {
+		fee += p.txs[id].Fee
+		size += p.txs[id].Size
+	}
+
+	return blockchain.FeeRate(fee, size)
+}
+
+/*-------------------------------changes-------------------------------*/
+
+func (p *Pool) add(desc *TxDesc) {
+	txID := hex.EncodeToString(desc.Tx.ID)
+	p.txs[txID] = desc
+	p.size += desc.Size
+	p.updates++
+
+	for _, in := range desc.Tx.Inputs {
+		p.spends[outpoint(in.ID, in.Out)] = txID
+	}
+}
+
+// Remove a single tx, descendants are left alone
+func (p *Pool) remove(txID string) {
+	desc, ok := p.txs[txID]
+	if !ok {
+		return
+	}
+
+	for _, in := range desc.Tx.Inputs {
+		key := outpoint(in.ID, in.Out)
+		if p.spends[key] == txID {
+			delete(p.spends, key)
+		}
+	}
+
+	p.size -= desc.Size
+	p.updates++
+	delete(p.txs, txID)
+}
+
+// Remove tx and everything spending from it, returns number of txs removed
+func (p *Pool) removeWithDescendants(txID string) int {
+	if _, ok := p.txs[txID]; !ok {
+		return 0
+	}
+
+	ids := append(p.descendants(txID), txID)
+	for _, id := range ids {
+		p.remove(id)
+	}
+
+	return len(ids)
+}
+
+func (p *Pool) Remove(txID []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.removeWithDescendants(hex.EncodeToString(txID))
+}
+
+// Validate tx and add it to the pool, see validate.go for the rules
+func (p *Pool) Add(tx blockchain.Transaction) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	txID := hex.EncodeToString(tx.ID)
+	if _, ok := p.txs[txID]; ok {
+		return errors.New("tx is already in the pool")
+	}
+
+	desc, conflicts, err := p.validate(&tx)
+	if err != nil {
+		return err
+	}
+
+	evict, err := p.makeRoom(desc, conflicts)
+	if err != nil {
+		return err
+	}
+
+	for id := range conflicts {
+		fmt.Printf("Tx %s replaced by %s\n", id, txID)
+		p.removeWithDescendants(id)
+	}
+
+	for _, id := range evict {
+		fmt.Printf("Mempool full, evicting tx %s\n", id)
+		p.removeWithDescendants(id)
+	}
+
+	p.add(desc)
+
+	return nil
+}
+
+// Pick lowest fee rate txs (with their descendants) to evict so that desc fits
+// into MaxSize, txs that are replaced anyway count as freed space
+// Fails if desc itself pays no more than a tx that would have to go
+func (p *Pool) makeRoom(desc *TxDesc, conflicts map[string]bool) ([]string, error) {
+	removed := make(map[string]bool)
+	size := p.size + desc.Size
+
+	drop := func(id string) {
+		for _, d := range append(p.descendants(id), id) {
+			if !removed[d] {
+				removed[d] = true
+				size -= p.txs[d].Size
+			}
+		}
+	}
+
+	for id := range conflicts {
+		drop(id)
+	}
+
+	if size <= p.cfg.MaxSize {
+		return nil, nil
+	}
+
+	var candidates []*TxDesc
+	for id, d := range p.txs {
+		if !removed[id] {
+			candidates = append(candidates, d)
+		}
+	}
+
+	// Lowest fee rate first, newest first among equals
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].FeeRate() != candidates[j].FeeRate() {
+			return candidates[i].FeeRate() < candidates[j].FeeRate()
+		}
+		return candidates[i].Added.After(candidates[j].Added)
+	})
+
+	var evict []string
+	for _, d := range candidates {
+		if size <= p.cfg.MaxSize {
+			break
+		}
+
+		id := hex.EncodeToString(d.Tx.ID)
+		if removed[id] {
+			continue
+		}
+
+		if d.FeeRate() >= desc.FeeRate() {
+			return nil, errors.New("mempool is full and fee rate is too low")
+		}
+
+		evict = append(evict, id)
+		drop(id)
+	}
+
+	if size > p.cfg.MaxSize {
+		return nil, errors.New("tx is larger than the mempool")
+	}
+
+	return evict, nil
+}
+
+// Drop txs older than MaxAge, returns number of txs removed
+func (p *Pool) Expire() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	removed := 0
+	cutoff := time.Now().Add(-p.cfg.MaxAge)
+
+	for id, desc := range p.txs {
+		if desc.Added.Before(cutoff) {
+			removed += p.removeWithDescendants(id)
+		}
+	}
+
+	return removed
+}
+
+// Block has been added to the chain, drop txs it includes and txs that
+// conflict with it (they spend outputs that the block has now spent)
+func (p *Pool) RemoveForBlock(block *blockchain.Block) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, tx := range block.Transactions {
+		txID := hex.EncodeToString(tx.ID)
+
+		// Children of an included tx stay, their parent is confirmed now
+		p.remove(txID)
+
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		for _, in := range tx.Inputs {
+			if id, ok := p.spends[outpoint(in.ID, in.Out)]; ok && id != txID {
+				fmt.Printf("Tx %s conflicts with block %x\n", id, block.Hash)
+				p.removeWithDescendants(id)
+			}
+		}
+	}
+}
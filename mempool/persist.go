@@ -0,0 +1,98 @@
+package mempool
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/LidoKing/learnBlockchain/blockchain"
+)
+
+// Pool tx as written to the mempool file
+type savedTx struct {
+	Tx    []byte
+	Added time.Time
+}
+
+// Write all pool txs to path, oldest first so parents come before the txs
+// spending them
+func (p *Pool) SaveFile(path string) error {
+	p.mu.RLock()
+	descs := make([]*TxDesc, 0, len(p.txs))
+	for _, desc := range p.txs {
+		descs = append(descs, desc)
+	}
+	p.mu.RUnlock()
+
+	sort.SliceStable(descs, func(i, j int) bool {
+		return descs[i].Added.Before(descs[j].Added)
+	})
+
+	saved := make([]savedTx, len(descs))
+	for i, desc := range descs {
+		saved[i] = savedTx{desc.Tx.Serialize(), desc.Added}
+	}
+
+	var buff bytes.Buffer
+	if err := gob.NewEncoder(&buff).Encode(saved); err != nil {
+		return err
+	}
+
+	// A crash while writing leaves the previous file in place
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buff.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Add back the txs saved by SaveFile(), each validated again against the
+// current UTXO set, so ones mined, double spent or expired meanwhile are
+// dropped. A missing file is an empty pool. Returns the number added back
+// and the number dropped.
+func (p *Pool) LoadFile(path string) (int, int, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var saved []savedTx
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&saved); err != nil {
+		return 0, 0, fmt.Errorf("%s: %s", path, err)
+	}
+
+	added, dropped := 0, 0
+	cutoff := time.Now().Add(-p.cfg.MaxAge)
+
+	for _, s := range saved {
+		tx, err := blockchain.DecodeTx(s.Tx)
+		if err != nil || s.Added.Before(cutoff) {
+			dropped++
+			continue
+		}
+
+		if err := p.Add(*tx); err != nil {
+			fmt.Printf("Dropped saved tx %x: %s\n", tx.ID, err)
+			dropped++
+			continue
+		}
+
+		// Expiry counts from when the tx first came in
+		p.mu.Lock()
+		if desc, ok := p.txs[hex.EncodeToString(tx.ID)]; ok {
+			desc.Added = s.Added
+		}
+		p.mu.Unlock()
+		added++
+	}
+
+	return added, dropped, nil
+}
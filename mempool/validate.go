@@ -0,0 +1,219 @@
+package mempool
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/LidoKing/learnBlockchain/blockchain"
+	"github.com/LidoKing/learnBlockchain/blockchain/wallet"
+)
+
+// Replace-by-fee rules, a tx conflicting with pool txs (spending the same
+// outputs) is only accepted when all of the following hold:
+//  1. every directly conflicting tx opted in, i.e. is Replaceable
+//  2. its fee rate is higher than that of every directly conflicting tx
+//  3. its fee covers the fees of all evicted txs (conflicts and their
+//     descendants) plus MinReplacementBump, so relaying it is paid for
+//  4. it evicts at most MaxReplacementEvictions txs
+//  5. it does not spend outputs of any tx it would evict
+//
+// Evicted txs are removed together with all of their descendants.
+const (
+	MinReplacementBump      = 1
+	MaxReplacementEvictions = 100
+)
+
+// Tx breaks the rules, as opposed to being turned down by pool policy (fees,
+// replacement, size) or spending outputs that are unknown or already spent
+type InvalidTxError struct {
+	Err error
+}
+
+func (e InvalidTxError) Error() string {
+	return e.Err.Error()
+}
+
+func invalid(err error) error {
+	return InvalidTxError{err}
+}
+
+// Tx spends outputs of txs that are neither in the pool nor have unspent
+// outputs in the chain, most likely because they have not arrived yet
+type MissingParentsError struct {
+	Parents [][]byte
+}
+
+func (e MissingParentsError) Error() string {
+	return fmt.Sprintf("tx spends outputs of %d unknown txs", len(e.Parents))
+}
+
+// Full check of a tx before it enters the pool:
+//   - it is not a coinbase and has inputs and positive outputs
+//   - its ID is the hash of its content, see Transaction.Hash()
+//   - it is within the size and input/output count limits of the chain params
+//   - no output is spent twice within the tx
+//   - every input spends an unspent output of the chain or an output of a pool tx,
+//     MissingParentsError if the tx it spends is not known at all
+//   - every input is signed by the owner of the output it spends
+//   - it pays at least MinFeeRate
+//   - conflicts with pool txs are allowed by the replace-by-fee rules
+//
+// Returns the pool entry and the pool txs it replaces.
+func (p *Pool) validate(tx *blockchain.Transaction) (*TxDesc, map[string]bool, error) {
+	if tx.IsCoinbase() {
+		return nil, nil, invalid(errors.New("coinbase txs are only valid in blocks"))
+	}
+
+	if len(tx.Inputs) == 0 || len(tx.Outputs) == 0 {
+		return nil, nil, invalid(errors.New("tx has no inputs or no outputs"))
+	}
+
+	// A forged ID would keep the tx it belongs to out of the pool
+	if !tx.HasValidID() {
+		return nil, nil, invalid(errors.New("tx ID is not the hash of the tx"))
+	}
+
+	if err := p.UTXO.Blockchain.Params.CheckTx(tx); err != nil {
+		return nil, nil, invalid(err)
+	}
+
+	for i, out := range tx.Outputs {
+		if out.Value <= 0 {
+			return nil, nil, invalid(fmt.Errorf("output %d has a non-positive value", i))
+		}
+	}
+
+	spent := make(map[string]bool)
+	for _, in := range tx.Inputs {
+		key := outpoint(in.ID, in.Out)
+		if spent[key] {
+			return nil, nil, invalid(fmt.Errorf("output %s is spent twice", key))
+		}
+		spent[key] = true
+	}
+
+	prevOutputs, err := p.prevOutputs(tx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i, in := range tx.Inputs {
+		prevPubKeyHash := prevOutputs[i].PubKeyHash
+
+		if len(in.PubKey) == 0 || !bytes.Equal(wallet.PublicKeyHash(in.PubKey), prevPubKeyHash) {
+			return nil, nil, invalid(fmt.Errorf("input %d is not from the owner of the output it spends", i))
+		}
+
+		if !tx.VerifyInput(i, prevOutputs) {
+			return nil, nil, invalid(fmt.Errorf("signature of input %d is invalid", i))
+		}
+	}
+
+	fee := tx.Fee(prevOutputs)
+	if fee < 0 {
+		return nil, nil, invalid(errors.New("tx spends more than its inputs"))
+	}
+
+	desc := &TxDesc{*tx, time.Now(), fee, tx.Size()}
+	if desc.FeeRate() < p.cfg.MinFeeRate {
+		return nil, nil, fmt.Errorf("fee rate %d is below minimum of %d", desc.FeeRate(), p.cfg.MinFeeRate)
+	}
+
+	conflicts := make(map[string]bool)
+	for _, in := range tx.Inputs {
+		if id, ok := p.spends[outpoint(in.ID, in.Out)]; ok {
+			conflicts[id] = true
+		}
+	}
+
+	if len(conflicts) > 0 {
+		if err := p.checkReplacement(desc, conflicts); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return desc, conflicts, nil
+}
+
+// Output spent by each input, from a pool tx or else from the UTXO set
+func (p *Pool) prevOutputs(tx *blockchain.Transaction) ([]blockchain.TxOutput, error) {
+	var outputs []blockchain.TxOutput
+	var missing [][]byte
+	seen := make(map[string]bool)
+
+	for _, in := range tx.Inputs {
+		if parent, ok := p.txs[hex.EncodeToString(in.ID)]; ok {
+			if in.Out < 0 || in.Out >= len(parent.Tx.Outputs) {
+				return nil, invalid(fmt.Errorf("output %d of tx %x does not exist", in.Out, in.ID))
+			}
+			outputs = append(outputs, parent.Tx.Outputs[in.Out])
+			continue
+		}
+
+		out, ok := p.UTXO.FindUnspentOutput(in.ID, in.Out)
+		if ok {
+			outputs = append(outputs, out)
+			continue
+		}
+
+		if p.UTXO.HasUnspentOutputs(in.ID) {
+			return nil, fmt.Errorf("output %x:%d is spent or unknown", in.ID, in.Out)
+		}
+
+		if id := hex.EncodeToString(in.ID); !seen[id] {
+			seen[id] = true
+			missing = append(missing, in.ID)
+		}
+	}
+
+	if len(missing) > 0 {
+		return nil, MissingParentsError{missing}
+	}
+
+	return outputs, nil
+}
+
+func (p *Pool) checkReplacement(desc *TxDesc, conflicts map[string]bool) error {
+	evicted := make(map[string]bool)
+
+	for id := range conflicts {
+		old := p.txs[id]
+
+		if !old.Tx.Replaceable {
+			return fmt.Errorf("conflicting tx %s is not replaceable", id)
+		}
+
+		if desc.FeeRate() <= old.FeeRate() {
+			return fmt.Errorf("fee rate must be higher than that of tx %s", id)
+		}
+
+		evicted[id] = true
+		for _, child := range p.descendants(id) {
+			evicted[child] = true
+		}
+	}
+
+	if len(evicted) > MaxReplacementEvictions {
+		return fmt.Errorf("replacement would evict %d txs", len(evicted))
+	}
+
+	evictedFees := 0
+	for id := range evicted {
+		evictedFees += p.txs[id].Fee
+	}
+
+	if desc.Fee < evictedFees+MinReplacementBump {
+		return fmt.Errorf("fee must be at least %d", evictedFees+MinReplacementBump)
+	}
+
+	for _, in := range desc.Tx.Inputs {
+		if evicted[hex.EncodeToString(in.ID)] {
+			return errors.New("replacement spends an output of a tx it replaces")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,316 @@
+package mempool
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/LidoKing/learnBlockchain/blockchain"
+	"github.com/LidoKing/learnBlockchain/blockchain/wallet"
+)
+
+/*-------------------------------utils-------------------------------*/
+
+// Chain in a temp dir whose genesis pays 20 to w, with an empty pool on it
+func newTestPool(t *testing.T) (*Pool, *wallet.Wallet) {
+	t.Helper()
+
+	prevDifficulty := blockchain.Difficulty
+	blockchain.Difficulty = 4
+
+	dir, err := ioutil.TempDir("", "mempool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := wallet.MakeWallet()
+	chain, err := blockchain.NewBlockChain(dir, blockchain.Genesis(blockchain.CoinbaseTx(string(w.Address()), "genesis")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	UTXOSet.Reindex()
+
+	t.Cleanup(func() {
+		chain.Database.Close()
+		os.RemoveAll(dir)
+		blockchain.Difficulty = prevDifficulty
+	})
+
+	return New(chain, DefaultConfig), w
+}
+
+// Pay amount back to w from its UTXOs, see blockchain.NewMultiSourceTransaction()
+func pay(p *Pool, w *wallet.Wallet, amount int, opts blockchain.TxOptions) *blockchain.Transaction {
+	address := string(w.Address())
+	payments := []blockchain.Payment{{Address: address, Amount: amount}}
+
+	return blockchain.NewMultiSourceTransaction([]*wallet.Wallet{w}, payments, address, opts, &p.UTXO)
+}
+
+// Tx signed by w spending output out of parent, paying all of it but fee to w
+func spend(w *wallet.Wallet, parent *blockchain.Transaction, out, fee int) *blockchain.Transaction {
+	inputs := []blockchain.TxInput{{ID: parent.ID, Out: out}}
+	payments := []blockchain.Payment{{Address: string(w.Address()), Amount: parent.Outputs[out].Value - fee}}
+
+	tx := blockchain.NewRawTransaction(inputs, payments)
+	tx.SignWith([]*wallet.Wallet{w}, []blockchain.TxOutput{parent.Outputs[out]})
+
+	return tx
+}
+
+func mustAdd(t *testing.T, p *Pool, tx *blockchain.Transaction) {
+	t.Helper()
+
+	if err := p.Add(*tx); err != nil {
+		t.Fatalf("tx %x refused: %s", tx.ID, err)
+	}
+}
+
+/*-------------------------------validation-------------------------------*/
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		tx   func(p *Pool, w *wallet.Wallet) *blockchain.Transaction
+		// nil, InvalidTxError or MissingParentsError
+		want error
+	}{
+		{
+			"spend",
+			func(p *Pool, w *wallet.Wallet) *blockchain.Transaction {
+				return pay(p, w, 5, blockchain.TxOptions{Fee: 1})
+			},
+			nil,
+		},
+		{
+			"coinbase",
+			func(p *Pool, w *wallet.Wallet) *blockchain.Transaction {
+				return blockchain.CoinbaseTx(string(w.Address()), "")
+			},
+			InvalidTxError{},
+		},
+		{
+			"no outputs",
+			func(p *Pool, w *wallet.Wallet) *blockchain.Transaction {
+				tx := pay(p, w, 5, blockchain.TxOptions{})
+				tx.Outputs = nil
+				return tx
+			},
+			InvalidTxError{},
+		},
+		{
+			"forged ID",
+			func(p *Pool, w *wallet.Wallet) *blockchain.Transaction {
+				tx := pay(p, w, 5, blockchain.TxOptions{})
+				tx.ID = pay(p, w, 6, blockchain.TxOptions{}).ID
+				return tx
+			},
+			InvalidTxError{},
+		},
+		{
+			"output spent twice",
+			func(p *Pool, w *wallet.Wallet) *blockchain.Transaction {
+				tx := pay(p, w, 5, blockchain.TxOptions{})
+				tx.Inputs = append(tx.Inputs, tx.Inputs[0])
+				return tx
+			},
+			InvalidTxError{},
+		},
+		{
+			"invalid signature",
+			func(p *Pool, w *wallet.Wallet) *blockchain.Transaction {
+				tx := pay(p, w, 5, blockchain.TxOptions{})
+				tx.Inputs[0].Sig[3] ^= 1
+				return tx
+			},
+			InvalidTxError{},
+		},
+		{
+			"not the owner",
+			func(p *Pool, w *wallet.Wallet) *blockchain.Transaction {
+				tx := pay(p, w, 5, blockchain.TxOptions{})
+				tx.Inputs[0].PubKey = wallet.MakeWallet().PublicKey
+				return tx
+			},
+			InvalidTxError{},
+		},
+		{
+			"spends more than its inputs",
+			func(p *Pool, w *wallet.Wallet) *blockchain.Transaction {
+				tx := pay(p, w, 5, blockchain.TxOptions{})
+				prevOutputs, _ := p.UTXO.Blockchain.PrevOutputs(tx)
+
+				inputs := []blockchain.TxInput{{ID: tx.Inputs[0].ID, Out: tx.Inputs[0].Out}}
+				payments := []blockchain.Payment{{Address: string(w.Address()), Amount: prevOutputs[0].Value + 1}}
+				raw := blockchain.NewRawTransaction(inputs, payments)
+				raw.SignWith([]*wallet.Wallet{w}, prevOutputs)
+				return raw
+			},
+			InvalidTxError{},
+		},
+		{
+			"unknown parent",
+			func(p *Pool, w *wallet.Wallet) *blockchain.Transaction {
+				parent := blockchain.CoinbaseTx(string(w.Address()), "elsewhere")
+				return spend(w, parent, 0, 1)
+			},
+			MissingParentsError{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, w := newTestPool(t)
+			tx := test.tx(p, w)
+
+			err := p.Add(*tx)
+			switch test.want.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("valid tx refused: %s", err)
+				}
+				if !p.Has(tx.ID) {
+					t.Fatal("accepted tx is not in the pool")
+				}
+			case InvalidTxError:
+				if !errors.As(err, &InvalidTxError{}) {
+					t.Fatalf("got %v, want an invalid tx error", err)
+				}
+			case MissingParentsError:
+				var missing MissingParentsError
+				if !errors.As(err, &missing) {
+					t.Fatalf("got %v, want a missing parents error", err)
+				}
+				if len(missing.Parents) != 1 || !bytes.Equal(missing.Parents[0], tx.Inputs[0].ID) {
+					t.Fatal("missing parent not reported")
+				}
+			}
+
+			if test.want != nil && p.Count() != 0 {
+				t.Fatal("refused tx is in the pool")
+			}
+		})
+	}
+}
+
+func TestValidateSpendsPoolTx(t *testing.T) {
+	p, w := newTestPool(t)
+
+	parent := pay(p, w, 5, blockchain.TxOptions{Fee: 1})
+	mustAdd(t, p, parent)
+
+	child := spend(w, parent, 1, 1)
+	mustAdd(t, p, child)
+
+	// Pays out more than the pool output it spends
+	greedy := spend(w, parent, 0, -1)
+	if err := p.Add(*greedy); !errors.As(err, &InvalidTxError{}) {
+		t.Fatalf("got %v, want an invalid tx error", err)
+	}
+
+	// Output of a pool tx that does not exist
+	bad := spend(w, parent, 0, 1)
+	bad.Inputs[0].Out = 5
+	if err := p.Add(*bad); !errors.As(err, &InvalidTxError{}) {
+		t.Fatalf("got %v, want an invalid tx error", err)
+	}
+
+	if p.Count() != 2 || p.Fee(child.ID) != 1 {
+		t.Fatal("pool does not hold parent and child")
+	}
+}
+
+func TestForgedIDDoesNotBlockTx(t *testing.T) {
+	p, w := newTestPool(t)
+
+	tx := pay(p, w, 5, blockchain.TxOptions{Fee: 1})
+	forged := pay(p, w, 6, blockchain.TxOptions{Fee: 1})
+	forged.ID = tx.ID
+
+	if err := p.Add(*forged); !errors.As(err, &InvalidTxError{}) {
+		t.Fatalf("got %v, want an invalid tx error", err)
+	}
+	mustAdd(t, p, tx)
+
+	if p.Count() != 1 || p.Fee(tx.ID) != 1 {
+		t.Fatal("pool does not hold the real tx")
+	}
+}
+
+/*-------------------------------replace-by-fee-------------------------------*/
+
+func TestReplaceByFee(t *testing.T) {
+	tests := []struct {
+		name string
+		// Original tx, replaced by a tx paying newFee
+		fee         int
+		replaceable bool
+		// Fee of a pool tx spending the change of the original, 0 for none
+		childFee int
+		newFee   int
+		replaced bool
+	}{
+		{"higher fee", 2, true, 0, 6, true},
+		{"not replaceable", 2, false, 0, 6, false},
+		{"same fee", 2, true, 0, 2, false},
+		{"lower fee", 4, true, 0, 2, false},
+		{"does not pay for evicted child", 2, true, 8, 6, false},
+		{"pays for evicted child", 2, true, 3, 6, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, w := newTestPool(t)
+
+			orig := pay(p, w, 5, blockchain.TxOptions{Fee: test.fee, Replaceable: test.replaceable})
+			mustAdd(t, p, orig)
+
+			var child *blockchain.Transaction
+			if test.childFee > 0 {
+				child = spend(w, orig, 1, test.childFee)
+				mustAdd(t, p, child)
+			}
+
+			// Spends the same genesis output, as the pool is not in the UTXO set
+			replacement := pay(p, w, 6, blockchain.TxOptions{Fee: test.newFee, Replaceable: true})
+
+			err := p.Add(*replacement)
+			if test.replaced != (err == nil) {
+				t.Fatalf("replaced %t, want %t (%v)", err == nil, test.replaced, err)
+			}
+
+			if p.Has(orig.ID) == test.replaced || p.Has(replacement.ID) != test.replaced {
+				t.Fatal("pool holds the wrong tx")
+			}
+			if child != nil && p.Has(child.ID) == test.replaced {
+				t.Fatal("child of replaced tx is not evicted with it")
+			}
+		})
+	}
+}
+
+func TestBumpFee(t *testing.T) {
+	p, w := newTestPool(t)
+
+	orig := pay(p, w, 5, blockchain.TxOptions{Fee: 1, Replaceable: true})
+	mustAdd(t, p, orig)
+
+	prevOutputs, err := p.UTXO.Blockchain.PrevOutputs(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bumped, err := blockchain.BumpFeeTransaction(orig, prevOutputs, []*wallet.Wallet{w}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustAdd(t, p, bumped)
+
+	if p.Has(orig.ID) || p.Fee(bumped.ID) != 5 {
+		t.Fatal("bumped tx did not replace the original")
+	}
+}
@@ -0,0 +1,130 @@
+package mining
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/LidoKing/learnBlockchain/blockchain"
+	"github.com/LidoKing/learnBlockchain/mempool"
+)
+
+type Config struct {
+	// Serialized size of all txs of a block, coinbase included, capped by
+	// the chain params
+	MaxBlockSize int
+	// Least time between two mining attempts, pool txs are collected meanwhile
+	MinInterval time.Duration
+}
+
+var DefaultConfig = Config{
+	MaxBlockSize: 1 << 20,
+	MinInterval:  10 * time.Second,
+}
+
+// How often a block being mined is checked for still extending the tip
+const tipCheckInterval = 100 * time.Millisecond
+
+// Keeps a block template up to date and mines it on a timer
+type Miner struct {
+	mu       sync.Mutex
+	cfg      Config
+	chain    *blockchain.BlockChain
+	pool     *mempool.Pool
+	address  string
+	template *Template
+}
+
+func NewMiner(chain *blockchain.BlockChain, pool *mempool.Pool, address string, cfg Config) *Miner {
+	return &Miner{
+		cfg:     cfg,
+		chain:   chain,
+		pool:    pool,
+		address: address,
+	}
+}
+
+// Current template, rebuilt first if the tip or the pool has changed
+func (m *Miner) Template() *Template {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.template == nil || m.template.Stale(m.chain, m.pool) {
+		m.template = NewTemplate(m.chain, m.pool, m.address, m.cfg.MaxBlockSize)
+	}
+
+	return m.template
+}
+
+// Mine the current template if it has any txs, returns nil otherwise or
+// when ctx is done before a block is found
+func (m *Miner) Mine(ctx context.Context) *blockchain.Block {
+	t := m.Template()
+	if t.TxCount() == 0 {
+		return nil
+	}
+
+	return m.mine(ctx, t)
+}
+
+// Mine the current template right away, even when it holds only the coinbase
+func (m *Miner) MineNow(ctx context.Context) *blockchain.Block {
+	return m.mine(ctx, m.Template())
+}
+
+func (m *Miner) mine(ctx context.Context, t *Template) *blockchain.Block {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go m.cancelOnTipChange(ctx, cancel, t.PrevHash)
+
+	fmt.Printf("Mining %d txs with %d fees\n", t.TxCount(), t.Fees)
+	block, err := m.chain.MineBlockContext(ctx, t.Txs)
+	if err != nil {
+		fmt.Printf("Mining cancelled: %s\n", err)
+		return nil
+	}
+
+	m.mu.Lock()
+	m.template = nil
+	m.mu.Unlock()
+
+	return block
+}
+
+// A block on top of prevHash would be stale once another block is the tip
+func (m *Miner) cancelOnTipChange(ctx context.Context, cancel context.CancelFunc, prevHash []byte) {
+	ticker := time.NewTicker(tipCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !bytes.Equal(m.chain.LastHash(), prevHash) {
+				cancel()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Try to mine every MinInterval until ctx is done, found is called with
+// each new block. A block being mined when ctx is done is given up.
+func (m *Miner) Run(ctx context.Context, found func(*blockchain.Block)) {
+	ticker := time.NewTicker(m.cfg.MinInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if block := m.Mine(ctx); block != nil {
+				found(block)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
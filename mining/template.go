@@ -0,0 +1,91 @@
+package mining
+
+import (
+	"bytes"
+	"encoding/hex"
+
+	"github.com/LidoKing/learnBlockchain/blockchain"
+	"github.com/LidoKing/learnBlockchain/mempool"
+)
+
+// Txs to put in the next block, coinbase first and every other tx after the
+// unconfirmed parents it spends from
+type Template struct {
+	Txs      []*blockchain.Transaction
+	Fees     int
+	Size     int
+	SigOps   int
+	PrevHash []byte
+
+	// Pool state the template was built from, see Pool.Updates()
+	poolUpdates uint64
+}
+
+// Build a template on top of the current tip paying reward and fees to address
+// Pool txs are taken best package fee rate first while they fit into maxSize
+// and the limits of the chain params, a tx that does not fit is skipped
+// together with everything spending from it
+func NewTemplate(chain *blockchain.BlockChain, pool *mempool.Pool, address string, maxSize int) *Template {
+	if limit := chain.Params.MaxTxsSize(); maxSize > limit {
+		maxSize = limit
+	}
+
+	t := &Template{
+		PrevHash:    chain.LastHash(),
+		poolUpdates: pool.Updates(),
+	}
+
+	var txs []*blockchain.Transaction
+
+	// Size of the coinbase only depends on the fee in its value, so a rough
+	// estimate is enough to keep room for it
+	t.Size = blockchain.NewCoinbaseTx(address, "", 0).Size()
+
+	// Txs earlier in the template, later ones may spend from them
+	pending := make(map[string]blockchain.Transaction)
+	for _, tx := range pool.TxsByPackageFeeRate() {
+		size := tx.Size()
+		if t.Size+size > maxSize {
+			continue
+		}
+
+		sigOps := tx.SigOps()
+		if t.SigOps+sigOps > chain.Params.MaxBlockSigOps {
+			continue
+		}
+
+		if chain.Params.CheckTx(tx) != nil {
+			continue
+		}
+
+		// Parent was skipped or has been mined/replaced meanwhile
+		if _, err := chain.FindPrevTXs(tx, pending); err != nil {
+			continue
+		}
+
+		if !chain.VerifyTransactionWith(tx, pending) {
+			continue
+		}
+
+		txs = append(txs, tx)
+		t.Fees += pool.Fee(tx.ID)
+		t.Size += size
+		t.SigOps += sigOps
+		pending[hex.EncodeToString(tx.ID)] = *tx
+	}
+
+	cbTx := blockchain.NewCoinbaseTx(address, "", t.Fees)
+	t.Txs = append([]*blockchain.Transaction{cbTx}, txs...)
+
+	return t
+}
+
+// Number of txs besides the coinbase
+func (t *Template) TxCount() int {
+	return len(t.Txs) - 1
+}
+
+// Tip or pool has changed since the template was built
+func (t *Template) Stale(chain *blockchain.BlockChain, pool *mempool.Pool) bool {
+	return !bytes.Equal(t.PrevHash, chain.LastHash()) || t.poolUpdates != pool.Updates()
+}
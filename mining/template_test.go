@@ -0,0 +1,155 @@
+package mining
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/LidoKing/learnBlockchain/blockchain"
+	"github.com/LidoKing/learnBlockchain/blockchain/wallet"
+	"github.com/LidoKing/learnBlockchain/mempool"
+)
+
+/*-------------------------------utils-------------------------------*/
+
+// Chain in a temp dir whose tip holds outputs of 6 for each of count
+// payments to w, with an empty pool on it
+func newTestPool(t *testing.T, count int) (*blockchain.BlockChain, *mempool.Pool, *wallet.Wallet, *blockchain.Transaction) {
+	t.Helper()
+
+	prevDifficulty := blockchain.Difficulty
+	blockchain.Difficulty = 4
+
+	dir, err := ioutil.TempDir("", "mining")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := wallet.MakeWallet()
+	address := string(w.Address())
+	chain, err := blockchain.NewBlockChain(dir, blockchain.Genesis(blockchain.CoinbaseTx(address, "genesis")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		chain.Database.Close()
+		os.RemoveAll(dir)
+		blockchain.Difficulty = prevDifficulty
+	})
+
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	UTXOSet.Reindex()
+
+	var payments []blockchain.Payment
+	for i := 0; i < count; i++ {
+		payments = append(payments, blockchain.Payment{Address: address, Amount: 6})
+	}
+	split := blockchain.NewPaymentsTransaction(w, payments, &UTXOSet)
+
+	block := chain.MineBlock([]*blockchain.Transaction{blockchain.NewCoinbaseTx(address, "", 0), split})
+	UTXOSet.Update(block)
+
+	return chain, mempool.New(chain, mempool.DefaultConfig), w, split
+}
+
+// Tx signed by w spending output out of parent, paying all of it but fee to w
+func spend(w *wallet.Wallet, parent *blockchain.Transaction, out, fee int) *blockchain.Transaction {
+	inputs := []blockchain.TxInput{{ID: parent.ID, Out: out}}
+	payments := []blockchain.Payment{{Address: string(w.Address()), Amount: parent.Outputs[out].Value - fee}}
+
+	tx := blockchain.NewRawTransaction(inputs, payments)
+	tx.SignWith([]*wallet.Wallet{w}, []blockchain.TxOutput{parent.Outputs[out]})
+
+	return tx
+}
+
+/*-------------------------------template-------------------------------*/
+
+func TestTemplatePackages(t *testing.T) {
+	chain, pool, w, split := newTestPool(t, 3)
+	address := string(w.Address())
+
+	low := spend(w, split, 0, 1)
+	mid := spend(w, split, 1, 2)
+	// Pays nothing but its child makes up for it (child pays for parent)
+	parent := spend(w, split, 2, 0)
+	child := spend(w, parent, 0, 5)
+
+	for _, tx := range []*blockchain.Transaction{low, mid, parent, child} {
+		if err := pool.Add(*tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	full := NewTemplate(chain, pool, address, 1<<20)
+	coinbaseSize := full.Size
+	for _, tx := range full.Txs[1:] {
+		coinbaseSize -= tx.Size()
+	}
+
+	tests := []struct {
+		name    string
+		maxSize int
+		want    []*blockchain.Transaction
+		fees    int
+	}{
+		{"all", 1 << 20, []*blockchain.Transaction{parent, child, mid, low}, 8},
+		{"no room for last", coinbaseSize + parent.Size() + child.Size() + mid.Size(), []*blockchain.Transaction{parent, child, mid}, 7},
+		{"coinbase only", coinbaseSize, nil, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmpl := NewTemplate(chain, pool, address, test.maxSize)
+
+			if !tmpl.Txs[0].IsCoinbase() || tmpl.TxCount() != len(test.want) {
+				t.Fatalf("%d txs, want a coinbase and %d more", len(tmpl.Txs), len(test.want))
+			}
+
+			for i, tx := range test.want {
+				if !bytes.Equal(tmpl.Txs[i+1].ID, tx.ID) {
+					t.Fatalf("tx %d is %x, want %x", i+1, tmpl.Txs[i+1].ID, tx.ID)
+				}
+			}
+
+			bare := blockchain.NewCoinbaseTx(address, "", 0)
+			if tmpl.Fees != test.fees || tmpl.Txs[0].Outputs[0].Value != bare.Outputs[0].Value+test.fees {
+				t.Fatalf("coinbase collects %d in fees, want %d", tmpl.Fees, test.fees)
+			}
+
+			if tmpl.Size > test.maxSize {
+				t.Fatalf("template of %d bytes exceeds %d", tmpl.Size, test.maxSize)
+			}
+
+			block := blockchain.CreateBlock(tmpl.Txs, tmpl.PrevHash, chain.GetBestHeight()+1)
+			if err := chain.CheckBlockTxs(block); err != nil {
+				t.Fatalf("block from template is invalid: %s", err)
+			}
+		})
+	}
+}
+
+func TestTemplateStale(t *testing.T) {
+	chain, pool, w, split := newTestPool(t, 2)
+	address := string(w.Address())
+
+	tmpl := NewTemplate(chain, pool, address, 1<<20)
+	if tmpl.Stale(chain, pool) {
+		t.Fatal("new template is stale")
+	}
+
+	if err := pool.Add(*spend(w, split, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if !tmpl.Stale(chain, pool) {
+		t.Fatal("template not stale after a pool change")
+	}
+
+	tmpl = NewTemplate(chain, pool, address, 1<<20)
+	chain.MineBlock([]*blockchain.Transaction{blockchain.NewCoinbaseTx(address, "", 0)})
+	if !tmpl.Stale(chain, pool) {
+		t.Fatal("template not stale after a new tip")
+	}
+}
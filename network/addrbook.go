@@ -0,0 +1,247 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	addrBookFile = "./tmp/peers_%s.data"
+
+	// Addresses failing this many dials in a row are dropped from the book
+	maxFailures = 10
+	// Wait before dialing an address again, doubled on each failure
+	retryDelay = 30 * time.Second
+	// Most addresses sent in one addr message
+	maxAddrs = 1000
+)
+
+// What we know about the listening address of another node
+type KnownAddress struct {
+	Addr        string
+	Services    uint64
+	LastSeen    time.Time
+	LastAttempt time.Time
+	LastSuccess time.Time
+	// Failed dials since the last success
+	Failures int
+}
+
+// Deduplicated addresses of other nodes plus current bans, safe for use from
+// several goroutines and saved next to the chain database
+type AddrBook struct {
+	mu    sync.Mutex
+	path  string
+	Addrs map[string]*KnownAddress
+	// Host -> end of ban, see banHost() and Peer.banKey()
+	Bans map[string]time.Time
+}
+
+// Nodes without an ID keep their book in memory only
+func NewAddrBook(nodeID string) *AddrBook {
+	path := ""
+	if nodeID != "" {
+		path = fmt.Sprintf(addrBookFile, nodeID)
+	}
+
+	return &AddrBook{
+		path:  path,
+		Addrs: make(map[string]*KnownAddress),
+		Bans:  make(map[string]time.Time),
+	}
+}
+
+// Book saved by SaveFile(), or an empty one when there is none yet
+func LoadAddrBook(nodeID string) *AddrBook {
+	book := NewAddrBook(nodeID)
+	if book.path == "" {
+		return book
+	}
+
+	data, err := ioutil.ReadFile(book.path)
+	if os.IsNotExist(err) {
+		return book
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(book); err != nil {
+		fmt.Printf("Address book %s is corrupt, starting over: %s\n", book.path, err)
+		return NewAddrBook(nodeID)
+	}
+
+	return book
+}
+
+func (b *AddrBook) SaveFile() {
+	if b.path == "" {
+		return
+	}
+
+	b.mu.Lock()
+	data := GobEncode(b)
+	b.mu.Unlock()
+
+	if err := ioutil.WriteFile(b.path, data, 0644); err != nil {
+		log.Panic(err)
+	}
+}
+
+/*-------------------------------addresses-------------------------------*/
+
+// Add or refresh addr, returns false when it was known already
+func (b *AddrBook) Add(addr string, services uint64) bool {
+	if addr == "" {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ka, ok := b.Addrs[addr]; ok {
+		ka.LastSeen = time.Now()
+		ka.Services |= services
+		return false
+	}
+
+	b.Addrs[addr] = &KnownAddress{Addr: addr, Services: services, LastSeen: time.Now()}
+	return true
+}
+
+func (b *AddrBook) Attempt(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ka, ok := b.Addrs[addr]; ok {
+		ka.LastAttempt = time.Now()
+	}
+}
+
+// Connected and finished the handshake
+func (b *AddrBook) Good(addr string, services uint64) {
+	b.Add(addr, services)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ka := b.Addrs[addr]
+	if ka == nil {
+		return
+	}
+	ka.Services = services
+	ka.LastSuccess = time.Now()
+	ka.Failures = 0
+}
+
+// Dial failed, addresses that keep failing are forgotten
+func (b *AddrBook) Failed(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ka, ok := b.Addrs[addr]
+	if !ok {
+		return
+	}
+
+	ka.Failures++
+	if ka.Failures >= maxFailures {
+		fmt.Printf("Forgetting %s after %d failed dials\n", addr, ka.Failures)
+		delete(b.Addrs, addr)
+	}
+}
+
+// Up to max addresses, most recently seen first
+func (b *AddrBook) Addresses(max int) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var addrs []*KnownAddress
+	for _, ka := range b.Addrs {
+		addrs = append(addrs, ka)
+	}
+
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i].LastSeen.After(addrs[j].LastSeen)
+	})
+
+	var list []string
+	for i := 0; i < len(addrs) && i < max; i++ {
+		list = append(list, addrs[i].Addr)
+	}
+
+	return list
+}
+
+// Random address worth dialing: not connected, not banned and not failing
+// recently, "" if there is none
+func (b *AddrBook) Pick(connected func(string) bool) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var candidates []string
+	for addr, ka := range b.Addrs {
+		if connected(addr) || b.banned(banHost(addr)) {
+			continue
+		}
+
+		delay := retryDelay << uint(ka.Failures)
+		if time.Since(ka.LastAttempt) < delay && ka.Failures > 0 {
+			continue
+		}
+
+		candidates = append(candidates, addr)
+	}
+
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	return candidates[rand.Intn(len(candidates))]
+}
+
+func (b *AddrBook) Count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.Addrs)
+}
+
+/*-------------------------------bans-------------------------------*/
+
+func (b *AddrBook) Ban(key string, d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.Bans[key] = time.Now().Add(d)
+}
+
+func (b *AddrBook) IsBanned(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.banned(key)
+}
+
+func (b *AddrBook) banned(key string) bool {
+	until, ok := b.Bans[key]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(until) {
+		delete(b.Bans, key)
+		return false
+	}
+
+	return true
+}
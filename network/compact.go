@@ -0,0 +1,342 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/LidoKing/learnBlockchain/blockchain"
+)
+
+// Compact block relay: new blocks are pushed to peers as a header plus short
+// IDs of their txs, which peers mostly have in their mempools already. Txs
+// the receiver cannot find are asked for with getblocktxn and sent back in
+// blocktxn. If rebuilding fails the whole block is fetched with getdata.
+const (
+	// Peers speaking at least this version get compact blocks instead of inv
+	compactBlocksVersion = 3
+	// Short IDs are the first 6 bytes of sha256(block hash, nonce, tx ID)
+	shortIDMask = 1<<48 - 1
+	// A block still missing txs after this long is fetched whole
+	compactTimeout   = 10 * time.Second
+	maxPartialBlocks = 16
+)
+
+type PrefilledTx struct {
+	Index int
+	Tx    []byte
+}
+
+type CompactBlock struct {
+	AddrFrom string
+	Header   blockchain.BlockHeader
+	Nonce    uint64
+	ShortIDs []uint64
+	// Txs the receiver cannot have, the coinbase at least
+	Prefilled []PrefilledTx
+}
+
+type GetBlockTxn struct {
+	AddrFrom  string
+	BlockHash []byte
+	Indexes   []int
+}
+
+type BlockTxn struct {
+	AddrFrom  string
+	BlockHash []byte
+	Txs       [][]byte
+}
+
+// Block being rebuilt from a compact block, txs[i] is nil while missing
+type partialBlock struct {
+	header  blockchain.BlockHeader
+	txs     []*blockchain.Transaction
+	missing []int
+	from    *Peer
+	started time.Time
+}
+
+func shortTxID(hash []byte, nonce uint64, txID []byte) uint64 {
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], nonce)
+
+	sum := sha256.Sum256(bytes.Join([][]byte{hash, n[:], txID}, []byte{}))
+	return binary.BigEndian.Uint64(sum[:8]) & shortIDMask
+}
+
+func (n *Node) compactBlockMessage(block *blockchain.Block) []byte {
+	cmpct := CompactBlock{
+		AddrFrom: n.address,
+		Header:   block.Header(),
+		Nonce:    randomNonce(),
+	}
+
+	for i, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			cmpct.Prefilled = append(cmpct.Prefilled, PrefilledTx{i, tx.Serialize()})
+			continue
+		}
+		cmpct.ShortIDs = append(cmpct.ShortIDs, shortTxID(block.Hash, cmpct.Nonce, tx.ID))
+	}
+
+	return append(CmdToBytes("cmpctblock"), GobEncode(cmpct)...)
+}
+
+// Tell peers other than except (nil for none) about block, as a compact
+// block if they understand it and with an inv otherwise
+func (n *Node) announceBlock(block *blockchain.Block, except *Peer) {
+	var cmpct []byte
+
+	for _, p := range n.relayPeers() {
+		if p == except || p.knows(block.Hash) {
+			continue
+		}
+		p.markKnown(block.Hash)
+
+		if p.Version < compactBlocksVersion {
+			n.SendInv(p, "block", [][]byte{block.Hash})
+			continue
+		}
+
+		if cmpct == nil {
+			cmpct = n.compactBlockMessage(block)
+		}
+		p.Send(cmpct)
+	}
+}
+
+/*-------------------------------handlers-------------------------------*/
+
+func (n *Node) HandleCompactBlock(p *Peer, request []byte) error {
+	var buff bytes.Buffer
+	var payload CompactBlock
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return malformed("cmpctblock", err)
+	}
+
+	header := payload.Header
+	n.markKnownBy(p, header.Hash)
+
+	if n.chain.HasBlock(header.Hash) {
+		return nil
+	}
+
+	if !header.ValidatePoW() {
+		return misbehavior{scoreInvalidBlock, fmt.Sprintf("compact block %x has invalid proof of work", header.Hash)}
+	}
+
+	// Only blocks on our tip are rebuilt, anything else goes through headers
+	if !bytes.Equal(header.PrevHash, n.chain.LastHash()) {
+		n.sync.start(p)
+		return nil
+	}
+
+	partial, err := n.newPartialBlock(&payload, p)
+	if err != nil {
+		return err
+	}
+
+	if len(partial.missing) == 0 {
+		return n.completeBlock(partial)
+	}
+
+	fmt.Printf("Compact block %x is missing %d of %d txs, asking %s\n",
+		header.Hash, len(partial.missing), len(partial.txs), p)
+
+	n.partialsMu.Lock()
+	if len(n.partials) >= maxPartialBlocks {
+		n.partialsMu.Unlock()
+		n.SendGetData(p, "block", header.Hash)
+		return nil
+	}
+	n.partials[hex.EncodeToString(header.Hash)] = partial
+	n.partialsMu.Unlock()
+
+	payloadOut := GobEncode(GetBlockTxn{n.address, header.Hash, partial.missing})
+	p.Send(append(CmdToBytes("getblocktxn"), payloadOut...))
+
+	return nil
+}
+
+func (n *Node) HandleGetBlockTxn(p *Peer, request []byte) error {
+	var buff bytes.Buffer
+	var payload GetBlockTxn
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return malformed("getblocktxn", err)
+	}
+
+	block, err := n.chain.GetBlock(payload.BlockHash)
+	if err != nil {
+		return nil
+	}
+
+	var txs [][]byte
+	for _, i := range payload.Indexes {
+		if i < 0 || i >= len(block.Transactions) {
+			return misbehavior{scoreMalformed, fmt.Sprintf("getblocktxn index %d out of range", i)}
+		}
+		txs = append(txs, block.Transactions[i].Serialize())
+	}
+
+	payloadOut := GobEncode(BlockTxn{n.address, block.Hash, txs})
+	p.Send(append(CmdToBytes("blocktxn"), payloadOut...))
+
+	return nil
+}
+
+func (n *Node) HandleBlockTxn(p *Peer, request []byte) error {
+	var buff bytes.Buffer
+	var payload BlockTxn
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return malformed("blocktxn", err)
+	}
+
+	key := hex.EncodeToString(payload.BlockHash)
+
+	n.partialsMu.Lock()
+	partial, ok := n.partials[key]
+	delete(n.partials, key)
+	n.partialsMu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	if len(payload.Txs) != len(partial.missing) {
+		return misbehavior{scoreMalformed, fmt.Sprintf("blocktxn has %d txs for %d requested", len(payload.Txs), len(partial.missing))}
+	}
+
+	for j, i := range partial.missing {
+		tx, err := blockchain.DecodeTx(payload.Txs[j])
+		if err != nil {
+			return malformed("blocktxn", err)
+		}
+		partial.txs[i] = tx
+	}
+	partial.missing = nil
+
+	return n.completeBlock(partial)
+}
+
+/*-------------------------------rebuilding-------------------------------*/
+
+// Fill in what a compact block from peer from refers to from the prefilled
+// txs and the mempool
+func (n *Node) newPartialBlock(cmpct *CompactBlock, from *Peer) (*partialBlock, error) {
+	count := len(cmpct.ShortIDs) + len(cmpct.Prefilled)
+	if count == 0 || count > n.chain.Params.MaxBlockSize {
+		return nil, misbehavior{scoreMalformed, fmt.Sprintf("compact block with %d txs", count)}
+	}
+
+	partial := &partialBlock{
+		header:  cmpct.Header,
+		txs:     make([]*blockchain.Transaction, count),
+		from:    from,
+		started: time.Now(),
+	}
+
+	prefilled := make([]bool, count)
+	for _, pre := range cmpct.Prefilled {
+		if pre.Index < 0 || pre.Index >= count || prefilled[pre.Index] {
+			return nil, misbehavior{scoreMalformed, fmt.Sprintf("compact block prefills index %d", pre.Index)}
+		}
+
+		tx, err := blockchain.DecodeTx(pre.Tx)
+		if err != nil {
+			return nil, malformed("cmpctblock", err)
+		}
+		partial.txs[pre.Index] = tx
+		prefilled[pre.Index] = true
+	}
+
+	// Short IDs two pool txs share cannot be resolved, those are asked for
+	pool := make(map[uint64]*blockchain.Transaction)
+	collided := make(map[uint64]bool)
+	for _, tx := range n.pool.TxMap() {
+		tx := tx
+		id := shortTxID(cmpct.Header.Hash, cmpct.Nonce, tx.ID)
+		if _, ok := pool[id]; ok {
+			collided[id] = true
+		}
+		pool[id] = &tx
+	}
+
+	next := 0
+	for i := range partial.txs {
+		if prefilled[i] {
+			continue
+		}
+
+		id := cmpct.ShortIDs[next]
+		next++
+
+		if tx, ok := pool[id]; ok && !collided[id] {
+			partial.txs[i] = tx
+		} else {
+			partial.missing = append(partial.missing, i)
+		}
+	}
+
+	return partial, nil
+}
+
+// All txs are in, hand the block on as if it had been sent whole
+func (n *Node) completeBlock(partial *partialBlock) error {
+	h := partial.header
+	block := &blockchain.Block{
+		Timestamp:    h.Timestamp,
+		Hash:         h.Hash,
+		Transactions: partial.txs,
+		PrevHash:     h.PrevHash,
+		Nonce:        h.Nonce,
+		Height:       h.Height,
+	}
+
+	// A short ID matched the wrong pool tx
+	if !h.Matches(block) {
+		fmt.Printf("Could not rebuild compact block %x, fetching it whole\n", h.Hash)
+		n.SendGetData(partial.from, "block", h.Hash)
+		return nil
+	}
+
+	fmt.Printf("Rebuilt compact block %x from %s\n", h.Hash, partial.from)
+
+	return n.processBlock(block, partial.from)
+}
+
+// Fetch blocks whole whose missing txs did not arrive in time
+func (n *Node) expirePartialBlocks() {
+	var late []*partialBlock
+
+	n.partialsMu.Lock()
+	for key, partial := range n.partials {
+		if time.Since(partial.started) > compactTimeout {
+			delete(n.partials, key)
+			late = append(late, partial)
+		}
+	}
+	n.partialsMu.Unlock()
+
+	for _, partial := range late {
+		if !n.chain.HasBlock(partial.header.Hash) {
+			n.SendGetData(partial.from, "block", partial.header.Hash)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/LidoKing/learnBlockchain/blockchain"
+	"github.com/LidoKing/learnBlockchain/blockchain/wallet"
+	"github.com/LidoKing/learnBlockchain/mempool"
+)
+
+// Node with just a chain in a temp dir, whose genesis pays w, and a pool,
+// enough for what does not touch peers
+func newTestNode(t *testing.T) (*Node, *wallet.Wallet) {
+	t.Helper()
+
+	prevDifficulty := blockchain.Difficulty
+	blockchain.Difficulty = 4
+
+	dir, err := ioutil.TempDir("", "network")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := wallet.MakeWallet()
+	chain, err := blockchain.NewBlockChain(dir, blockchain.Genesis(blockchain.CoinbaseTx(string(w.Address()), "genesis")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		chain.Database.Close()
+		os.RemoveAll(dir)
+		blockchain.Difficulty = prevDifficulty
+	})
+
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	UTXOSet.Reindex()
+
+	n := &Node{chain: chain, pool: mempool.New(chain, mempool.DefaultConfig)}
+	return n, w
+}
+
+func decodeCompactBlock(t *testing.T, msg []byte) *CompactBlock {
+	t.Helper()
+
+	var cmpct CompactBlock
+	if err := gob.NewDecoder(bytes.NewReader(msg[commandLength:])).Decode(&cmpct); err != nil {
+		t.Fatal(err)
+	}
+	return &cmpct
+}
+
+func TestCompactBlockReconstruction(t *testing.T) {
+	n, w := newTestNode(t)
+	address := string(w.Address())
+
+	// Two txs spending separate outputs of a mined tx, so both can be in
+	// the pool at once
+	UTXOSet := blockchain.UTXOSet{Blockchain: n.chain}
+	split := blockchain.NewPaymentsTransaction(w, []blockchain.Payment{{Address: address, Amount: 10}}, &UTXOSet)
+	UTXOSet.Update(n.chain.MineBlock([]*blockchain.Transaction{blockchain.NewCoinbaseTx(address, "", 0), split}))
+
+	first := spendOutput(w, split, 0, 1)
+	second := spendOutput(w, split, 1, 1)
+
+	block := blockchain.CreateBlock([]*blockchain.Transaction{blockchain.NewCoinbaseTx(address, "", 2), first, second}, n.chain.LastHash(), 2)
+
+	tests := []struct {
+		name    string
+		pool    []*blockchain.Transaction
+		missing []int
+	}{
+		{"all in pool", []*blockchain.Transaction{first, second}, nil},
+		{"one missing", []*blockchain.Transaction{second}, []int{1}},
+		{"none in pool", nil, []int{1, 2}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n.pool = mempool.New(n.chain, mempool.DefaultConfig)
+			for _, tx := range test.pool {
+				if err := n.pool.Add(*tx); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			msg := n.compactBlockMessage(block)
+			if len(msg) >= len(block.Serialize()) {
+				t.Fatalf("compact block of %d bytes is not smaller than the block (%d)", len(msg), len(block.Serialize()))
+			}
+
+			partial, err := n.newPartialBlock(decodeCompactBlock(t, msg), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(partial.missing) != len(test.missing) {
+				t.Fatalf("missing %v, want %v", partial.missing, test.missing)
+			}
+			for i, index := range test.missing {
+				if partial.missing[i] != index || partial.txs[index] != nil {
+					t.Fatalf("missing %v, want %v", partial.missing, test.missing)
+				}
+			}
+
+			// What a blocktxn reply fills in
+			for _, index := range partial.missing {
+				partial.txs[index] = block.Transactions[index]
+			}
+
+			rebuilt := &blockchain.Block{
+				Timestamp:    partial.header.Timestamp,
+				Hash:         partial.header.Hash,
+				Transactions: partial.txs,
+				PrevHash:     partial.header.PrevHash,
+				Nonce:        partial.header.Nonce,
+				Height:       partial.header.Height,
+			}
+			if !partial.header.Matches(rebuilt) {
+				t.Fatal("rebuilt block does not match its header")
+			}
+		})
+	}
+}
+
+func TestCompactBlockMalformed(t *testing.T) {
+	n, w := newTestNode(t)
+	block := blockchain.CreateBlock([]*blockchain.Transaction{blockchain.NewCoinbaseTx(string(w.Address()), "", 0)}, n.chain.LastHash(), 1)
+	cmpct := decodeCompactBlock(t, n.compactBlockMessage(block))
+
+	tests := []struct {
+		name   string
+		change func(c *CompactBlock)
+	}{
+		{"no txs", func(c *CompactBlock) { c.Prefilled = nil }},
+		{"prefilled out of range", func(c *CompactBlock) { c.Prefilled[0].Index = 1 }},
+		{"prefilled twice", func(c *CompactBlock) {
+			c.Prefilled = append(c.Prefilled, c.Prefilled[0])
+			c.ShortIDs = nil
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bad := *cmpct
+			bad.Prefilled = append([]PrefilledTx(nil), cmpct.Prefilled...)
+			test.change(&bad)
+
+			_, err := n.newPartialBlock(&bad, nil)
+			if !errors.As(err, &misbehavior{}) {
+				t.Fatalf("got %v, want misbehavior", err)
+			}
+		})
+	}
+}
+
+// Tx signed by w spending output out of parent, paying all of it but fee to w
+func spendOutput(w *wallet.Wallet, parent *blockchain.Transaction, out, fee int) *blockchain.Transaction {
+	inputs := []blockchain.TxInput{{ID: parent.ID, Out: out}}
+	payments := []blockchain.Payment{{Address: string(w.Address()), Amount: parent.Outputs[out].Value - fee}}
+
+	tx := blockchain.NewRawTransaction(inputs, payments)
+	tx.SignWith([]*wallet.Wallet{w}, []blockchain.TxOutput{parent.Outputs[out]})
+
+	return tx
+}
@@ -0,0 +1,203 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Where a node listens and which nodes it talks to. Other nodes are told the
+// advertised address, which is the listen address unless an external IP is
+// given, as needed behind NAT, in containers or when listening on all
+// interfaces. Addresses are host:port with IPv6 hosts in brackets, a missing
+// port means defaultPort.
+type NetConfig struct {
+	// Bind address, an empty host or 0.0.0.0/:: listens on all interfaces
+	Listen string `json:"listen"`
+	// Host other nodes reach this one at, with the listen port
+	ExternalIP string `json:"externalip"`
+	// Only connect to these nodes and not to any from the address book
+	Connect []string `json:"connect"`
+	// Always connect to these nodes, besides those from the address book
+	AddNodes []string `json:"addnode"`
+	// Added to the address book at start
+	Seeds []string `json:"seeds"`
+	// Ban misbehaving peers on loopback addresses too, off by default as all
+	// nodes and CLI commands on this machine come from there
+	BanLoopback bool `json:"banloopback"`
+}
+
+const (
+	defaultPort = "3000"
+	// Read by startnode and by CLI commands looking for their node, NODE_ID
+	// only selects which one
+	netConfigFile = "./tmp/node_%s.json"
+)
+
+var DefaultNetConfig = NetConfig{
+	Listen: "localhost:" + defaultPort,
+	Seeds:  []string{"localhost:" + defaultPort},
+}
+
+// DefaultNetConfig, listening on the port nodeID names if it is a port
+// number, as in the original repo, so that nodes on one machine do not need a
+// config to run side by side
+func defaultNetConfig(nodeID string) NetConfig {
+	cfg := DefaultNetConfig
+	cfg.Seeds = append([]string(nil), DefaultNetConfig.Seeds...)
+
+	if port, err := strconv.Atoi(nodeID); err == nil && port > 0 && port <= 65535 {
+		cfg.Listen = net.JoinHostPort("localhost", strconv.Itoa(port))
+	}
+
+	return cfg
+}
+
+// Config in the data dir of nodeID, the defaults of nodeID for fields it
+// leaves out or when there is none, see defaultNetConfig()
+func LoadNetConfig(nodeID string) (NetConfig, error) {
+	cfg := defaultNetConfig(nodeID)
+	path := fmt.Sprintf(netConfigFile, nodeID)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Normalize all addresses, the first malformed one is returned as error
+func (c *NetConfig) Validate() error {
+	var err error
+
+	if c.Listen, err = normalizeAddr(c.Listen, true); err != nil {
+		return fmt.Errorf("listen address: %s", err)
+	}
+
+	if c.ExternalIP != "" {
+		host := strings.Trim(c.ExternalIP, "[]")
+		if host == "" || strings.ContainsAny(host, " /") {
+			return fmt.Errorf("external IP %q is malformed", c.ExternalIP)
+		}
+		c.ExternalIP = host
+	}
+
+	for _, list := range [][]string{c.Connect, c.AddNodes, c.Seeds} {
+		for i, addr := range list {
+			if list[i], err = normalizeAddr(addr, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Address other nodes are told to dial
+func (c NetConfig) Advertised() string {
+	host, port, _ := net.SplitHostPort(c.Listen)
+
+	if c.ExternalIP != "" {
+		host = c.ExternalIP
+	} else if isUnspecified(host) {
+		// Nothing better to tell, fine for nodes on one machine
+		host = "localhost"
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+// Address local CLI commands reach the node at
+func (c NetConfig) LocalAddr() string {
+	host, port, _ := net.SplitHostPort(c.Listen)
+	if isUnspecified(host) {
+		host = "localhost"
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+// Address of the node using the data dir of nodeID, for CLI commands
+func NodeAddress(nodeID string) (string, error) {
+	cfg, err := LoadNetConfig(nodeID)
+	if err != nil {
+		return "", err
+	}
+
+	return cfg.LocalAddr(), nil
+}
+
+// First seed of the node using the data dir of nodeID, where CLI commands
+// send txs to
+func SeedNode(nodeID string) (string, error) {
+	cfg, err := LoadNetConfig(nodeID)
+	if err != nil {
+		return "", err
+	}
+
+	if len(cfg.Seeds) == 0 {
+		return cfg.LocalAddr(), nil
+	}
+	return cfg.Seeds[0], nil
+}
+
+/*-------------------------------addresses-------------------------------*/
+
+func isUnspecified(host string) bool {
+	if host == "" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// Bring addr into host:port form, adding defaultPort when it has none
+// Only listen addresses may leave the host out
+func normalizeAddr(addr string, listen bool) (string, error) {
+	addr = strings.TrimSpace(addr)
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// Bare host, IPv6 ones with or without brackets
+		host, port = strings.Trim(addr, "[]"), defaultPort
+		if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+			return "", fmt.Errorf("address %q is malformed", addr)
+		}
+	}
+
+	if host == "" && !listen {
+		return "", fmt.Errorf("address %q has no host", addr)
+	}
+
+	// Listening on port 0 picks a free port
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 || (n == 0 && !listen) {
+		return "", fmt.Errorf("address %q has a bad port", addr)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// Checks addresses learned from other nodes, which are not normalized
+func validAddr(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || isUnspecified(host) {
+		return false
+	}
+
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
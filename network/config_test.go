@@ -0,0 +1,31 @@
+package network
+
+import "testing"
+
+func TestDefaultNetConfig(t *testing.T) {
+	tests := []struct {
+		nodeID string
+		listen string
+	}{
+		{"3000", "localhost:3000"},
+		{"3001", "localhost:3001"},
+		{"alice", "localhost:" + defaultPort},
+		{"70000", "localhost:" + defaultPort},
+		{"", "localhost:" + defaultPort},
+	}
+
+	for _, test := range tests {
+		// No config file in the package dir, so only defaults
+		cfg, err := LoadNetConfig(test.nodeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cfg.Listen != test.listen || cfg.LocalAddr() != test.listen {
+			t.Errorf("node %q listens on %s, want %s", test.nodeID, cfg.Listen, test.listen)
+		}
+		if len(cfg.Seeds) != 1 || cfg.Seeds[0] != "localhost:"+defaultPort {
+			t.Errorf("node %q has seeds %v", test.nodeID, cfg.Seeds)
+		}
+	}
+}
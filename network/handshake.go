@@ -0,0 +1,241 @@
+package network
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// Before anything else both ends of a connection send "version" and answer
+// the other's with "verack", other messages are only processed after that.
+// The connection then speaks the lower of both protocol versions.
+const (
+	minProtocolVersion = 2
+	userAgent          = "/learnBlockchain:0.2.0/"
+	handshakeTimeout   = 10 * time.Second
+)
+
+// Services a node offers, advertised in its version message
+const (
+	ServiceFullNode uint64 = 1 << iota
+	ServiceLight
+	ServiceMiner
+)
+
+func randomNonce() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Panic(err)
+	}
+
+	return binary.BigEndian.Uint64(b[:])
+}
+
+func servicesString(services uint64) string {
+	names := []string{"full", "light", "miner"}
+
+	var s []byte
+	for i, name := range names {
+		if services&(1<<uint(i)) != 0 {
+			if len(s) > 0 {
+				s = append(s, ',')
+			}
+			s = append(s, name...)
+		}
+	}
+
+	if len(s) == 0 {
+		return "none"
+	}
+	return string(s)
+}
+
+func versionMessage(services uint64, bestHeight int, nonce uint64, addrFrom string) []byte {
+	payload := GobEncode(Version{
+		Version:    version,
+		Services:   services,
+		UserAgent:  userAgent,
+		BestHeight: bestHeight,
+		Nonce:      nonce,
+		AddrFrom:   addrFrom,
+	})
+
+	return append(CmdToBytes("version"), payload...)
+}
+
+func (n *Node) versionMessage() []byte {
+	return versionMessage(n.services, n.chain.GetBestHeight(), n.nonce, n.address)
+}
+
+func decodeVersion(request []byte) (Version, error) {
+	var payload Version
+
+	dec := gob.NewDecoder(bytes.NewReader(request[commandLength:]))
+	err := dec.Decode(&payload)
+
+	return payload, err
+}
+
+// nonce is the one we sent, seeing it back means we are talking to ourselves
+func checkVersion(payload Version, nonce uint64) error {
+	if payload.Nonce == nonce {
+		return errors.New("connected to self")
+	}
+
+	if payload.Version < minProtocolVersion {
+		return fmt.Errorf("protocol version %d is older than %d", payload.Version, minProtocolVersion)
+	}
+
+	return nil
+}
+
+/*-------------------------------peer side-------------------------------*/
+
+// Only handshake messages may be sent before it completes
+func isHandshakeCmd(cmd string) bool {
+	return cmd == "version" || cmd == "verack" || cmd == "ping" || cmd == "pong"
+}
+
+func (p *Peer) HandshakeDone() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.versionReceived && p.verackReceived
+}
+
+func (p *Peer) sendVersion() {
+	p.mu.Lock()
+	p.versionSent = true
+	p.mu.Unlock()
+
+	p.Send(p.node.versionMessage())
+}
+
+func (p *Peer) handleVersion(request []byte) {
+	payload, err := decodeVersion(request)
+	if err != nil {
+		p.Misbehaving(scoreMalformed, fmt.Sprintf("malformed version: %s", err))
+		p.Close()
+		return
+	}
+
+	if err := checkVersion(payload, p.node.nonce); err != nil {
+		fmt.Printf("Handshake with %s failed: %s\n", p, err)
+		p.Close()
+		return
+	}
+
+	p.mu.Lock()
+	if p.versionReceived {
+		p.mu.Unlock()
+		fmt.Printf("Duplicate version from %s\n", p)
+		return
+	}
+	p.versionReceived = true
+	p.Version = payload.Version
+	if p.Version > version {
+		p.Version = version
+	}
+	p.Services = payload.Services
+	p.UserAgent = payload.UserAgent
+	p.StartHeight = payload.BestHeight
+	versionSent := p.versionSent
+	p.mu.Unlock()
+
+	p.learnAddr(payload.AddrFrom)
+
+	fmt.Printf("Peer %s: version %d, services %s, %s, height %d\n",
+		p, payload.Version, servicesString(payload.Services), payload.UserAgent, payload.BestHeight)
+
+	// Inbound peers spoke first
+	if !versionSent {
+		p.sendVersion()
+	}
+	p.Send(CmdToBytes("verack"))
+
+	p.completeHandshake()
+}
+
+func (p *Peer) handleVerack() {
+	p.mu.Lock()
+	p.verackReceived = true
+	p.mu.Unlock()
+
+	p.completeHandshake()
+}
+
+// Once both version and verack are in, send what was held back and catch up
+func (p *Peer) completeHandshake() {
+	p.mu.Lock()
+	if !p.versionReceived || !p.verackReceived || p.handshaked {
+		p.mu.Unlock()
+		return
+	}
+	p.handshaked = true
+	held := p.held
+	p.held = nil
+	p.mu.Unlock()
+
+	for _, request := range held {
+		p.Send(request)
+	}
+
+	addr := p.Addr()
+	if addr == "" || p.Services&ServiceFullNode == 0 {
+		return
+	}
+
+	n := p.node
+	n.book.Good(addr, p.Services)
+
+	if !p.Inbound {
+		n.SendGetAddr(p)
+	}
+
+	if n.chain.GetBestHeight() < p.StartHeight {
+		n.sync.start(p)
+	}
+}
+
+/*-------------------------------one-shot-------------------------------*/
+
+// Handshake on a connection used for a single message, see sendOnce()
+func handshakeOnce(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce := randomNonce()
+	if err := WriteMessage(conn, versionMessage(0, 0, nonce, "")); err != nil {
+		return err
+	}
+
+	gotVersion, gotVerack := false, false
+	for !gotVersion || !gotVerack {
+		req, err := ReadMessage(conn, maxMessageSize(nil))
+		if err != nil {
+			return err
+		}
+
+		switch BytesToCmd(req[:commandLength]) {
+		case "version":
+			payload, err := decodeVersion(req)
+			if err == nil {
+				err = checkVersion(payload, nonce)
+			}
+			if err != nil {
+				return err
+			}
+			gotVersion = true
+		case "verack":
+			gotVerack = true
+		}
+	}
+
+	return WriteMessage(conn, CmdToBytes("verack"))
+}
@@ -0,0 +1,263 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	targetOutbound  = 8
+	maxInbound      = 16
+	connectInterval = 10 * time.Second
+	saveInterval    = time.Minute
+
+	// Peers reaching banThreshold are disconnected and banned for banDuration
+	banThreshold = 100
+	banDuration  = 24 * time.Hour
+
+	// Key of all loopback addresses, see banHost()
+	loopbackHost = "127.0.0.1"
+
+	scoreInvalidBlock = 100
+	scoreInvalidTx    = 10
+	scoreMalformed    = 20
+)
+
+// Returned by handlers for a message breaking the rules, the peer that sent
+// it is scored with it, see Peer.Misbehaving()
+type misbehavior struct {
+	score  int
+	reason string
+}
+
+func (m misbehavior) Error() string {
+	return m.reason
+}
+
+func malformed(cmd string, err error) error {
+	return misbehavior{scoreMalformed, fmt.Sprintf("malformed %s: %s", cmd, err)}
+}
+
+/*-------------------------------scoring-------------------------------*/
+
+// Host part of addr, addr itself if it has no port
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Host of addr as bans are keyed, IPs in canonical form and localhost as
+// well as every loopback IP as 127.0.0.1, so that dialed addresses and those
+// of connections agree
+func banHost(addr string) string {
+	host := hostOf(addr)
+	if strings.EqualFold(host, "localhost") {
+		return loopbackHost
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip.IsLoopback() {
+		return loopbackHost
+	}
+	return ip.String()
+}
+
+// Whether addr is on the host remote (the address of a connection) comes
+// from, host names in addr are looked up if they do not match as they are
+func sameHost(addr, remote string) bool {
+	host := banHost(remote)
+	if banHost(addr) == host {
+		return true
+	}
+
+	ips, err := net.LookupIP(hostOf(addr))
+	if err != nil {
+		return false
+	}
+
+	for _, ip := range ips {
+		if ip.String() == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Scores and bans are keyed by the host the connection comes from, not by
+// the AddrFrom a peer chooses itself, so reconnecting or claiming another
+// address does not shed them
+// All nodes and CLI commands on this machine share the loopback host, so
+// unless BanLoopback is set loopback peers are scored by connection and only
+// disconnected, false is returned for keys that are not banned
+func (p *Peer) banKey() (string, bool) {
+	remote := p.conn.RemoteAddr().String()
+	host := banHost(remote)
+
+	if host == loopbackHost && !p.node.cfg.Net.BanLoopback {
+		return remote, false
+	}
+	return host, true
+}
+
+// CLI commands handshake without services or a listening address and send a
+// single message, see sendOnce()
+func (p *Peer) oneShot() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.Inbound && p.versionReceived && p.Services == 0 && p.addr == ""
+}
+
+func (p *Peer) Misbehaving(score int, reason string) {
+	// Whoever ran the command gets the error, the node is not to blame
+	if p.oneShot() {
+		fmt.Printf("Refused message of CLI connection %s: %s\n", p, reason)
+		return
+	}
+
+	n := p.node
+	key, bannable := p.banKey()
+
+	n.scoresMu.Lock()
+	n.banScores[key] += score
+	total := n.banScores[key]
+	if total >= banThreshold {
+		delete(n.banScores, key)
+	}
+	n.scoresMu.Unlock()
+
+	fmt.Printf("Peer %s misbehaving (%d, total %d): %s\n", p, score, total, reason)
+
+	if total < banThreshold {
+		return
+	}
+
+	if !bannable {
+		fmt.Printf("Disconnecting %s, loopback peers are not banned\n", p)
+		p.Close()
+		return
+	}
+
+	fmt.Printf("Banning %s for %s\n", key, banDuration)
+	n.book.Ban(key, banDuration)
+
+	for _, other := range n.allConns() {
+		if otherKey, _ := other.banKey(); otherKey == key {
+			other.Close()
+		}
+	}
+}
+
+/*-------------------------------connections-------------------------------*/
+
+func (n *Node) countPeers(inbound bool) int {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	count := 0
+	for p := range n.conns {
+		if p.Inbound == inbound {
+			count++
+		}
+	}
+
+	return count
+}
+
+func (n *Node) isConnected(addr string) bool {
+	_, ok := n.getPeer(addr)
+	return ok || n.isLocalAddr(addr)
+}
+
+func (n *Node) acceptPeer(conn net.Conn) {
+	p := newPeer(n, conn, "", true)
+
+	if n.book.IsBanned(banHost(conn.RemoteAddr().String())) {
+		fmt.Printf("Refused banned %s\n", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	if n.countPeers(true) >= maxInbound {
+		fmt.Printf("Refused %s, too many inbound peers\n", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	secured, pubKey, err := n.secureAccept(conn)
+	if err != nil {
+		fmt.Printf("Refused %s: %s\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	p.conn = secured
+	p.PubKey = pubKey
+
+	p.start()
+}
+
+// Dial the nodes given with -connect or -addnode that are not connected yet
+func (n *Node) connectFixed(addrs []string) {
+	for _, addr := range addrs {
+		if n.isConnected(addr) {
+			continue
+		}
+
+		if _, err := n.connectPeer(addr); err != nil {
+			fmt.Printf("%s is not available\n", addr)
+		}
+	}
+}
+
+// Dial addresses from the book until there are targetOutbound outbound peers,
+// with -connect only the nodes given
+func (n *Node) connectMore() {
+	if len(n.cfg.Net.Connect) > 0 {
+		n.connectFixed(n.cfg.Net.Connect)
+		return
+	}
+	n.connectFixed(n.cfg.Net.AddNodes)
+
+	for tries := targetOutbound - n.countPeers(false); tries > 0; tries-- {
+		addr := n.book.Pick(n.isConnected)
+		if addr == "" {
+			return
+		}
+
+		n.book.Attempt(addr)
+		if _, err := n.connectPeer(addr); err != nil {
+			fmt.Printf("%s is not available\n", addr)
+			n.book.Failed(addr)
+		}
+	}
+}
+
+// Keep up the number of outbound peers and save the address book now and then
+func (n *Node) managePeers(ctx context.Context) {
+	n.connectMore()
+
+	connectTicker := time.NewTicker(connectInterval)
+	defer connectTicker.Stop()
+	saveTicker := time.NewTicker(saveInterval)
+	defer saveTicker.Stop()
+
+	for {
+		select {
+		case <-connectTicker.C:
+			n.connectMore()
+		case <-saveTicker.C:
+			n.book.SaveFile()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
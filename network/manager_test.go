@@ -0,0 +1,119 @@
+package network
+
+import (
+	"net"
+	"testing"
+)
+
+// Connection that seems to come from remote
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.remote }
+
+// Inbound peer from remote on a node with nothing but an address book
+func testPeer(t *testing.T, n *Node, remote string) *Peer {
+	t.Helper()
+
+	addr, err := net.ResolveTCPAddr("tcp", remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, other := net.Pipe()
+	t.Cleanup(func() { other.Close() })
+
+	p := newPeer(n, remoteConn{local, addr}, "", true)
+	n.conns[p] = true
+	return p
+}
+
+func newScoringNode(banLoopback bool) *Node {
+	n := &Node{
+		book:      NewAddrBook(""),
+		banScores: make(map[string]int),
+		peers:     make(map[string]*Peer),
+		conns:     make(map[*Peer]bool),
+	}
+	n.cfg.Net.BanLoopback = banLoopback
+	return n
+}
+
+func TestBanHost(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"localhost:3000", "127.0.0.1"},
+		{"LOCALHOST", "127.0.0.1"},
+		{"127.0.0.1:51234", "127.0.0.1"},
+		{"[::1]:3000", "127.0.0.1"},
+		{"127.0.0.2", "127.0.0.1"},
+		{"[2001:db8:0::1]:3000", "2001:db8::1"},
+		{"sim1:3000", "sim1"},
+	}
+
+	for _, test := range tests {
+		if got := banHost(test.addr); got != test.want {
+			t.Errorf("banHost(%q) = %q, want %q", test.addr, got, test.want)
+		}
+	}
+
+	if !sameHost("localhost:3001", "127.0.0.1:51234") || !sameHost("[::1]:3002", "127.0.0.1:51234") || sameHost("10.0.0.1:3000", "127.0.0.1:51234") {
+		t.Fatal("wrong host match")
+	}
+}
+
+func TestMisbehaving(t *testing.T) {
+	tests := []struct {
+		name        string
+		remote      string
+		banLoopback bool
+		// Host that ends up banned, "" for none
+		banned string
+	}{
+		{"remote host", "10.0.0.1:51234", false, "10.0.0.1"},
+		{"loopback", "127.0.0.1:51234", false, ""},
+		{"loopback banned", "127.0.0.1:51234", true, "127.0.0.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := newScoringNode(test.banLoopback)
+			p := testPeer(t, n, test.remote)
+			// Another connection from the same host
+			other := testPeer(t, n, hostOf(test.remote)+":51235")
+
+			p.Misbehaving(banThreshold, "test")
+
+			if !p.closed() {
+				t.Fatal("peer reaching the threshold not disconnected")
+			}
+			if other.closed() != (test.banned != "") {
+				t.Fatalf("other connection from the host closed: %t", other.closed())
+			}
+			if test.banned != "" && !n.book.IsBanned(test.banned) {
+				t.Fatalf("%s not banned", test.banned)
+			}
+			if test.banned == "" && n.book.IsBanned(loopbackHost) {
+				t.Fatal("loopback banned")
+			}
+		})
+	}
+}
+
+func TestMisbehavingOneShot(t *testing.T) {
+	n := newScoringNode(true)
+	p := testPeer(t, n, "10.0.0.1:51234")
+
+	// What handleVersion() records for sendOnce()
+	p.versionReceived = true
+
+	p.Misbehaving(banThreshold, "test")
+
+	if p.closed() || n.book.IsBanned("10.0.0.1") || len(n.banScores) != 0 {
+		t.Fatal("CLI connection scored")
+	}
+}
@@ -0,0 +1,83 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Every message on a connection starts with a header:
+//
+//	magic    4 bytes, identifies the network
+//	command  commandLength bytes, zero padded
+//	length   4 bytes big endian, size of the payload
+//	checksum 4 bytes, start of sha256(sha256(payload))
+//
+// so several messages can be sent over one connection.
+const (
+	checksumLength = 4
+	headerLength   = 4 + commandLength + 4 + checksumLength
+)
+
+var networkMagic = []byte{0xf9, 0xbe, 0xb4, 0xd9}
+
+func checksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+
+	return second[:checksumLength]
+}
+
+// Write request (command followed by payload, see CmdToBytes()) with a header
+func WriteMessage(w io.Writer, request []byte) error {
+	if len(request) < commandLength {
+		return errors.New("message has no command")
+	}
+
+	cmd, payload := request[:commandLength], request[commandLength:]
+
+	var msg bytes.Buffer
+	msg.Write(networkMagic)
+	msg.Write(cmd)
+	binary.Write(&msg, binary.BigEndian, uint32(len(payload)))
+	msg.Write(checksum(payload))
+	msg.Write(payload)
+
+	_, err := w.Write(msg.Bytes())
+	return err
+}
+
+// Read the next message, returned as command followed by payload like the
+// requests taken by the handlers
+func ReadMessage(r io.Reader, maxSize int64) ([]byte, error) {
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(header[:4], networkMagic) {
+		return nil, errors.New("wrong network magic")
+	}
+
+	cmd := header[4 : 4+commandLength]
+	length := binary.BigEndian.Uint32(header[4+commandLength:])
+	sum := header[4+commandLength+4:]
+
+	if int64(length) > maxSize {
+		return nil, fmt.Errorf("%s message of %d bytes is larger than %d", BytesToCmd(cmd), length, maxSize)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(checksum(payload), sum) {
+		return nil, fmt.Errorf("%s message has a wrong checksum", BytesToCmd(cmd))
+	}
+
+	return append(append([]byte{}, cmd...), payload...), nil
+}
@@ -2,38 +2,35 @@ package network
 
 import (
   "bytes"
+	"context"
 	"encoding/gob"
-	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net"
-	"syscall"
-	"runtime"
-	"os"
-  "github.com/vrecan/death/v3"
+	"time"
   "github.com/LidoKing/learnBlockchain/blockchain"
+	"github.com/LidoKing/learnBlockchain/mempool"
 )
 
 const (
 	protocol      = "tcp"
-	version       = 1
+	version       = 3
 	commandLength = 12
-)
 
-var (
-	nodeAddress     string
-	mineAddress     string
-	KnownNodes      = []string{"localhost:3000"}
-	blocksInTransit = [][]byte{}
-	memoryPool      = make(map[string]blockchain.Transaction)
+	expireInterval = 10 * time.Minute
+	// Gob type info and the fields next to a block's bytes
+	messageOverhead = 1024
 )
 
 type Addr struct {
 	AddrList []string
 }
 
+type GetAddr struct {
+	AddrFrom string
+}
+
 type Block struct {
 	AddrFrom string
 	Block    []byte
@@ -41,6 +38,8 @@ type Block struct {
 
 type GetBlocks struct {
 	AddrFrom string
+	Locator  [][]byte
+	StopHash []byte
 }
 
 type GetData struct {
@@ -62,7 +61,10 @@ type Tx struct {
 
 type Version struct {
 	Version    int
+	Services   uint64
+	UserAgent  string
 	BestHeight int
+	Nonce      uint64
 	AddrFrom   string
 }
 
@@ -92,95 +94,101 @@ func ExtractCmd(request []byte) []byte {
 	return request[:commandLength]
 }
 
-func RequestBlocks() {
-	for _, node := range KnownNodes {
-		SendGetBlocks(node)
-	}
-}
-
-func SendAddr(address string) {
-	nodes := Addr{KnownNodes}
-	nodes.AddrList = append(nodes.AddrList, nodeAddress)
+func (n *Node) SendAddr(p *Peer) {
+	nodes := Addr{n.book.Addresses(maxAddrs - 1)}
+	nodes.AddrList = append(nodes.AddrList, n.address)
 	payload := GobEncode(nodes)
 	request := append(CmdToBytes("addr"), payload...)
 
-	SendData(address, request)
+	p.Send(request)
 }
 
-func SendBlock(addr string, b *blockchain.Block) {
-	data := Block{nodeAddress, b.Serialize()}
+func (n *Node) SendGetAddr(p *Peer) {
+	payload := GobEncode(GetAddr{n.address})
+	request := append(CmdToBytes("getaddr"), payload...)
+
+	p.Send(request)
+}
+
+func (n *Node) SendBlock(p *Peer, b *blockchain.Block) {
+	data := Block{n.address, b.Serialize()}
 	payload := GobEncode(data)
 	request := append(CmdToBytes("block"), payload...)
 
-	SendData(addr, request)
+	p.Send(request)
 }
 
-func SendData(addr string, data []byte) {
-	conn, err := net.Dial(protocol, addr)
-
+// Without a running node (CLI commands) a message goes over a connection of
+// its own
+func sendOnce(addr string, data []byte) {
+	conn, err := net.DialTimeout(protocol, addr, dialTimeout)
 	if err != nil {
 		fmt.Printf("%s is not available\n", addr)
-		var updatedNodes []string
-
-		for _, node := range KnownNodes {
-			if node != addr {
-				updatedNodes = append(updatedNodes, node)
-			}
-		}
+		return
+	}
 
-		KnownNodes = updatedNodes
+	defer conn.Close()
 
+	secured, err := secureDialOnce(conn)
+	if err != nil {
+		fmt.Printf("Could not secure connection to %s: %s\n", addr, err)
 		return
 	}
+	conn = secured
 
-	defer conn.Close()
+	if err := handshakeOnce(conn); err != nil {
+		fmt.Printf("Handshake with %s failed: %s\n", addr, err)
+		return
+	}
 
-	_, err = io.Copy(conn, bytes.NewReader(data))
+	err = WriteMessage(conn, data)
 	if err != nil {
 		log.Panic(err)
 	}
 }
 
-func SendInv(address, kind string, items [][]byte) {
-	inventory := Inv{nodeAddress, kind, items}
+func (n *Node) SendInv(p *Peer, kind string, items [][]byte) {
+	inventory := Inv{n.address, kind, items}
 	payload := GobEncode(inventory)
 	request := append(CmdToBytes("inv"), payload...)
 
-	SendData(address, request)
+	p.Send(request)
 }
 
-func SendGetBlocks(address string) {
-	payload := GobEncode(GetBlocks{nodeAddress})
+// Ask for the hashes of up to maxBlocksPerInv blocks following the fork with
+// locator, see BlockChain.BlockLocator()
+func (n *Node) SendGetBlocks(p *Peer, locator [][]byte, stop []byte) {
+	payload := GobEncode(GetBlocks{n.address, locator, stop})
 	request := append(CmdToBytes("getblocks"), payload...)
 
-	SendData(address, request)
+	p.Send(request)
 }
 
-func SendGetData(address, kind string, id []byte) {
-	payload := GobEncode(GetData{nodeAddress, kind, id})
+func (n *Node) SendGetData(p *Peer, kind string, id []byte) {
+	payload := GobEncode(GetData{n.address, kind, id})
 	request := append(CmdToBytes("getdata"), payload...)
 
-	SendData(address, request)
+	p.Send(request)
 }
 
-func SendTx(addr string, tnx *blockchain.Transaction) {
-	data := Tx{nodeAddress, tnx.Serialize()}
+func (n *Node) SendTx(p *Peer, tnx *blockchain.Transaction) {
+	data := Tx{n.address, tnx.Serialize()}
 	payload := GobEncode(data)
 	request := append(CmdToBytes("tx"), payload...)
 
-	SendData(addr, request)
+	p.Send(request)
 }
 
-func SendVersion(addr string, chain *blockchain.BlockChain) {
-	bestHeight := chain.GetBestHeight()
-	payload := GobEncode(Version{version, bestHeight, nodeAddress})
-
-	request := append(CmdToBytes("version"), payload...)
+// Hand tx to the node at addr, for CLI commands
+func SendTx(addr string, tnx *blockchain.Transaction) {
+	data := Tx{"", tnx.Serialize()}
+	payload := GobEncode(data)
+	request := append(CmdToBytes("tx"), payload...)
 
-	SendData(addr, request)
+	sendOnce(addr, request)
 }
 
-func HandleAddr(request []byte) {
+func (n *Node) HandleAddr(p *Peer, request []byte) error {
 	var buff bytes.Buffer
 	var payload Addr
 
@@ -188,16 +196,44 @@ func HandleAddr(request []byte) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return malformed("addr", err)
+	}
+
+	if len(payload.AddrList) > maxAddrs {
+		return misbehavior{scoreMalformed, fmt.Sprintf("addr with %d addresses", len(payload.AddrList))}
+	}
+
+	added := 0
+	for _, addr := range payload.AddrList {
+		if !validAddr(addr) || n.isLocalAddr(addr) {
+			continue
+		}
+		if n.book.Add(addr, 0) {
+			added++
+		}
+	}
+	fmt.Printf("%d new addresses, there are %d known nodes\n", added, n.book.Count())
 
+	return nil
+}
+
+func (n *Node) HandleGetAddr(p *Peer, request []byte) error {
+	var buff bytes.Buffer
+	var payload GetAddr
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return malformed("getaddr", err)
 	}
 
-	KnownNodes = append(KnownNodes, payload.AddrList...)
-	fmt.Printf("there are %d known nodes\n", len(KnownNodes))
-	RequestBlocks()
+	n.SendAddr(p)
+
+	return nil
 }
 
-func HandleBlock(request []byte, chain *blockchain.BlockChain) {
+func (n *Node) HandleBlock(p *Peer, request []byte) error {
 	var buff bytes.Buffer
 	var payload Block
 
@@ -205,29 +241,62 @@ func HandleBlock(request []byte, chain *blockchain.BlockChain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return malformed("block", err)
 	}
 
 	blockData := payload.Block
-	block := blockchain.Deserialize(blockData)
+	block, err := blockchain.DecodeBlock(blockData)
+	if err != nil {
+		return malformed("block", err)
+	}
 
 	fmt.Println("Recevied a new block!")
-	chain.AddBlock(block)
+	return n.processBlock(block, p)
+}
+
+// Block from peer p (nil if made by this node), whether sent whole or
+// rebuilt from a compact block
+func (n *Node) processBlock(block *blockchain.Block, p *Peer) error {
+	if err := n.chain.Params.CheckBlock(block); err != nil {
+		return misbehavior{scoreInvalidBlock, fmt.Sprintf("invalid block: %s", err)}
+	}
+
+	n.markKnownBy(p, block.Hash)
+
+	if handled, err := n.sync.blockReceived(p, block); handled {
+		return err
+	}
 
-	fmt.Printf("Added block %x\n", block.Hash)
+	// Not asked for by the sync, take it if it extends our tip and otherwise
+	// find out through headers what we are missing
+	if n.chain.HasBlock(block.Hash) {
+		return nil
+	}
 
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		SendGetData(payload.AddrFrom, "block", blockHash)
+	header := block.Header()
+	if !header.ValidatePoW() {
+		return misbehavior{scoreInvalidBlock, fmt.Sprintf("block %x has invalid proof of work", block.Hash)}
+	}
+
+	if !n.chain.HasBlock(block.PrevHash) {
+		n.addOrphanBlock(p, block)
+		return nil
+	}
 
-		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := blockchain.UTXOSet{chain}
-		UTXOSet.Reindex()
+	if !bytes.Equal(block.PrevHash, n.chain.LastHash()) {
+		n.sync.start(p)
+		return nil
 	}
+
+	if err := n.connectBlock(block, p); err != nil {
+		return err
+	}
+	n.connectOrphanBlocks()
+
+	return nil
 }
 
-func HandleInv(request []byte, chain *blockchain.BlockChain) {
+func (n *Node) HandleInv(p *Peer, request []byte) error {
 	var buff bytes.Buffer
 	var payload Inv
 
@@ -235,36 +304,39 @@ func HandleInv(request []byte, chain *blockchain.BlockChain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return malformed("inv", err)
 	}
 
-	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
+	if len(payload.Items) == 0 || len(payload.Items) > maxInvPerMsg {
+		return misbehavior{scoreMalformed, fmt.Sprintf("inv with %d items", len(payload.Items))}
+	}
 
-	if payload.Type == "block" {
-		blocksInTransit = payload.Items
+	n.markKnownBy(p, payload.Items...)
 
-		blockHash := payload.Items[0]
-		SendGetData(payload.AddrFrom, "block", blockHash)
+	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
 
-		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
+	// Blocks are fetched by the sync once it has their headers
+	if payload.Type == "block" {
+		for _, hash := range payload.Items {
+			if !n.chain.HasBlock(hash) {
+				n.sync.start(p)
+				break
 			}
 		}
-		blocksInTransit = newInTransit
 	}
 
 	if payload.Type == "tx" {
-		txID := payload.Items[0]
-
-		if memoryPool[hex.EncodeToString(txID)].ID == nil {
-			SendGetData(payload.AddrFrom, "tx", txID)
+		for _, txID := range payload.Items {
+			if !n.pool.Has(txID) && !n.txOrphans.has(txID) {
+				n.SendGetData(p, "tx", txID)
+			}
 		}
 	}
+
+	return nil
 }
 
-func HandleGetBlocks(request []byte, chain *blockchain.BlockChain) {
+func (n *Node) HandleGetBlocks(p *Peer, request []byte) error {
 	var buff bytes.Buffer
 	var payload GetBlocks
 
@@ -272,14 +344,22 @@ func HandleGetBlocks(request []byte, chain *blockchain.BlockChain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return malformed("getblocks", err)
+	}
+
+	if err := checkLocator("getblocks", payload.Locator); err != nil {
+		return err
+	}
+
+	blocks := n.chain.HashesAfter(payload.Locator, payload.StopHash, maxBlocksPerInv)
+	if len(blocks) > 0 {
+		n.SendInv(p, "block", blocks)
 	}
 
-	blocks := chain.GetBlockHashes()
-	SendInv(payload.AddrFrom, "block", blocks)
+	return nil
 }
 
-func HandleGetData(request []byte, chain *blockchain.BlockChain) {
+func (n *Node) HandleGetData(p *Peer, request []byte) error {
 	var buff bytes.Buffer
 	var payload GetData
 
@@ -287,27 +367,33 @@ func HandleGetData(request []byte, chain *blockchain.BlockChain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return malformed("getdata", err)
 	}
 
 	if payload.Type == "block" {
-		block, err := chain.GetBlock([]byte(payload.ID))
+		block, err := n.chain.GetBlock([]byte(payload.ID))
 		if err != nil {
-			return
+			return nil
 		}
 
-		SendBlock(payload.AddrFrom, &block)
+		n.markKnownBy(p, block.Hash)
+		n.SendBlock(p, &block)
 	}
 
 	if payload.Type == "tx" {
-		txID := hex.EncodeToString(payload.ID)
-		tx := memoryPool[txID]
+		tx, ok := n.pool.Get(payload.ID)
+		if !ok {
+			return nil
+		}
 
-		SendTx(payload.AddrFrom, &tx)
+		n.markKnownBy(p, tx.ID)
+		n.SendTx(p, &tx)
 	}
+
+	return nil
 }
 
-func HandleTx(request []byte, chain *blockchain.BlockChain) {
+func (n *Node) HandleTx(p *Peer, request []byte) error {
 	var buff bytes.Buffer
 	var payload Tx
 
@@ -315,148 +401,149 @@ func HandleTx(request []byte, chain *blockchain.BlockChain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return malformed("tx", err)
 	}
 
 	txData := payload.Transaction
-	tx := blockchain.DeserializeTx(txData)
-	memoryPool[hex.EncodeToString(tx.ID)] = tx
+	tx, err := blockchain.DecodeTx(txData)
+	if err != nil {
+		return malformed("tx", err)
+	}
 
-	fmt.Printf("%s, %d", nodeAddress, len(memoryPool))
+	n.markKnownBy(p, tx.ID)
 
-	if nodeAddress == KnownNodes[0] {
-		for _, node := range KnownNodes {
-			if node != nodeAddress && node != payload.AddrFrom {
-				SendInv(node, "tx", [][]byte{tx.ID})
-			}
-		}
-	} else {
-		if len(memoryPool) >= 2 && len(mineAddress) > 0 {
-			MineTx(chain)
-		}
+	err = n.pool.Add(*tx)
+	if missing, ok := err.(mempool.MissingParentsError); ok {
+		n.addOrphanTx(tx, missing.Parents, p)
+		return nil
 	}
-}
 
-func MineTx(chain *blockchain.BlockChain) {
-	var txs []*blockchain.Transaction
-
-	for id := range memoryPool {
-		fmt.Printf("tx: %x\n", memoryPool[id].ID)
-		tx := memoryPool[id]
-		if chain.VerifyTransaction(&tx) {
-			txs = append(txs, &tx)
+	if err != nil {
+		if _, ok := err.(mempool.InvalidTxError); ok {
+			return misbehavior{scoreInvalidTx, fmt.Sprintf("invalid tx %x: %s", tx.ID, err)}
 		}
+		fmt.Printf("Rejected tx %x: %s\n", tx.ID, err)
+		return nil
 	}
 
-	if len(txs) == 0 {
-		fmt.Println("All Transactions are invalid")
-		return
-	}
+	n.txAccepted(tx, p)
+	n.acceptOrphanTxs([][]byte{tx.ID})
 
-	cbTx := blockchain.CoinbaseTx(mineAddress, "")
-	txs = append(txs, cbTx)
+	return nil
+}
 
-	newBlock := chain.MineBlock(txs)
-	UTXOSet  := blockchain.UTXOSet{chain}
-	UTXOSet.Reindex()
+// Tx from peer p (nil if made by this node) entered the pool, pass it on
+func (n *Node) txAccepted(tx *blockchain.Transaction, p *Peer) {
+	fmt.Printf("Accepted tx %x, %d txs in the pool\n", tx.ID, n.pool.Count())
 
-	fmt.Println("New Block mined")
+	n.markKnownBy(p, tx.ID)
+	n.relayTx(tx)
+	n.publishTx(tx)
+}
 
-	for _, tx := range txs {
-		txID := hex.EncodeToString(tx.ID)
-		delete(memoryPool, txID)
+// Tx made on this node, pooled and relayed like one from a peer
+func (n *Node) SubmitTx(tx *blockchain.Transaction) error {
+	if err := n.pool.Add(*tx); err != nil {
+		return err
 	}
 
-	for _, node := range KnownNodes {
-		if node != nodeAddress {
-			SendInv(node, "block", [][]byte{newBlock.Hash})
-		}
+	n.txAccepted(tx, nil)
+	return nil
+}
+
+// Block made outside the node, e.g. by an external miner, checked and
+// connected like one from a peer
+func (n *Node) SubmitBlock(block *blockchain.Block) error {
+	if n.chain.HasBlock(block.Hash) {
+		return errors.New("block is already known")
+	}
+	if !bytes.Equal(block.PrevHash, n.chain.LastHash()) {
+		return errors.New("block does not extend the tip")
 	}
 
-	if len(memoryPool) > 0 {
-		MineTx(chain)
+	if err := n.processBlock(block, nil); err != nil {
+		return err
 	}
+	if !n.chain.HasBlock(block.Hash) {
+		return errors.New("block was not accepted")
+	}
+
+	return nil
 }
 
-func HandleVersion(request []byte, chain *blockchain.BlockChain) {
-	var buff bytes.Buffer
-	var payload Version
+// New block from the miner, update local state and announce it
+func (n *Node) BlockMined(newBlock *blockchain.Block) {
+	UTXOSet := blockchain.UTXOSet{Blockchain: n.chain}
+	UTXOSet.Reindex()
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
-	}
+	fmt.Printf("New Block mined %x\n", newBlock.Hash)
 
-	bestHeight := chain.GetBestHeight()
-	otherHeight := payload.BestHeight
+	n.pool.RemoveForBlock(newBlock)
 
-	if bestHeight < otherHeight {
-		SendGetBlocks(payload.AddrFrom)
-	} else if bestHeight > otherHeight {
-		SendVersion(payload.AddrFrom, chain)
+	n.announceBlock(newBlock, nil)
+	n.tipChanged()
+}
+
+// Mine a block on top of the current tip without waiting for txs or the
+// mining interval and relay it, for nodes mined on demand like in tests
+func (n *Node) MineBlock() (*blockchain.Block, error) {
+	if n.miner == nil {
+		return nil, errors.New("node is not mining")
 	}
 
-	if !NodeIsKnown(payload.AddrFrom) {
-		KnownNodes = append(KnownNodes, payload.AddrFrom)
+	block := n.miner.MineNow(context.Background())
+	if block == nil {
+		return nil, errors.New("mining gave up, the tip changed or a tx was invalid")
 	}
-}
+	n.BlockMined(block)
 
-func HandleConnection(conn net.Conn, chain *blockchain.BlockChain) {
-	req, err := ioutil.ReadAll(conn)
-	defer conn.Close()
+	return block, nil
+}
 
-	if err != nil {
-		log.Panic(err)
+// Largest payload a peer may send, a block plus room for the encoding around it
+func maxMessageSize(chain *blockchain.BlockChain) int64 {
+	params := blockchain.DefaultParams
+	if chain != nil {
+		params = chain.Params
 	}
+
+	return int64(params.MaxBlockSize) + messageOverhead
+}
+
+// Dispatch a request read from peer p, see Peer.readLoop()
+// Replies go back over the connection it came in on, whatever AddrFrom says
+// A misbehavior error is returned for messages breaking the rules
+func (n *Node) HandleMessage(p *Peer, req []byte) error {
 	command := BytesToCmd(req[:commandLength])
 	fmt.Printf("Received %s command\n", command)
 
 	switch command {
 	case "addr":
-		HandleAddr(req)
+		return n.HandleAddr(p, req)
+	case "getaddr":
+		return n.HandleGetAddr(p, req)
 	case "block":
-		HandleBlock(req, chain)
+		return n.HandleBlock(p, req)
 	case "inv":
-		HandleInv(req, chain)
+		return n.HandleInv(p, req)
 	case "getblocks":
-		HandleGetBlocks(req, chain)
+		return n.HandleGetBlocks(p, req)
+	case "getheaders":
+		return n.HandleGetHeaders(p, req)
+	case "headers":
+		return n.HandleHeaders(p, req)
 	case "getdata":
-		HandleGetData(req, chain)
+		return n.HandleGetData(p, req)
 	case "tx":
-		HandleTx(req, chain)
-	case "version":
-		HandleVersion(req, chain)
+		return n.HandleTx(p, req)
+	case "cmpctblock":
+		return n.HandleCompactBlock(p, req)
+	case "getblocktxn":
+		return n.HandleGetBlockTxn(p, req)
+	case "blocktxn":
+		return n.HandleBlockTxn(p, req)
 	default:
-		fmt.Println("Unknown command")
-	}
-
-}
-
-func StartServer(nodeID, minerAddress string) {
-	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
-	mineAddress = minerAddress
-	ln, err := net.Listen(protocol, nodeAddress)
-	if err != nil {
-		log.Panic(err)
-	}
-	defer ln.Close()
-
-	chain := blockchain.ContinueBlockChain(nodeID)
-	defer chain.Database.Close()
-	go CloseDB(chain)
-
-	if nodeAddress != KnownNodes[0] {
-		SendVersion(KnownNodes[0], chain)
-	}
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Panic(err)
-		}
-		go HandleConnection(conn, chain)
-
+		return misbehavior{1, fmt.Sprintf("unknown command %q", command)}
 	}
 }
 
@@ -471,23 +558,3 @@ func GobEncode(data interface{}) []byte {
 
 	return buff.Bytes()
 }
-
-func NodeIsKnown(addr string) bool {
-	for _, node := range KnownNodes {
-		if node == addr {
-			return true
-		}
-	}
-
-	return false
-}
-
-func CloseDB(chain *blockchain.BlockChain) {
-	d := death.NewDeath(syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
-
-	d.WaitForDeathWithFunc(func() {
-		defer os.Exit(1)
-		defer runtime.Goexit()
-		chain.Database.Close()
-	})
-}
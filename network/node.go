@@ -0,0 +1,420 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/LidoKing/learnBlockchain/blockchain"
+	"github.com/LidoKing/learnBlockchain/blockchain/wallet"
+	"github.com/LidoKing/learnBlockchain/events"
+	"github.com/LidoKing/learnBlockchain/mempool"
+	"github.com/LidoKing/learnBlockchain/mining"
+)
+
+// Everything a node needs besides its chain and wallets
+type Config struct {
+	// Selects the files of the node in the data dir (address book, node key)
+	NodeID    string
+	Net       NetConfig
+	Transport TransportConfig
+	// Nil for TCP
+	Network Network
+	Mempool mempool.Config
+	Mining  mining.Config
+	// Mining is on when set, rewards go to this address
+	MinerAddress string
+}
+
+const (
+	mempoolFile      = "./tmp/mempool_%s.data"
+	acceptRetryDelay = time.Second
+	// The mempool is also saved now and then in case the node dies
+	mempoolSaveInterval = 5 * time.Minute
+	// Unmined wallet txs are announced again, first once peers had time
+	// to connect after a start
+	rebroadcastDelay    = time.Minute
+	rebroadcastInterval = 30 * time.Minute
+)
+
+var DefaultConfig = Config{
+	Net:     DefaultNetConfig,
+	Mempool: mempool.DefaultConfig,
+	Mining:  mining.DefaultConfig,
+}
+
+// Full node: keeps connections to its peers, syncs and relays blocks and txs
+// and mines if asked to. Several can run in one process, each with a chain
+// of its own.
+type Node struct {
+	cfg     Config
+	chain   *blockchain.BlockChain
+	wallets *wallet.Wallets
+	pool    *mempool.Pool
+	miner   *mining.Miner
+	book    *AddrBook
+	key     *noiseKeyPair
+
+	// Address other nodes are told and the one local clients dial
+	address       string
+	listenAddress string
+	services      uint64
+	// Identifies this node, a version carrying it means we dialed ourselves
+	nonce uint64
+
+	peersMu sync.Mutex
+	// Peers by listening address
+	peers map[string]*Peer
+	// Every open connection, also those of peers that did not tell their address
+	conns map[*Peer]bool
+	// Set once shutdown has begun, no peers are started after it
+	closing bool
+	// Read and write loops of all peers
+	peerWg sync.WaitGroup
+
+	scoresMu sync.Mutex
+	// Misbehavior so far by host, see Peer.banKey()
+	banScores map[string]int
+
+	sync         *syncManager
+	blockOrphans *orphanPool
+	txOrphans    *orphanPool
+
+	partialsMu sync.Mutex
+	partials   map[string]*partialBlock
+
+	events *events.Bus
+	tipMu  sync.Mutex
+	// Tip the last events were published for
+	notifiedTip []byte
+
+	ln       net.Listener
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// Node on chain, wallets may be nil for a node that has none
+func NewNode(cfg Config, chain *blockchain.BlockChain, wallets *wallet.Wallets) (*Node, error) {
+	if err := cfg.Net.Validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.MinerAddress != "" && !wallet.ValidateAddress(cfg.MinerAddress) {
+		return nil, fmt.Errorf("miner address %s is not valid", cfg.MinerAddress)
+	}
+
+	key, err := loadOrCreateNodeKey(cfg.NodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		cfg:          cfg,
+		chain:        chain,
+		wallets:      wallets,
+		pool:         mempool.New(chain, cfg.Mempool),
+		book:         LoadAddrBook(cfg.NodeID),
+		key:          key,
+		services:     ServiceFullNode,
+		nonce:        randomNonce(),
+		peers:        make(map[string]*Peer),
+		conns:        make(map[*Peer]bool),
+		banScores:    make(map[string]int),
+		blockOrphans: newOrphanPool(maxOrphanBlocks),
+		txOrphans:    newOrphanPool(maxOrphanTxs),
+		partials:     make(map[string]*partialBlock),
+		events:       events.NewBus(),
+		notifiedTip:  chain.LastHash(),
+		done:         make(chan struct{}),
+	}
+	if n.cfg.Network == nil {
+		n.cfg.Network = tcpNetwork{}
+	}
+	n.sync = newSyncManager(n)
+
+	if cfg.MinerAddress != "" {
+		n.miner = mining.NewMiner(chain, n.pool, cfg.MinerAddress, cfg.Mining)
+		n.services |= ServiceMiner
+
+		if wallets != nil && len(wallets.Wallets) > 0 {
+			if _, err := wallets.GetWallet(cfg.MinerAddress); err != nil {
+				fmt.Printf("Mining rewards go to %s, which is not a wallet of this node\n", cfg.MinerAddress)
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// Listen and connect to peers, everything runs until ctx is done or Stop()
+// is called
+func (n *Node) Start(ctx context.Context) error {
+	ln, err := n.cfg.Network.Listen(n.cfg.Net.Listen)
+	if err != nil {
+		return err
+	}
+	n.ln = ln
+
+	// Port 0 picks a free one, which only the listener knows
+	host, _, _ := net.SplitHostPort(n.cfg.Net.Listen)
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	n.cfg.Net.Listen = net.JoinHostPort(host, port)
+	n.address = n.cfg.Net.Advertised()
+	n.listenAddress = n.cfg.Net.LocalAddr()
+
+	fmt.Printf("Listening on %s as %s\n", ln.Addr(), n.address)
+	fmt.Printf("Node key: %s\n", n.PubKey())
+	if n.cfg.Transport.encrypted() {
+		fmt.Printf("Encrypting connections, %d nodes on the allow-list\n", len(n.cfg.Transport.AllowList))
+	}
+
+	n.loadMempool()
+
+	if len(n.cfg.Net.Connect) == 0 {
+		for _, node := range n.cfg.Net.Seeds {
+			if !n.isLocalAddr(node) {
+				n.book.Add(node, ServiceFullNode)
+			}
+		}
+	}
+
+	ctx, n.cancel = context.WithCancel(ctx)
+
+	n.spawn(func() { n.acceptLoop(ctx) })
+	n.spawn(func() { n.managePeers(ctx) })
+	n.spawn(func() { n.sync.run(ctx) })
+	n.spawn(func() { n.expireLoop(ctx) })
+	n.spawn(func() { n.rebroadcastLoop(ctx) })
+	if n.miner != nil {
+		n.spawn(func() { n.miner.Run(ctx, n.BlockMined) })
+	}
+
+	go func() {
+		<-ctx.Done()
+		n.shutdown()
+	}()
+
+	return nil
+}
+
+func (n *Node) spawn(f func()) {
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		f()
+	}()
+}
+
+// Disconnect all peers and wait for everything started by Start() to end,
+// the chain is left open for the caller to close
+func (n *Node) Stop() {
+	if n.cancel == nil {
+		return
+	}
+
+	n.cancel()
+	<-n.done
+}
+
+// Closed once the node has stopped
+func (n *Node) Done() <-chan struct{} {
+	return n.done
+}
+
+// Stop accepting and dialing, let the loops and the miner end, send what is
+// queued for each peer and wait for the messages being handled, then save
+// the address book and the mempool
+func (n *Node) shutdown() {
+	n.stopOnce.Do(func() {
+		fmt.Printf("Stopping node %s\n", n.address)
+
+		n.ln.Close()
+		n.peersMu.Lock()
+		n.closing = true
+		n.peersMu.Unlock()
+
+		// Everything started by Start(), they all end with its context
+		n.wg.Wait()
+
+		for _, p := range n.allConns() {
+			p.drain()
+		}
+		n.peerWg.Wait()
+
+		n.book.SaveFile()
+		n.saveMempool()
+
+		fmt.Printf("Node %s stopped\n", n.address)
+		close(n.done)
+	})
+}
+
+func (n *Node) acceptLoop(ctx context.Context) {
+	for {
+		conn, err := n.ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				// Closed by shutdown()
+				return
+			}
+
+			// Likely out of file descriptors, which may pass
+			fmt.Printf("Accept failed: %s\n", err)
+			select {
+			case <-time.After(acceptRetryDelay):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		go n.acceptPeer(conn)
+	}
+}
+
+/*-------------------------------mempool-------------------------------*/
+
+// Pool txs are kept across restarts, nodes without an ID have no data dir
+func (n *Node) saveMempool() {
+	if n.cfg.NodeID == "" {
+		return
+	}
+
+	if err := n.pool.SaveFile(fmt.Sprintf(mempoolFile, n.cfg.NodeID)); err != nil {
+		fmt.Printf("Could not save the mempool: %s\n", err)
+		return
+	}
+	fmt.Printf("Saved %d mempool txs\n", n.pool.Count())
+}
+
+// Txs saved by the last run that are still valid on the current chain
+func (n *Node) loadMempool() {
+	if n.cfg.NodeID == "" {
+		return
+	}
+
+	added, dropped, err := n.pool.LoadFile(fmt.Sprintf(mempoolFile, n.cfg.NodeID))
+	if err != nil {
+		fmt.Printf("Could not load the mempool: %s\n", err)
+		return
+	}
+	if added+dropped > 0 {
+		fmt.Printf("Loaded %d mempool txs, dropped %d no longer valid\n", added, dropped)
+	}
+}
+
+// Periodically drop pool txs that have not been mined for too long and
+// orphans whose parents never came, and save the pool
+func (n *Node) expireLoop(ctx context.Context) {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+	saveTicker := time.NewTicker(mempoolSaveInterval)
+	defer saveTicker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if removed := n.pool.Expire(); removed > 0 {
+				fmt.Printf("Expired %d txs from the mempool\n", removed)
+			}
+			n.expireOrphans()
+		case <-saveTicker.C:
+			n.saveMempool()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Pool txs spending outputs of our wallets
+func (n *Node) walletTxs() []*blockchain.Transaction {
+	if n.wallets == nil {
+		return nil
+	}
+
+	keys := make(map[string]bool)
+	for _, w := range n.wallets.Wallets {
+		keys[string(w.PublicKey)] = true
+	}
+
+	var txs []*blockchain.Transaction
+	for _, tx := range n.pool.TxMap() {
+		for _, in := range tx.Inputs {
+			if keys[string(in.PubKey)] {
+				tx := tx
+				txs = append(txs, &tx)
+				break
+			}
+		}
+	}
+
+	return txs
+}
+
+// Announce unmined wallet txs again, to peers that never got them or lost
+// them, e.g. by restarting
+func (n *Node) rebroadcastLoop(ctx context.Context) {
+	timer := time.NewTimer(rebroadcastDelay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			txs := n.walletTxs()
+			if len(txs) > 0 {
+				fmt.Printf("Rebroadcasting %d wallet txs\n", len(txs))
+			}
+			for _, tx := range txs {
+				n.rebroadcastTx(tx)
+			}
+			timer.Reset(rebroadcastInterval)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+/*-------------------------------accessors-------------------------------*/
+
+// Selects the files of the node in the data dir, empty for nodes without any
+func (n *Node) ID() string {
+	return n.cfg.NodeID
+}
+
+// Advertised address, known once the node has started
+func (n *Node) Address() string {
+	return n.address
+}
+
+func (n *Node) Chain() *blockchain.BlockChain {
+	return n.chain
+}
+
+func (n *Node) Pool() *mempool.Pool {
+	return n.pool
+}
+
+func (n *Node) Wallets() *wallet.Wallets {
+	return n.wallets
+}
+
+// Changes of the chain and mempool, see notify.go
+func (n *Node) Events() *events.Bus {
+	return n.events
+}
+
+// Hex static key other nodes know this one by
+func (n *Node) PubKey() string {
+	return fmt.Sprintf("%x", n.key.Public)
+}
+
+func (n *Node) isLocalAddr(addr string) bool {
+	return addr == n.address || addr == n.listenAddress
+}
@@ -0,0 +1,374 @@
+package network
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Noise_XX_25519_ChaChaPoly_SHA256 handshake, see noiseprotocol.org:
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+//
+// Both ends learn the other's static key, which identifies the node, and end
+// up with one key per direction. Afterwards every record on the wire is a
+// 2-byte length followed by that many bytes of ChaCha20-Poly1305 ciphertext.
+const (
+	noiseProtocolName = "Noise_XX_25519_ChaChaPoly_SHA256"
+	noisePrologue     = "learnBlockchain"
+	noiseKeyLen       = 32
+	noiseTagLen       = 16
+	noiseMaxRecord    = 65535
+)
+
+// Sent by the initiator before the handshake, so a node can tell encrypted
+// connections from plaintext ones (which start with the message magic)
+var noiseMagic = []byte{0x4e, 0x6f, 0x69, 0x7a}
+
+type noiseKeyPair struct {
+	Private [noiseKeyLen]byte
+	Public  [noiseKeyLen]byte
+}
+
+func newNoiseKeyPair() (*noiseKeyPair, error) {
+	private := make([]byte, noiseKeyLen)
+	if _, err := io.ReadFull(rand.Reader, private); err != nil {
+		return nil, err
+	}
+
+	return noiseKeyPairFrom(private), nil
+}
+
+func noiseKeyPairFrom(private []byte) *noiseKeyPair {
+	kp := &noiseKeyPair{}
+	copy(kp.Private[:], private)
+	curve25519.ScalarBaseMult(&kp.Public, &kp.Private)
+
+	return kp
+}
+
+func noiseDH(kp *noiseKeyPair, public []byte) []byte {
+	var pub, shared [noiseKeyLen]byte
+	copy(pub[:], public)
+	curve25519.ScalarMult(&shared, &kp.Private, &pub)
+
+	return shared[:]
+}
+
+/*-------------------------------cipher state-------------------------------*/
+
+type noiseCipher struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+func newNoiseCipher(key []byte) *noiseCipher {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		// Only happens for a key of the wrong size
+		panic(err)
+	}
+
+	return &noiseCipher{aead: aead}
+}
+
+func (c *noiseCipher) nextNonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], c.nonce)
+	c.nonce++
+
+	return nonce
+}
+
+func (c *noiseCipher) encrypt(ad, plaintext []byte) []byte {
+	return c.aead.Seal(nil, c.nextNonce(), plaintext, ad)
+}
+
+func (c *noiseCipher) decrypt(ad, ciphertext []byte) ([]byte, error) {
+	return c.aead.Open(nil, c.nextNonce(), ciphertext, ad)
+}
+
+/*-------------------------------symmetric state-------------------------------*/
+
+type noiseState struct {
+	h  []byte
+	ck []byte
+	c  *noiseCipher
+}
+
+func newNoiseState() *noiseState {
+	// The name is exactly as long as a hash, so it is used as is
+	h := []byte(noiseProtocolName)
+	s := &noiseState{h: h, ck: append([]byte{}, h...)}
+	s.mixHash([]byte(noisePrologue))
+
+	return s
+}
+
+func hmacSHA256(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+
+	return mac.Sum(nil)
+}
+
+func noiseHKDF(ck, ikm []byte) ([]byte, []byte) {
+	temp := hmacSHA256(ck, ikm)
+	out1 := hmacSHA256(temp, []byte{1})
+	out2 := hmacSHA256(temp, out1, []byte{2})
+
+	return out1, out2
+}
+
+func (s *noiseState) mixHash(data []byte) {
+	sum := sha256.Sum256(append(append([]byte{}, s.h...), data...))
+	s.h = sum[:]
+}
+
+func (s *noiseState) mixKey(ikm []byte) {
+	var key []byte
+	s.ck, key = noiseHKDF(s.ck, ikm)
+	s.c = newNoiseCipher(key)
+}
+
+func (s *noiseState) encryptAndHash(plaintext []byte) []byte {
+	out := plaintext
+	if s.c != nil {
+		out = s.c.encrypt(s.h, plaintext)
+	}
+	s.mixHash(out)
+
+	return out
+}
+
+func (s *noiseState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	out := ciphertext
+	if s.c != nil {
+		var err error
+		if out, err = s.c.decrypt(s.h, ciphertext); err != nil {
+			return nil, err
+		}
+	}
+	s.mixHash(ciphertext)
+
+	return out, nil
+}
+
+// Keys for initiator to responder and responder to initiator
+func (s *noiseState) split() (*noiseCipher, *noiseCipher) {
+	k1, k2 := noiseHKDF(s.ck, nil)
+	return newNoiseCipher(k1), newNoiseCipher(k2)
+}
+
+/*-------------------------------handshake-------------------------------*/
+
+func writeNoiseMessage(w io.Writer, msg []byte) error {
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(msg)))
+
+	_, err := w.Write(append(length[:], msg...))
+	return err
+}
+
+func readNoiseMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err := io.ReadFull(r, msg)
+
+	return msg, err
+}
+
+// Run the handshake as the dialing side, returns the encrypted connection and
+// the static key of the remote node
+func noiseInitiate(conn net.Conn, static *noiseKeyPair) (*noiseConn, []byte, error) {
+	s := newNoiseState()
+	e, err := newNoiseKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// -> e
+	s.mixHash(e.Public[:])
+	msg := append(append([]byte{}, e.Public[:]...), s.encryptAndHash(nil)...)
+	if _, err := conn.Write(noiseMagic); err != nil {
+		return nil, nil, err
+	}
+	if err := writeNoiseMessage(conn, msg); err != nil {
+		return nil, nil, err
+	}
+
+	// <- e, ee, s, es
+	msg, err = readNoiseMessage(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(msg) != noiseKeyLen+noiseKeyLen+noiseTagLen+noiseTagLen {
+		return nil, nil, fmt.Errorf("noise message 2 has %d bytes", len(msg))
+	}
+
+	re := msg[:noiseKeyLen]
+	s.mixHash(re)
+	s.mixKey(noiseDH(e, re))
+
+	rs, err := s.decryptAndHash(msg[noiseKeyLen : 2*noiseKeyLen+noiseTagLen])
+	if err != nil {
+		return nil, nil, errors.New("noise handshake failed")
+	}
+	s.mixKey(noiseDH(e, rs))
+
+	if _, err := s.decryptAndHash(msg[2*noiseKeyLen+noiseTagLen:]); err != nil {
+		return nil, nil, errors.New("noise handshake failed")
+	}
+
+	// -> s, se
+	msg = s.encryptAndHash(static.Public[:])
+	s.mixKey(noiseDH(static, re))
+	msg = append(msg, s.encryptAndHash(nil)...)
+	if err := writeNoiseMessage(conn, msg); err != nil {
+		return nil, nil, err
+	}
+
+	send, recv := s.split()
+	return newNoiseConn(conn, send, recv), rs, nil
+}
+
+// Run the handshake as the accepting side, after noiseMagic has been read
+func noiseRespond(conn net.Conn, r io.Reader, static *noiseKeyPair) (*noiseConn, []byte, error) {
+	s := newNoiseState()
+
+	// -> e
+	msg, err := readNoiseMessage(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(msg) != noiseKeyLen {
+		return nil, nil, fmt.Errorf("noise message 1 has %d bytes", len(msg))
+	}
+
+	re := msg
+	s.mixHash(re)
+	s.decryptAndHash(nil)
+
+	// <- e, ee, s, es
+	e, err := newNoiseKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.mixHash(e.Public[:])
+	msg = append([]byte{}, e.Public[:]...)
+	s.mixKey(noiseDH(e, re))
+	msg = append(msg, s.encryptAndHash(static.Public[:])...)
+	s.mixKey(noiseDH(static, re))
+	msg = append(msg, s.encryptAndHash(nil)...)
+	if err := writeNoiseMessage(conn, msg); err != nil {
+		return nil, nil, err
+	}
+
+	// -> s, se
+	msg, err = readNoiseMessage(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(msg) != noiseKeyLen+noiseTagLen+noiseTagLen {
+		return nil, nil, fmt.Errorf("noise message 3 has %d bytes", len(msg))
+	}
+
+	rs, err := s.decryptAndHash(msg[:noiseKeyLen+noiseTagLen])
+	if err != nil {
+		return nil, nil, errors.New("noise handshake failed")
+	}
+	s.mixKey(noiseDH(e, rs))
+
+	if _, err := s.decryptAndHash(msg[noiseKeyLen+noiseTagLen:]); err != nil {
+		return nil, nil, errors.New("noise handshake failed")
+	}
+
+	recv, send := s.split()
+	return newNoiseConn(readerConn{conn, r}, send, recv), rs, nil
+}
+
+/*-------------------------------transport-------------------------------*/
+
+// Connection whose reads and writes go through the handshake's ciphers
+type noiseConn struct {
+	net.Conn
+	send    *noiseCipher
+	recv    *noiseCipher
+	pending []byte
+}
+
+func newNoiseConn(conn net.Conn, send, recv *noiseCipher) *noiseConn {
+	return &noiseConn{Conn: conn, send: send, recv: recv}
+}
+
+func (c *noiseConn) Write(b []byte) (int, error) {
+	written := 0
+
+	for len(b) > 0 {
+		n := len(b)
+		if n > noiseMaxRecord-noiseTagLen {
+			n = noiseMaxRecord - noiseTagLen
+		}
+
+		if err := writeNoiseMessage(c.Conn, c.send.encrypt(nil, b[:n])); err != nil {
+			return written, err
+		}
+
+		written += n
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+func (c *noiseConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		record, err := readNoiseMessage(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+
+		c.pending, err = c.recv.decrypt(nil, record)
+		if err != nil {
+			return 0, errors.New("noise record failed to decrypt")
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+// Connection reading through r, which may hold bytes already taken off conn
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readerConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func isNoiseMagic(b []byte) bool {
+	return bytes.Equal(b, noiseMagic)
+}
@@ -0,0 +1,186 @@
+package network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+type handshakeResult struct {
+	conn   net.Conn
+	remote []byte
+	err    error
+}
+
+func newTestKey(t *testing.T) *noiseKeyPair {
+	t.Helper()
+
+	kp, err := newNoiseKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kp
+}
+
+func TestNoiseRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	initiator, responder := newTestKey(t), newTestKey(t)
+
+	results := make(chan handshakeResult)
+	go func() {
+		magic := make([]byte, len(noiseMagic))
+		if _, err := io.ReadFull(b, magic); err != nil || !isNoiseMagic(magic) {
+			results <- handshakeResult{err: err}
+			return
+		}
+
+		conn, remote, err := noiseRespond(b, b, responder)
+		results <- handshakeResult{conn, remote, err}
+	}()
+
+	conn, remote, err := noiseInitiate(a, initiator)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-results
+	if r.err != nil || r.conn == nil {
+		t.Fatalf("responder failed: %v", r.err)
+	}
+
+	if !bytes.Equal(remote, responder.Public[:]) || !bytes.Equal(r.remote, initiator.Public[:]) {
+		t.Fatal("static keys not exchanged")
+	}
+
+	// Spans several records
+	big := bytes.Repeat([]byte("learnBlockchain"), 20000)
+	go conn.Write(big)
+
+	got := make([]byte, len(big))
+	if _, err := io.ReadFull(r.conn, got); err != nil || !bytes.Equal(got, big) {
+		t.Fatalf("payload did not arrive intact: %v", err)
+	}
+
+	go r.conn.Write([]byte("reply"))
+
+	got = make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "reply" {
+		t.Fatalf("reply did not arrive intact: %v", err)
+	}
+}
+
+func TestNoiseTamperedRecord(t *testing.T) {
+	send := newNoiseCipher(bytes.Repeat([]byte{1}, noiseKeyLen))
+	recv := newNoiseCipher(bytes.Repeat([]byte{1}, noiseKeyLen))
+
+	record := send.encrypt(nil, []byte("block"))
+	record[0] ^= 1
+
+	if _, err := recv.decrypt(nil, record); err == nil {
+		t.Fatal("tampered record decrypted")
+	}
+}
+
+func TestSecureAccept(t *testing.T) {
+	client := newTestKey(t)
+	listed := hex.EncodeToString(client.Public[:])
+	other := hex.EncodeToString(newTestKey(t).Public[:])
+
+	tests := []struct {
+		name      string
+		transport TransportConfig
+		// Client runs the handshake, otherwise it talks plaintext
+		encrypted bool
+		accepted  bool
+	}{
+		{"plaintext", TransportConfig{}, false, true},
+		{"encrypted to plaintext node", TransportConfig{}, true, true},
+		{"plaintext to encrypting node", TransportConfig{Encrypt: true}, false, false},
+		{"encrypted", TransportConfig{Encrypt: true}, true, true},
+		{"allow-listed", TransportConfig{AllowList: []string{other, listed}}, true, true},
+		{"allow-listed upper case", TransportConfig{AllowList: []string{strings.ToUpper(listed)}}, true, true},
+		{"not allow-listed", TransportConfig{AllowList: []string{other}}, true, false},
+		{"plaintext to allow-listing node", TransportConfig{AllowList: []string{listed}}, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := &Node{cfg: Config{Transport: test.transport}, key: newTestKey(t)}
+
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+
+			go func() {
+				if test.encrypted {
+					noiseInitiate(a, client)
+				} else {
+					a.Write(append(CmdToBytes("version"), []byte("payload")...))
+				}
+			}()
+
+			conn, remote, err := n.secureAccept(b)
+			if test.accepted != (err == nil) {
+				t.Fatalf("accepted %t, want %t (%v)", err == nil, test.accepted, err)
+			}
+			if !test.accepted {
+				return
+			}
+
+			if test.encrypted && !bytes.Equal(remote, client.Public[:]) {
+				t.Fatal("remote key not reported")
+			}
+
+			if !test.encrypted {
+				// Bytes peeked at are not lost
+				cmd := make([]byte, commandLength)
+				if _, err := io.ReadFull(conn, cmd); err != nil || BytesToCmd(cmd) != "version" {
+					t.Fatalf("plaintext message lost: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestSecureDialAllowList(t *testing.T) {
+	server := newTestKey(t)
+
+	tests := []struct {
+		name      string
+		allowList []string
+		accepted  bool
+	}{
+		{"server listed", []string{hex.EncodeToString(server.Public[:])}, true},
+		{"server not listed", []string{hex.EncodeToString(newTestKey(t).Public[:])}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := &Node{cfg: Config{Transport: TransportConfig{AllowList: test.allowList}}, key: newTestKey(t)}
+
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+
+			go func() {
+				magic := make([]byte, len(noiseMagic))
+				io.ReadFull(b, magic)
+				noiseRespond(b, b, server)
+			}()
+
+			_, remote, err := n.secureDial(a)
+			if test.accepted != (err == nil) {
+				t.Fatalf("accepted %t, want %t (%v)", err == nil, test.accepted, err)
+			}
+			if test.accepted && !bytes.Equal(remote, server.Public[:]) {
+				t.Fatal("remote key not reported")
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/LidoKing/learnBlockchain/blockchain"
+	"github.com/LidoKing/learnBlockchain/blockchain/wallet"
+	"github.com/LidoKing/learnBlockchain/events"
+)
+
+// Events published on Node.Events(), after the state they report has been
+// updated, so a subscriber looking at the chain or UTXO set sees it
+
+// Tx entered the pool, its outputs are unconfirmed payments
+func (n *Node) publishTx(tx *blockchain.Transaction) {
+	n.events.Publish(events.Event{Topic: events.TxAccepted, Tx: tx})
+	n.publishPayments(tx, nil)
+}
+
+func (n *Node) publishPayments(tx *blockchain.Transaction, block *blockchain.Block) {
+	for i, out := range tx.Outputs {
+		n.events.Publish(events.Event{
+			Topic: events.Payment,
+			Block: block,
+			Tx:    tx,
+			Payment: &events.PaymentOut{
+				Address: wallet.AddressFromPubKeyHash(out.PubKeyHash),
+				Out:     i,
+				Value:   out.Value,
+			},
+		})
+	}
+}
+
+// Publish the blocks that left and joined the best chain since the tip of
+// the last call, then the new tip. Called wherever blocks are connected, a
+// reorg through the sync shows up as one change of tip.
+func (n *Node) tipChanged() {
+	n.tipMu.Lock()
+	defer n.tipMu.Unlock()
+
+	tip := n.chain.LastHash()
+	if bytes.Equal(tip, n.notifiedTip) {
+		return
+	}
+
+	disconnected, connected, err := n.forkPath(n.notifiedTip, tip)
+	if err != nil {
+		fmt.Printf("Could not follow tip change to %x: %s\n", tip, err)
+		return
+	}
+
+	for _, block := range disconnected {
+		n.events.Publish(events.Event{Topic: events.BlockDisconnected, Block: block})
+	}
+
+	for _, block := range connected {
+		n.events.Publish(events.Event{Topic: events.BlockConnected, Block: block})
+		for _, tx := range block.Transactions {
+			n.publishPayments(tx, block)
+		}
+	}
+
+	if len(connected) > 0 {
+		n.events.Publish(events.Event{Topic: events.Tip, Block: connected[len(connected)-1]})
+	}
+	n.notifiedTip = tip
+}
+
+// Blocks from the tip from down to the fork point, and from there up to the
+// tip to
+func (n *Node) forkPath(from, to []byte) ([]*blockchain.Block, []*blockchain.Block, error) {
+	var disconnected, connected []*blockchain.Block
+
+	oldBlock, err := n.getBlock(from)
+	if err != nil {
+		return nil, nil, err
+	}
+	newBlock, err := n.getBlock(to)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for !bytes.Equal(oldBlock.Hash, newBlock.Hash) {
+		if oldBlock.Height >= newBlock.Height {
+			disconnected = append(disconnected, oldBlock)
+			if oldBlock, err = n.getBlock(oldBlock.PrevHash); err != nil {
+				return nil, nil, err
+			}
+		} else {
+			connected = append(connected, newBlock)
+			if newBlock, err = n.getBlock(newBlock.PrevHash); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	// Oldest first
+	for i, j := 0, len(connected)-1; i < j; i, j = i+1, j-1 {
+		connected[i], connected[j] = connected[j], connected[i]
+	}
+
+	return disconnected, connected, nil
+}
+
+func (n *Node) getBlock(hash []byte) (*blockchain.Block, error) {
+	block, err := n.chain.GetBlock(hash)
+	if err != nil {
+		return nil, fmt.Errorf("block %x: %s", hash, err)
+	}
+	return &block, nil
+}
@@ -0,0 +1,329 @@
+package network
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/LidoKing/learnBlockchain/blockchain"
+	"github.com/LidoKing/learnBlockchain/mempool"
+)
+
+// Blocks and txs that arrive before what they build on wait here, keyed by
+// the missing parents, until those show up or they expire. The sender is
+// asked for the parents when an orphan is added.
+const (
+	maxOrphanBlocks = 100
+	maxOrphanTxs    = 100
+	orphanExpiry    = 20 * time.Minute
+)
+
+type orphan struct {
+	// One of block and tx is set
+	block   *blockchain.Block
+	tx      *blockchain.Transaction
+	parents []string
+	// Peer that sent it, nil if it was made by this node
+	from    *Peer
+	expires time.Time
+}
+
+type orphanPool struct {
+	mu       sync.Mutex
+	max      int
+	orphans  map[string]*orphan
+	byParent map[string]map[string]bool
+}
+
+func newOrphanPool(max int) *orphanPool {
+	return &orphanPool{
+		max:      max,
+		orphans:  make(map[string]*orphan),
+		byParent: make(map[string]map[string]bool),
+	}
+}
+
+func newOrphanBlock(block *blockchain.Block, from *Peer) *orphan {
+	parents := []string{hex.EncodeToString(block.PrevHash)}
+	return &orphan{block: block, parents: parents, from: from, expires: time.Now().Add(orphanExpiry)}
+}
+
+func newOrphanTx(tx *blockchain.Transaction, missing [][]byte, from *Peer) *orphan {
+	var parents []string
+	for _, id := range missing {
+		parents = append(parents, hex.EncodeToString(id))
+	}
+
+	return &orphan{tx: tx, parents: parents, from: from, expires: time.Now().Add(orphanExpiry)}
+}
+
+func (o *orphan) id() string {
+	if o.block != nil {
+		return hex.EncodeToString(o.block.Hash)
+	}
+	return hex.EncodeToString(o.tx.ID)
+}
+
+/*-------------------------------pool-------------------------------*/
+
+// Keep o, making room by dropping expired orphans and then the one closest
+// to expiring
+func (op *orphanPool) add(o *orphan) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	if _, ok := op.orphans[o.id()]; ok {
+		return
+	}
+
+	if len(op.orphans) >= op.max {
+		op.dropExpired()
+	}
+
+	if len(op.orphans) >= op.max {
+		var oldest *orphan
+		for _, other := range op.orphans {
+			if oldest == nil || other.expires.Before(oldest.expires) {
+				oldest = other
+			}
+		}
+		op.remove(oldest)
+	}
+
+	op.orphans[o.id()] = o
+	for _, parent := range o.parents {
+		if op.byParent[parent] == nil {
+			op.byParent[parent] = make(map[string]bool)
+		}
+		op.byParent[parent][o.id()] = true
+	}
+}
+
+func (op *orphanPool) remove(o *orphan) {
+	delete(op.orphans, o.id())
+
+	for _, parent := range o.parents {
+		delete(op.byParent[parent], o.id())
+		if len(op.byParent[parent]) == 0 {
+			delete(op.byParent, parent)
+		}
+	}
+}
+
+func (op *orphanPool) has(id []byte) bool {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	_, ok := op.orphans[hex.EncodeToString(id)]
+	return ok
+}
+
+// Remove and return the orphan with id, nil if there is none
+func (op *orphanPool) take(id []byte) *orphan {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	o, ok := op.orphans[hex.EncodeToString(id)]
+	if !ok {
+		return nil
+	}
+
+	op.remove(o)
+	return o
+}
+
+// Remove and return the orphans waiting for parent
+func (op *orphanPool) children(parent []byte) []*orphan {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	var list []*orphan
+	for id := range op.byParent[hex.EncodeToString(parent)] {
+		list = append(list, op.orphans[id])
+	}
+
+	for _, o := range list {
+		op.remove(o)
+	}
+
+	return list
+}
+
+// Remove and return the orphan waiting for parent that arrived first, nil if
+// there is none. The others stay, e.g. competing blocks on the same parent.
+func (op *orphanPool) firstChild(parent []byte) *orphan {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	var first *orphan
+	for id := range op.byParent[hex.EncodeToString(parent)] {
+		o := op.orphans[id]
+		if first == nil || o.expires.Before(first.expires) {
+			first = o
+		}
+	}
+
+	if first != nil {
+		op.remove(first)
+	}
+	return first
+}
+
+func (op *orphanPool) waitingFor(parent []byte) bool {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	return len(op.byParent[hex.EncodeToString(parent)]) > 0
+}
+
+func (op *orphanPool) count() int {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	return len(op.orphans)
+}
+
+func (op *orphanPool) dropExpired() int {
+	removed := 0
+	now := time.Now()
+
+	for _, o := range op.orphans {
+		if now.After(o.expires) {
+			op.remove(o)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+func (op *orphanPool) expire() int {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	return op.dropExpired()
+}
+
+/*-------------------------------blocks-------------------------------*/
+
+// Keep block until its parent arrives, the headers sync fetches the parents
+// from the peer that sent it
+func (n *Node) addOrphanBlock(p *Peer, block *blockchain.Block) {
+	fmt.Printf("Block %x is an orphan, its parent %x is unknown\n", block.Hash, block.PrevHash)
+
+	n.blockOrphans.add(newOrphanBlock(block, p))
+	n.sync.start(p)
+}
+
+// Add block on top of the tip, update everything depending on it and pass
+// it on to peers other than from
+func (n *Node) connectBlock(block *blockchain.Block, from *Peer) error {
+	if err := n.chain.CheckBlockTxs(block); err != nil {
+		return misbehavior{scoreInvalidBlock, fmt.Sprintf("invalid block: %s", err)}
+	}
+
+	UTXOSet := blockchain.UTXOSet{Blockchain: n.chain}
+	if err := UTXOSet.CheckTxIDs(block); err != nil {
+		return misbehavior{scoreInvalidBlock, fmt.Sprintf("invalid block: %s", err)}
+	}
+
+	// The UTXO set and pool follow the tip, a block that did not become it
+	// must not touch them
+	if err := n.chain.ExtendTip(block); err != nil {
+		return err
+	}
+
+	n.pool.RemoveForBlock(block)
+	UTXOSet.Update(block)
+
+	fmt.Printf("Added block %x\n", block.Hash)
+	n.announceBlock(block, from)
+	n.tipChanged()
+
+	var ids [][]byte
+	for _, tx := range block.Transactions {
+		ids = append(ids, tx.ID)
+	}
+	n.acceptOrphanTxs(ids)
+
+	return nil
+}
+
+// Connect orphans that extend the tip, one after another, the first to
+// arrive if several do. Orphans forking off elsewhere are left to expire,
+// the headers sync takes care of other branches and picks them up if needed.
+func (n *Node) connectOrphanBlocks() {
+	for {
+		o := n.blockOrphans.firstChild(n.chain.LastHash())
+		if o == nil {
+			return
+		}
+
+		// A sibling that arrived later may still extend the tip
+		if err := n.connectBlock(o.block, o.from); err != nil {
+			fmt.Printf("Could not connect orphan %x: %s\n", o.block.Hash, err)
+			if m, ok := err.(misbehavior); ok && o.from != nil {
+				o.from.Misbehaving(m.score, m.reason)
+			}
+		}
+	}
+}
+
+/*-------------------------------txs-------------------------------*/
+
+// Keep tx until its parents arrive and ask the sender for those that are
+// not orphans themselves
+func (n *Node) addOrphanTx(tx *blockchain.Transaction, missing [][]byte, from *Peer) {
+	fmt.Printf("Tx %x is an orphan, %d parents are unknown\n", tx.ID, len(missing))
+
+	n.txOrphans.add(newOrphanTx(tx, missing, from))
+
+	for _, parent := range missing {
+		if !n.txOrphans.has(parent) {
+			n.SendGetData(from, "tx", parent)
+		}
+	}
+}
+
+// Try orphans again whose parents are among ids, and in turn their children
+// once they are accepted
+func (n *Node) acceptOrphanTxs(ids [][]byte) {
+	for len(ids) > 0 {
+		parent := ids[0]
+		ids = ids[1:]
+
+		for _, o := range n.txOrphans.children(parent) {
+			err := n.pool.Add(*o.tx)
+
+			if missing, ok := err.(mempool.MissingParentsError); ok {
+				n.txOrphans.add(newOrphanTx(o.tx, missing.Parents, o.from))
+				continue
+			}
+
+			if err != nil {
+				if _, ok := err.(mempool.InvalidTxError); ok {
+					if o.from != nil {
+						o.from.Misbehaving(scoreInvalidTx, fmt.Sprintf("invalid orphan tx %x: %s", o.tx.ID, err))
+					}
+				}
+				fmt.Printf("Rejected orphan tx %x: %s\n", o.tx.ID, err)
+				continue
+			}
+
+			fmt.Printf("Accepted orphan tx %x\n", o.tx.ID)
+			n.txAccepted(o.tx, o.from)
+			ids = append(ids, o.tx.ID)
+		}
+	}
+}
+
+// Drop orphans that waited too long
+func (n *Node) expireOrphans() {
+	blocks := n.blockOrphans.expire()
+	txs := n.txOrphans.expire()
+
+	if blocks+txs > 0 {
+		fmt.Printf("Expired %d orphan blocks and %d orphan txs\n", blocks, txs)
+	}
+}
@@ -0,0 +1,80 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/LidoKing/learnBlockchain/blockchain"
+)
+
+// Orphan block on parent that expires after the given time
+func testOrphan(hash, parent string, expires time.Duration) *orphan {
+	block := &blockchain.Block{Hash: []byte(hash), PrevHash: []byte(parent)}
+
+	o := newOrphanBlock(block, nil)
+	o.expires = time.Now().Add(expires)
+	return o
+}
+
+func TestOrphanPoolFirstChild(t *testing.T) {
+	op := newOrphanPool(10)
+
+	// Competing blocks on the same parent and one on another
+	op.add(testOrphan("late", "parent", 3*time.Minute))
+	op.add(testOrphan("early", "parent", time.Minute))
+	op.add(testOrphan("middle", "parent", 2*time.Minute))
+	op.add(testOrphan("other", "elsewhere", time.Minute))
+
+	for _, want := range []string{"early", "middle", "late"} {
+		o := op.firstChild([]byte("parent"))
+		if o == nil || !bytes.Equal(o.block.Hash, []byte(want)) {
+			t.Fatalf("got %v, want %s", o, want)
+		}
+	}
+
+	if op.firstChild([]byte("parent")) != nil || op.waitingFor([]byte("parent")) {
+		t.Fatal("siblings left after all were taken")
+	}
+	if op.count() != 1 || !op.has([]byte("other")) {
+		t.Fatal("orphan on another parent taken")
+	}
+}
+
+func TestOrphanPoolChildren(t *testing.T) {
+	op := newOrphanPool(10)
+	op.add(testOrphan("a", "parent", time.Minute))
+	op.add(testOrphan("b", "parent", time.Minute))
+	op.add(testOrphan("c", "elsewhere", time.Minute))
+
+	if children := op.children([]byte("parent")); len(children) != 2 {
+		t.Fatalf("%d children, want 2", len(children))
+	}
+	if op.waitingFor([]byte("parent")) || op.count() != 1 {
+		t.Fatal("children left in the pool")
+	}
+}
+
+func TestOrphanPoolLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		// Expiry of the orphan in the full pool that is not "keep"
+		expires time.Duration
+	}{
+		{"expired dropped", -time.Minute},
+		{"closest to expiring dropped", time.Minute},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			op := newOrphanPool(2)
+			op.add(testOrphan("keep", "parent", time.Hour))
+			op.add(testOrphan("drop", "parent", test.expires))
+			op.add(testOrphan("new", "parent", time.Hour))
+
+			if op.count() != 2 || op.has([]byte("drop")) || !op.has([]byte("keep")) || !op.has([]byte("new")) {
+				t.Fatal("wrong orphan dropped")
+			}
+		})
+	}
+}
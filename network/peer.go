@@ -0,0 +1,375 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	sendQueueSize = 100
+	dialTimeout   = 5 * time.Second
+	writeTimeout  = 30 * time.Second
+	pingInterval  = 30 * time.Second
+	// A peer that sent nothing, not even a pong, for this long is dead
+	idleTimeout = 3 * pingInterval
+	// Longest a stopping node spends sending what is queued for a peer
+	drainTimeout = 5 * time.Second
+)
+
+// Long-lived connection to another node, messages are read and written by
+// goroutines of their own so a slow peer does not hold up others
+type Peer struct {
+	Inbound bool
+	// Static key of the node on encrypted connections, nil on plaintext ones
+	PubKey []byte
+
+	// From the version message of the peer, see handshake.go
+	Version     int
+	Services    uint64
+	UserAgent   string
+	StartHeight int
+
+	mu sync.Mutex
+	// Listening address of the node, see Addr()
+	addr            string
+	versionSent     bool
+	versionReceived bool
+	verackReceived  bool
+	handshaked      bool
+	// Messages queued before the handshake completed
+	held [][]byte
+	// Inventory the peer has and txs to announce to it, see relay.go
+	known   inventorySet
+	txQueue [][]byte
+
+	node      *Node
+	conn      net.Conn
+	send      chan []byte
+	quit      chan struct{}
+	closeOnce sync.Once
+	// Closed by drain()
+	stopping  chan struct{}
+	drainOnce sync.Once
+}
+
+func newPeer(n *Node, conn net.Conn, addr string, inbound bool) *Peer {
+	return &Peer{
+		addr:     addr,
+		Inbound:  inbound,
+		node:     n,
+		conn:     conn,
+		send:     make(chan []byte, sendQueueSize),
+		quit:     make(chan struct{}),
+		stopping: make(chan struct{}),
+	}
+}
+
+/*-------------------------------registry-------------------------------*/
+
+func (n *Node) getPeer(addr string) (*Peer, bool) {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	p, ok := n.peers[addr]
+	return p, ok
+}
+
+// Connected peers whose listening address is known
+func (n *Node) Peers() []*Peer {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	var list []*Peer
+	for _, p := range n.peers {
+		list = append(list, p)
+	}
+
+	return list
+}
+
+// Every open connection
+func (n *Node) allConns() []*Peer {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	var list []*Peer
+	for p := range n.conns {
+		list = append(list, p)
+	}
+
+	return list
+}
+
+// Existing connection to addr, or a new one
+func (n *Node) connectPeer(addr string) (*Peer, error) {
+	if p, ok := n.getPeer(addr); ok {
+		return p, nil
+	}
+
+	if n.book.IsBanned(banHost(addr)) {
+		return nil, fmt.Errorf("%s is banned", addr)
+	}
+
+	conn, err := n.cfg.Network.Dial(addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// Host names are only known to be banned once resolved
+	if n.book.IsBanned(banHost(conn.RemoteAddr().String())) {
+		conn.Close()
+		return nil, fmt.Errorf("%s is banned", addr)
+	}
+
+	secured, pubKey, err := n.secureDial(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn = secured
+
+	n.peersMu.Lock()
+	if p, ok := n.peers[addr]; ok {
+		// Connected meanwhile by someone else
+		n.peersMu.Unlock()
+		conn.Close()
+		return p, nil
+	}
+	p := newPeer(n, conn, addr, false)
+	p.PubKey = pubKey
+	n.peers[addr] = p
+	n.peersMu.Unlock()
+
+	p.start()
+	p.sendVersion()
+
+	return p, nil
+}
+
+// Listening address of the node, the dialed one for outbound peers and the
+// one from the version message for inbound ones, "" until that is known
+func (p *Peer) Addr() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.addr
+}
+
+// Inbound peers are registered under the listening address from their
+// version message, as long as its host is the one the connection comes from,
+// otherwise anyone could take over the address of another node
+// An address another connection is registered under is not taken over
+// either, the peer then stays known by its connection only
+func (p *Peer) learnAddr(addrFrom string) {
+	if !p.Inbound || addrFrom == "" || p.Addr() != "" {
+		return
+	}
+
+	if !sameHost(addrFrom, p.conn.RemoteAddr().String()) {
+		fmt.Printf("Peer %s claims to listen on %s, not registering it\n", p, addrFrom)
+		return
+	}
+
+	p.node.peersMu.Lock()
+	defer p.node.peersMu.Unlock()
+
+	if _, ok := p.node.peers[addrFrom]; ok {
+		return
+	}
+
+	p.mu.Lock()
+	p.addr = addrFrom
+	p.mu.Unlock()
+	p.node.peers[addrFrom] = p
+}
+
+/*-------------------------------connection-------------------------------*/
+
+// Run the read and write loops, unless the node is shutting down
+func (p *Peer) start() {
+	p.node.peersMu.Lock()
+	if p.node.closing {
+		p.node.peersMu.Unlock()
+		p.Close()
+		return
+	}
+	p.node.conns[p] = true
+	p.node.peerWg.Add(2)
+	p.node.peersMu.Unlock()
+
+	go func() {
+		defer p.node.peerWg.Done()
+		p.writeLoop()
+	}()
+	go func() {
+		defer p.node.peerWg.Done()
+		p.readLoop()
+	}()
+}
+
+// Queue request for sending, a peer that cannot keep up is disconnected
+func (p *Peer) Send(request []byte) {
+	if !isHandshakeCmd(BytesToCmd(request[:commandLength])) {
+		p.mu.Lock()
+		if !p.handshaked {
+			p.held = append(p.held, request)
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+	}
+
+	select {
+	case p.send <- request:
+	case <-p.quit:
+	default:
+		fmt.Printf("Send queue of %s is full, disconnecting\n", p)
+		p.Close()
+	}
+}
+
+func (p *Peer) Close() {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+		p.conn.Close()
+
+		addr := p.Addr()
+		p.node.peersMu.Lock()
+		if p.node.peers[addr] == p {
+			delete(p.node.peers, addr)
+		}
+		delete(p.node.conns, p)
+		p.node.peersMu.Unlock()
+
+		// Scores by connection end with it, see banKey()
+		if key, bannable := p.banKey(); !bannable {
+			p.node.scoresMu.Lock()
+			delete(p.node.banScores, key)
+			p.node.scoresMu.Unlock()
+		}
+	})
+}
+
+// Send what is queued and close, for a node shutting down
+// A message being handled is finished first, see Node.shutdown()
+func (p *Peer) drain() {
+	p.drainOnce.Do(func() {
+		close(p.stopping)
+	})
+}
+
+func (p *Peer) closed() bool {
+	select {
+	case <-p.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Peer) String() string {
+	if addr := p.Addr(); addr != "" {
+		return addr
+	}
+	return p.conn.RemoteAddr().String()
+}
+
+func (p *Peer) readLoop() {
+	defer p.Close()
+
+	for {
+		p.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+
+		req, err := ReadMessage(p.conn, maxMessageSize(p.node.chain))
+		if err != nil {
+			if err != io.EOF && !p.closed() {
+				fmt.Printf("Dropping peer %s: %s\n", p, err)
+			}
+			return
+		}
+
+		switch BytesToCmd(req[:commandLength]) {
+		case "ping":
+			p.Send(CmdToBytes("pong"))
+		case "pong":
+			// Reading it has already pushed the deadline
+		case "version":
+			p.handleVersion(req)
+		case "verack":
+			p.handleVerack()
+		case "getstatus":
+			if p.HandshakeDone() {
+				p.Send(p.node.statusMessage())
+			}
+		default:
+			if !p.HandshakeDone() {
+				fmt.Printf("Ignoring %s from %s before handshake\n", BytesToCmd(req[:commandLength]), p)
+				continue
+			}
+			if err := p.node.HandleMessage(p, req); err != nil {
+				if m, ok := err.(misbehavior); ok {
+					p.Misbehaving(m.score, m.reason)
+				} else {
+					fmt.Printf("Failed to handle message from %s: %s\n", p, err)
+				}
+			}
+		}
+	}
+}
+
+func (p *Peer) writeLoop() {
+	defer p.Close()
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	trickle := time.NewTimer(trickleDelay())
+	defer trickle.Stop()
+
+	for {
+		var request []byte
+
+		select {
+		case request = <-p.send:
+		case <-ticker.C:
+			request = CmdToBytes("ping")
+		case <-trickle.C:
+			trickle.Reset(trickleDelay())
+			if request = p.txInvMessage(); request == nil {
+				continue
+			}
+		case <-p.stopping:
+			p.flush()
+			return
+		case <-p.quit:
+			return
+		}
+
+		p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := WriteMessage(p.conn, request); err != nil {
+			if !p.closed() {
+				fmt.Printf("Dropping peer %s: %s\n", p, err)
+			}
+			return
+		}
+	}
+}
+
+// Write out the send queue, within drainTimeout
+func (p *Peer) flush() {
+	p.conn.SetWriteDeadline(time.Now().Add(drainTimeout))
+
+	for {
+		select {
+		case request := <-p.send:
+			if err := WriteMessage(p.conn, request); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
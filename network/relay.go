@@ -0,0 +1,151 @@
+package network
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"time"
+
+	"github.com/LidoKing/learnBlockchain/blockchain"
+)
+
+// Every peer remembers the inventory (tx IDs and block hashes) it is known to
+// have, because it announced or sent it to us or we did so to it, and is not
+// told about it again. Txs are announced to each peer in batches at random
+// intervals around trickleInterval, which keeps invs few and makes it harder
+// to tell which node a tx started from. Blocks are announced right away.
+const (
+	maxKnownInventory = 5000
+	maxInvPerMsg      = 1000
+	trickleInterval   = 2 * time.Second
+)
+
+// Bounded set forgetting the oldest items first
+type inventorySet struct {
+	items map[string]bool
+	order []string
+}
+
+func (s *inventorySet) add(hash []byte) {
+	key := hex.EncodeToString(hash)
+	if s.items[key] {
+		return
+	}
+
+	if s.items == nil {
+		s.items = make(map[string]bool)
+	}
+
+	if len(s.order) >= maxKnownInventory {
+		delete(s.items, s.order[0])
+		s.order = s.order[1:]
+	}
+
+	s.items[key] = true
+	s.order = append(s.order, key)
+}
+
+func (s *inventorySet) has(hash []byte) bool {
+	return s.items[hex.EncodeToString(hash)]
+}
+
+/*-------------------------------peer side-------------------------------*/
+
+func (p *Peer) markKnown(hash []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.known.add(hash)
+}
+
+func (p *Peer) knows(hash []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.known.has(hash)
+}
+
+// Mark hashes as known by p, nil for this node
+func (n *Node) markKnownBy(p *Peer, hashes ...[]byte) {
+	if p == nil {
+		return
+	}
+
+	for _, hash := range hashes {
+		p.markKnown(hash)
+	}
+}
+
+// Queue txID for the next trickle unless the peer has it already
+func (p *Peer) queueTx(txID []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.known.has(txID) {
+		return
+	}
+
+	p.known.add(txID)
+	p.txQueue = append(p.txQueue, txID)
+}
+
+// Queue txID even if the peer is thought to have it
+func (p *Peer) requeueTx(txID []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.known.add(txID)
+	p.txQueue = append(p.txQueue, txID)
+}
+
+// Next batch of queued tx announcements, nil if there are none
+func (p *Peer) txInvMessage() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.txQueue) == 0 {
+		return nil
+	}
+
+	n := len(p.txQueue)
+	if n > maxInvPerMsg {
+		n = maxInvPerMsg
+	}
+
+	items := p.txQueue[:n]
+	p.txQueue = p.txQueue[n:]
+
+	return append(CmdToBytes("inv"), GobEncode(Inv{p.node.address, "tx", items})...)
+}
+
+func trickleDelay() time.Duration {
+	return trickleInterval/2 + time.Duration(rand.Int63n(int64(trickleInterval)))
+}
+
+/*-------------------------------announcing-------------------------------*/
+
+// Peers that relay inventory, CLI connections and light nodes do not
+func (n *Node) relayPeers() []*Peer {
+	var list []*Peer
+
+	for _, p := range n.Peers() {
+		if p.HandshakeDone() && p.Services&ServiceFullNode != 0 && p.Addr() != n.address {
+			list = append(list, p)
+		}
+	}
+
+	return list
+}
+
+// Announce a tx that entered the pool to all peers that do not have it
+func (n *Node) relayTx(tx *blockchain.Transaction) {
+	for _, p := range n.relayPeers() {
+		p.queueTx(tx.ID)
+	}
+}
+
+// Announce a tx of ours again to all peers, see rebroadcastLoop()
+func (n *Node) rebroadcastTx(tx *blockchain.Transaction) {
+	for _, p := range n.relayPeers() {
+		p.requeueTx(tx.ID)
+	}
+}
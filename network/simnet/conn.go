@@ -0,0 +1,383 @@
+package simnet
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/LidoKing/learnBlockchain/network"
+)
+
+// In-memory network between simulated nodes, standing in for TCP
+// Every Write is delivered as a whole after the current latency, in order,
+// unless it is dropped. Nodes in different partitions cannot dial each other
+// and their connections are cut.
+type Network struct {
+	mu        sync.Mutex
+	listeners map[string]*listener
+	conns     map[*conn]bool
+	// Partition by node address, nodes in different ones cannot talk
+	groups   map[string]int
+	latency  time.Duration
+	jitter   time.Duration
+	dropRate float64
+	rand     *rand.Rand
+	nextPort int
+}
+
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		listeners: make(map[string]*listener),
+		conns:     make(map[*conn]bool),
+		groups:    make(map[string]int),
+		rand:      rand.New(rand.NewSource(seed)),
+		nextPort:  40000,
+	}
+}
+
+// Every message takes latency plus up to jitter to arrive
+func (nw *Network) SetLatency(latency, jitter time.Duration) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+
+	nw.latency, nw.jitter = latency, jitter
+}
+
+// Share of messages lost on the way, 0 to 1
+func (nw *Network) SetDropRate(rate float64) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+
+	nw.dropRate = rate
+}
+
+// Split the nodes at the given addresses into groups that cannot reach each
+// other, nodes left out form a group of their own
+func (nw *Network) Partition(groups ...[]string) {
+	nw.mu.Lock()
+	nw.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			nw.groups[addr] = i + 1
+		}
+	}
+
+	var cut []*conn
+	for c := range nw.conns {
+		if !nw.reachable(c.node, c.peerNode) {
+			cut = append(cut, c)
+		}
+	}
+	nw.mu.Unlock()
+
+	for _, c := range cut {
+		c.Close()
+	}
+}
+
+// Undo Partition(), nodes reconnect on their own
+func (nw *Network) Heal() {
+	nw.Partition()
+}
+
+// View of the network from the node listening on addr, for its
+// network.Config
+func (nw *Network) Host(addr string) network.Network {
+	return &host{nw, addr}
+}
+
+func (nw *Network) reachable(a, b string) bool {
+	return nw.groups[a] == nw.groups[b]
+}
+
+// Delay of the next message and whether it is lost, nw.mu held
+func (nw *Network) transit() (time.Duration, bool) {
+	if nw.dropRate > 0 && nw.rand.Float64() < nw.dropRate {
+		return 0, true
+	}
+
+	delay := nw.latency
+	if nw.jitter > 0 {
+		delay += time.Duration(nw.rand.Int63n(int64(nw.jitter)))
+	}
+	return delay, false
+}
+
+func (nw *Network) dial(from, to string) (net.Conn, error) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+
+	l, ok := nw.listeners[to]
+	if !ok || !nw.reachable(from, to) {
+		return nil, fmt.Errorf("dial %s: connection refused", to)
+	}
+
+	// Dialing side gets an ephemeral port like with TCP
+	hostname, _, _ := net.SplitHostPort(from)
+	local := net.JoinHostPort(hostname, strconv.Itoa(nw.nextPort))
+	nw.nextPort++
+
+	in, out := newPipe(), newPipe()
+	dialer := &conn{nw: nw, node: from, peerNode: to, local: addr(local), remote: addr(to), in: in, out: out}
+	accepted := &conn{nw: nw, node: to, peerNode: from, local: addr(to), remote: addr(local), in: out, out: in}
+
+	select {
+	case l.accept <- accepted:
+	default:
+		return nil, fmt.Errorf("dial %s: connection refused", to)
+	}
+
+	nw.conns[dialer] = true
+	nw.conns[accepted] = true
+	return dialer, nil
+}
+
+/*-------------------------------host-------------------------------*/
+
+type host struct {
+	nw   *Network
+	addr string
+}
+
+func (h *host) Listen(addr string) (net.Listener, error) {
+	h.nw.mu.Lock()
+	defer h.nw.mu.Unlock()
+
+	if _, ok := h.nw.listeners[addr]; ok {
+		return nil, fmt.Errorf("listen %s: address already in use", addr)
+	}
+
+	l := &listener{nw: h.nw, addr: addr, accept: make(chan *conn, 16), done: make(chan struct{})}
+	h.nw.listeners[addr] = l
+	return l, nil
+}
+
+func (h *host) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return h.nw.dial(h.addr, addr)
+}
+
+type addr string
+
+func (a addr) Network() string { return "sim" }
+func (a addr) String() string  { return string(a) }
+
+/*-------------------------------listener-------------------------------*/
+
+type listener struct {
+	nw     *Network
+	addr   string
+	accept chan *conn
+	once   sync.Once
+	done   chan struct{}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		l.nw.mu.Lock()
+		delete(l.nw.listeners, l.addr)
+		l.nw.mu.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return addr(l.addr)
+}
+
+/*-------------------------------connections-------------------------------*/
+
+type packet struct {
+	data []byte
+	at   time.Time
+}
+
+// One direction of a connection
+type pipe struct {
+	mu sync.Mutex
+	// Written and on the way
+	queue []packet
+	// Arrived and not read yet
+	buf []byte
+	// Arrival of the last packet, later ones never overtake it
+	last time.Time
+	// Writer closed, the reader gets EOF once everything arrived
+	eof bool
+	// Reader closed
+	closed   bool
+	deadline time.Time
+	// Wakes the reader
+	notify chan struct{}
+}
+
+func newPipe() *pipe {
+	return &pipe{notify: make(chan struct{}, 1)}
+}
+
+func (p *pipe) wake() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (p *pipe) push(data []byte, delay time.Duration) {
+	p.mu.Lock()
+	at := time.Now().Add(delay)
+	if at.Before(p.last) {
+		at = p.last
+	}
+	p.last = at
+	p.queue = append(p.queue, packet{data, at})
+	p.mu.Unlock()
+
+	p.wake()
+}
+
+func (p *pipe) read(b []byte) (int, error) {
+	for {
+		p.mu.Lock()
+		now := time.Now()
+
+		for len(p.queue) > 0 && !p.queue[0].at.After(now) {
+			p.buf = append(p.buf, p.queue[0].data...)
+			p.queue = p.queue[1:]
+		}
+
+		switch {
+		case p.closed:
+			p.mu.Unlock()
+			return 0, net.ErrClosed
+		case len(p.buf) > 0:
+			n := copy(b, p.buf)
+			p.buf = p.buf[n:]
+			p.mu.Unlock()
+			return n, nil
+		case p.eof && len(p.queue) == 0:
+			p.mu.Unlock()
+			return 0, io.EOF
+		case !p.deadline.IsZero() && !now.Before(p.deadline):
+			p.mu.Unlock()
+			return 0, timeoutError{}
+		}
+
+		// Sleep until the next packet arrives or the deadline passes
+		var timer *time.Timer
+		var wait <-chan time.Time
+		next := p.deadline
+		if len(p.queue) > 0 && (next.IsZero() || p.queue[0].at.Before(next)) {
+			next = p.queue[0].at
+		}
+		if !next.IsZero() {
+			timer = time.NewTimer(next.Sub(now))
+			wait = timer.C
+		}
+		p.mu.Unlock()
+
+		select {
+		case <-p.notify:
+		case <-wait:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (p *pipe) setDeadline(t time.Time) {
+	p.mu.Lock()
+	p.deadline = t
+	p.mu.Unlock()
+
+	p.wake()
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// End of a connection, owned by the node listening on node
+type conn struct {
+	nw            *Network
+	node          string
+	peerNode      string
+	local, remote net.Addr
+	in, out       *pipe
+	once          sync.Once
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	return c.in.read(b)
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	c.out.mu.Lock()
+	closed := c.out.eof || c.out.closed
+	c.out.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+
+	c.nw.mu.Lock()
+	delay, dropped := c.nw.transit()
+	c.nw.mu.Unlock()
+
+	if !dropped {
+		data := make([]byte, len(b))
+		copy(data, b)
+		c.out.push(data, delay)
+	}
+	return len(b), nil
+}
+
+func (c *conn) Close() error {
+	c.once.Do(func() {
+		c.nw.mu.Lock()
+		delete(c.nw.conns, c)
+		c.nw.mu.Unlock()
+
+		c.in.mu.Lock()
+		c.in.closed = true
+		c.in.mu.Unlock()
+		c.in.wake()
+
+		c.out.mu.Lock()
+		c.out.eof = true
+		c.out.mu.Unlock()
+		c.out.wake()
+	})
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+// Writes never block
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
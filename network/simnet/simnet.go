@@ -0,0 +1,236 @@
+// Package simnet runs several nodes in one process on an in-memory network,
+// for tests of how they sync and relay. Latency, message drops and
+// partitions can be changed at any time, blocks are mined on demand at a low
+// difficulty and Converged() checks that all nodes agree on the tip and the
+// UTXO set.
+//
+// Badger (v1) has no in-memory mode, so chains live in a temporary dir that
+// Close() removes.
+package simnet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/LidoKing/learnBlockchain/blockchain"
+	"github.com/LidoKing/learnBlockchain/blockchain/wallet"
+	"github.com/LidoKing/learnBlockchain/network"
+)
+
+type Config struct {
+	Nodes int
+	// Leading zero bits of block hashes, low enough to mine in no time
+	// Set for the whole process while the simulation runs
+	Difficulty int
+	Latency    time.Duration
+	Jitter     time.Duration
+	// Share of messages lost on the way, 0 to 1
+	DropRate float64
+	// Seeds jitter and drops, for repeatable runs
+	Seed int64
+}
+
+var DefaultConfig = Config{
+	Nodes:      3,
+	Difficulty: 8,
+	Latency:    10 * time.Millisecond,
+}
+
+const (
+	simPort = "3000"
+	// Nodes only mine when asked to
+	mineInterval = 24 * time.Hour
+	pollInterval = 50 * time.Millisecond
+)
+
+// Running simulation, node i mines to and spends from wallet i
+type Sim struct {
+	Net     *Network
+	Nodes   []*network.Node
+	wallets []*wallet.Wallet
+	chains  []*blockchain.BlockChain
+	dir     string
+
+	prevDifficulty int
+}
+
+// Start cfg.Nodes nodes sharing a genesis block that pays node 0, each one
+// connected to all others
+func New(cfg Config) (*Sim, error) {
+	if cfg.Nodes < 1 {
+		return nil, fmt.Errorf("simulation needs nodes, got %d", cfg.Nodes)
+	}
+
+	dir, err := ioutil.TempDir("", "simnet")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Sim{
+		Net:            NewNetwork(cfg.Seed),
+		dir:            dir,
+		prevDifficulty: blockchain.Difficulty,
+	}
+	s.Net.SetLatency(cfg.Latency, cfg.Jitter)
+	s.Net.SetDropRate(cfg.DropRate)
+	blockchain.Difficulty = cfg.Difficulty
+
+	addrs := make([]string, cfg.Nodes)
+	for i := range addrs {
+		addrs[i] = s.NodeAddress(i)
+		s.wallets = append(s.wallets, wallet.MakeWallet())
+	}
+
+	genesis := blockchain.Genesis(blockchain.CoinbaseTx(s.Address(0), "simnet genesis"))
+
+	for i := range addrs {
+		chain, err := blockchain.NewBlockChain(filepath.Join(dir, fmt.Sprintf("node%d", i)), genesis)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.chains = append(s.chains, chain)
+
+		UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+		UTXOSet.Reindex()
+
+		nodeCfg := network.DefaultConfig
+		nodeCfg.Net = network.NetConfig{Listen: addrs[i]}
+		// Each pair is dialed once, by the later node
+		nodeCfg.Net.Connect = append([]string(nil), addrs[:i]...)
+		nodeCfg.Network = s.Net.Host(addrs[i])
+		nodeCfg.MinerAddress = s.Address(i)
+		nodeCfg.Mining.MinInterval = mineInterval
+
+		w := s.wallets[i]
+		wallets := &wallet.Wallets{Wallets: map[string]*wallet.Wallet{s.Address(i): w}}
+
+		node, err := network.NewNode(nodeCfg, chain, wallets)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.Nodes = append(s.Nodes, node)
+	}
+
+	for _, node := range s.Nodes {
+		if err := node.Start(context.Background()); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Stop all nodes and delete their chains
+func (s *Sim) Close() {
+	for _, node := range s.Nodes {
+		node.Stop()
+	}
+	for _, chain := range s.chains {
+		chain.Database.Close()
+	}
+
+	os.RemoveAll(s.dir)
+	blockchain.Difficulty = s.prevDifficulty
+}
+
+// Network address of node i
+func (s *Sim) NodeAddress(i int) string {
+	return fmt.Sprintf("sim%d:%s", i, simPort)
+}
+
+// Wallet address of node i
+func (s *Sim) Address(i int) string {
+	return string(s.wallets[i].Address())
+}
+
+/*-------------------------------actions-------------------------------*/
+
+// Mine a block on node i right away and relay it
+func (s *Sim) Mine(i int) (*blockchain.Block, error) {
+	return s.Nodes[i].MineBlock()
+}
+
+// Pay amount from the wallet of node from to that of node to, the tx is
+// submitted to node from
+func (s *Sim) Send(from, to, amount int) (tx *blockchain.Transaction, err error) {
+	// Building a tx panics on missing funds like it does for the CLI
+	defer func() {
+		if r := recover(); r != nil {
+			tx, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+
+	UTXOSet := blockchain.UTXOSet{Blockchain: s.chains[from]}
+	tx = blockchain.NewTransaction(s.wallets[from], s.Address(to), amount, &UTXOSet)
+
+	return tx, s.Nodes[from].SubmitTx(tx)
+}
+
+// Split nodes into groups by index, see Network.Partition()
+func (s *Sim) Partition(groups ...[]int) {
+	var addrGroups [][]string
+	for _, group := range groups {
+		var addrs []string
+		for _, i := range group {
+			addrs = append(addrs, s.NodeAddress(i))
+		}
+		addrGroups = append(addrGroups, addrs)
+	}
+
+	s.Net.Partition(addrGroups...)
+}
+
+func (s *Sim) Heal() {
+	s.Net.Heal()
+}
+
+/*-------------------------------convergence-------------------------------*/
+
+// Nil once all nodes have the same tip and UTXO set, otherwise the first
+// difference
+func (s *Sim) Converged() error {
+	tip := s.chains[0].LastHash()
+	utxos := blockchain.UTXOSet{Blockchain: s.chains[0]}.Hash()
+
+	for i, chain := range s.chains[1:] {
+		if !bytes.Equal(chain.LastHash(), tip) {
+			return fmt.Errorf("node %d has tip %x at height %d, node 0 has %x at height %d",
+				i+1, chain.LastHash(), chain.GetBestHeight(), tip, s.chains[0].GetBestHeight())
+		}
+
+		if !bytes.Equal(blockchain.UTXOSet{Blockchain: chain}.Hash(), utxos) {
+			return fmt.Errorf("node %d has other UTXOs than node 0 at tip %x", i+1, tip)
+		}
+	}
+
+	return nil
+}
+
+// Wait up to timeout for Converged() to pass, returns its last error
+func (s *Sim) WaitForConvergence(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		err := s.Converged()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// Height all nodes agree on, -1 if they do not
+func (s *Sim) Height() int {
+	if s.Converged() != nil {
+		return -1
+	}
+	return s.chains[0].GetBestHeight()
+}
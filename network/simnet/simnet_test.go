@@ -0,0 +1,139 @@
+package simnet
+
+import (
+	"testing"
+	"time"
+)
+
+const (
+	convergeTimeout = 30 * time.Second
+	// Time nodes get to dial each other before a test starts
+	connectDelay = 500 * time.Millisecond
+)
+
+// Simulation of cfg.Nodes nodes that have connected to each other
+func start(t *testing.T, cfg Config) *Sim {
+	t.Helper()
+
+	if testing.Short() {
+		t.Skip("simulation runs several nodes")
+	}
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+
+	time.Sleep(connectDelay)
+	return s
+}
+
+func mine(t *testing.T, s *Sim, i int) {
+	t.Helper()
+
+	if _, err := s.Mine(i); err != nil {
+		t.Fatalf("node %d: %s", i, err)
+	}
+}
+
+func TestSync(t *testing.T) {
+	s := start(t, DefaultConfig)
+
+	for i := 0; i < 3; i++ {
+		mine(t, s, i)
+		if err := s.WaitForConvergence(convergeTimeout); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s.Height() != 3 {
+		t.Fatalf("height %d, want 3", s.Height())
+	}
+}
+
+func TestTxRelay(t *testing.T) {
+	s := start(t, DefaultConfig)
+
+	tx, err := s.Send(0, 2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(convergeTimeout)
+	for i := range s.Nodes {
+		for !s.Nodes[i].Pool().Has(tx.ID) {
+			if time.Now().After(deadline) {
+				t.Fatalf("tx did not reach node %d", i)
+			}
+			time.Sleep(pollInterval)
+		}
+	}
+
+	// Peers have the tx, so the block reaches them as a compact block
+	mine(t, s, 1)
+	if err := s.WaitForConvergence(convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range s.Nodes {
+		if s.Nodes[i].Pool().Has(tx.ID) {
+			t.Fatalf("mined tx still in the pool of node %d", i)
+		}
+	}
+}
+
+func TestPartitionReorg(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.Nodes = 4
+	cfg.Jitter = 5 * time.Millisecond
+	s := start(t, cfg)
+
+	s.Partition([]int{0, 1}, []int{2, 3})
+
+	// Mined on the side that loses, so it is disconnected again
+	tx, err := s.Send(0, 1, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mine(t, s, 0)
+	mine(t, s, 2)
+	mine(t, s, 2)
+
+	time.Sleep(time.Second)
+	if s.Converged() == nil {
+		t.Fatal("converged while partitioned")
+	}
+
+	s.Heal()
+	if err := s.WaitForConvergence(convergeTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Height() != 2 {
+		t.Fatalf("height %d after heal, want the longer branch's 2", s.Height())
+	}
+	if !s.Nodes[0].Pool().Has(tx.ID) {
+		t.Fatal("tx of disconnected block is not back in the pool")
+	}
+}
+
+func TestDroppedMessages(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.Nodes = 4
+	cfg.Seed = 1
+	s := start(t, cfg)
+
+	s.Net.SetDropRate(0.2)
+	for i := 0; i < 3; i++ {
+		mine(t, s, i)
+	}
+	time.Sleep(3 * time.Second)
+
+	// Syncing catches up with whatever got lost once messages go through
+	s.Net.SetDropRate(0)
+	mine(t, s, 3)
+	if err := s.WaitForConvergence(150 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
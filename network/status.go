@@ -0,0 +1,165 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Answer to "getstatus", what the status command prints
+type Status struct {
+	Address      string
+	Listen       string
+	PubKey       string
+	Encrypt      bool
+	UserAgent    string
+	Height       int
+	Tip          []byte
+	HeaderHeight int
+	Syncing      bool
+	InFlight     int
+	Waiting      int
+	Connected    int
+	MempoolTxs   int
+	OrphanBlocks int
+	OrphanTxs    int
+	KnownAddrs   int
+	Peers        []PeerStatus
+}
+
+type PeerStatus struct {
+	Addr        string
+	PubKey      string
+	Inbound     bool
+	Version     int
+	Services    uint64
+	UserAgent   string
+	StartHeight int
+}
+
+// What the node is up to, also sent to the status command
+func (n *Node) Status() *Status {
+	sync := n.sync.status()
+
+	st := &Status{
+		Address:      n.address,
+		Listen:       n.cfg.Net.Listen,
+		PubKey:       n.PubKey(),
+		Encrypt:      n.cfg.Transport.encrypted(),
+		UserAgent:    userAgent,
+		Height:       n.chain.GetBestHeight(),
+		Tip:          n.chain.LastHash(),
+		HeaderHeight: sync.HeaderHeight,
+		Syncing:      sync.Syncing,
+		InFlight:     sync.InFlight,
+		Waiting:      sync.Waiting,
+		Connected:    sync.Connected,
+		MempoolTxs:   n.pool.Count(),
+		OrphanBlocks: n.blockOrphans.count(),
+		OrphanTxs:    n.txOrphans.count(),
+		KnownAddrs:   n.book.Count(),
+	}
+
+	for _, p := range n.Peers() {
+		if !p.HandshakeDone() {
+			continue
+		}
+		pubKey := ""
+		if p.PubKey != nil {
+			pubKey = hex.EncodeToString(p.PubKey)
+		}
+		st.Peers = append(st.Peers, PeerStatus{p.Addr(), pubKey, p.Inbound, p.Version, p.Services, p.UserAgent, p.StartHeight})
+	}
+
+	return st
+}
+
+func (n *Node) statusMessage() []byte {
+	return append(CmdToBytes("status"), GobEncode(n.Status())...)
+}
+
+// Ask the node at addr for its status, see the status command
+func RequestStatus(addr string) (*Status, error) {
+	conn, err := net.DialTimeout(protocol, addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn, err = secureDialOnce(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := handshakeOnce(conn); err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := WriteMessage(conn, CmdToBytes("getstatus")); err != nil {
+		return nil, err
+	}
+
+	for {
+		req, err := ReadMessage(conn, maxMessageSize(nil))
+		if err != nil {
+			return nil, err
+		}
+
+		if BytesToCmd(req[:commandLength]) != "status" {
+			continue
+		}
+
+		var st Status
+		dec := gob.NewDecoder(bytes.NewReader(req[commandLength:]))
+		if err := dec.Decode(&st); err != nil {
+			return nil, fmt.Errorf("malformed status: %s", err)
+		}
+
+		return &st, nil
+	}
+}
+
+func (st *Status) Print() {
+	fmt.Printf("Node %s %s\n", st.Address, st.UserAgent)
+	if st.Listen != st.Address {
+		fmt.Printf("  Listen:  %s\n", st.Listen)
+	}
+	transport := "plaintext"
+	if st.Encrypt {
+		transport = "encrypted"
+	}
+	fmt.Printf("  Key:     %s (%s)\n", st.PubKey, transport)
+	fmt.Printf("  Height:  %d (%x)\n", st.Height, st.Tip)
+
+	if st.Syncing {
+		percent := 100.0
+		if st.HeaderHeight > 0 {
+			percent = float64(st.Height) * 100 / float64(st.HeaderHeight)
+		}
+		fmt.Printf("  Syncing: %d of %d (%.1f%%), %d blocks in flight, %d waiting\n",
+			st.Height, st.HeaderHeight, percent, st.InFlight, st.Waiting)
+	} else {
+		fmt.Println("  Synced")
+	}
+
+	fmt.Printf("  Mempool: %d txs\n", st.MempoolTxs)
+	fmt.Printf("  Orphans: %d blocks, %d txs\n", st.OrphanBlocks, st.OrphanTxs)
+	fmt.Printf("  Peers:   %d connected, %d known addresses\n", len(st.Peers), st.KnownAddrs)
+
+	for _, p := range st.Peers {
+		direction := "out"
+		if p.Inbound {
+			direction = "in"
+		}
+		key := "plaintext"
+		if p.PubKey != "" {
+			key = p.PubKey[:16]
+		}
+		fmt.Printf("    %-22s %-3s v%d %-16s %s height %d, %s\n",
+			p.Addr, direction, p.Version, servicesString(p.Services), p.UserAgent, p.StartHeight, key)
+	}
+}
@@ -0,0 +1,585 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/LidoKing/learnBlockchain/blockchain"
+)
+
+// Headers-first sync: headers are fetched from one peer with getheaders and
+// checked for proof of work and linkage, then block bodies are requested
+// with getdata from all peers that should have them, several at a time.
+// Bodies arriving out of order wait until their parents are connected.
+const (
+	maxHeadersPerMsg   = 2000
+	maxBlocksPerInv    = 500
+	maxInFlightPerPeer = 16
+	headersTimeout     = 30 * time.Second
+	blockTimeout       = 30 * time.Second
+	syncTickInterval   = 5 * time.Second
+	// Peers that let this many block requests time out are disconnected
+	maxStalls = 3
+	// Enough for a dense start and doubling steps over any realistic chain
+	maxLocatorHashes = 101
+)
+
+type GetHeaders struct {
+	AddrFrom string
+	Locator  [][]byte
+	StopHash []byte
+}
+
+type Headers struct {
+	AddrFrom string
+	Headers  []blockchain.BlockHeader
+}
+
+type blockRequest struct {
+	peer *Peer
+	sent time.Time
+}
+
+type syncManager struct {
+	node *Node
+	mu   sync.Mutex
+	// Validated headers beyond our tip, headers[0] is the next block to connect
+	headers []blockchain.BlockHeader
+	// Peer headers are being fetched from and when they were asked for
+	headerPeer   *Peer
+	headersAsked time.Time
+	// Peers that announced blocks while headerPeer was busy, asked next
+	waitingPeers []*Peer
+	inFlight     map[string]*blockRequest
+	received     map[string]*blockchain.Block
+	stalls       map[*Peer]int
+	// Highest header each peer has sent, their start height may be outdated
+	peerHeights   map[*Peer]int
+	connected     int
+	reindexNeeded bool
+	// Tip before the blocks waiting for the reindex were connected
+	oldTip []byte
+	// Txs in connected blocks that orphan txs wait for
+	orphanParents [][]byte
+}
+
+func newSyncManager(n *Node) *syncManager {
+	return &syncManager{
+		node:        n,
+		inFlight:    make(map[string]*blockRequest),
+		received:    make(map[string]*blockchain.Block),
+		stalls:      make(map[*Peer]int),
+		peerHeights: make(map[*Peer]int),
+	}
+}
+
+// Ask for up to maxHeadersPerMsg headers following the fork with locator,
+// stopping at stop if it comes first (nil for no stop)
+func (n *Node) SendGetHeaders(p *Peer, locator [][]byte, stop []byte) {
+	payload := GobEncode(GetHeaders{n.address, locator, stop})
+	request := append(CmdToBytes("getheaders"), payload...)
+
+	p.Send(request)
+}
+
+func (n *Node) SendHeaders(p *Peer, headers []blockchain.BlockHeader) {
+	payload := GobEncode(Headers{n.address, headers})
+	request := append(CmdToBytes("headers"), payload...)
+
+	p.Send(request)
+}
+
+/*-------------------------------handlers-------------------------------*/
+
+func checkLocator(cmd string, locator [][]byte) error {
+	if len(locator) > maxLocatorHashes {
+		return misbehavior{scoreMalformed, fmt.Sprintf("%s with %d locator hashes", cmd, len(locator))}
+	}
+
+	return nil
+}
+
+func (n *Node) HandleGetHeaders(p *Peer, request []byte) error {
+	var buff bytes.Buffer
+	var payload GetHeaders
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return malformed("getheaders", err)
+	}
+
+	if err := checkLocator("getheaders", payload.Locator); err != nil {
+		return err
+	}
+
+	headers := n.chain.HeadersAfter(payload.Locator, payload.StopHash, maxHeadersPerMsg)
+	n.SendHeaders(p, headers)
+
+	return nil
+}
+
+func (n *Node) HandleHeaders(p *Peer, request []byte) error {
+	var buff bytes.Buffer
+	var payload Headers
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return malformed("headers", err)
+	}
+
+	if len(payload.Headers) > maxHeadersPerMsg {
+		return misbehavior{scoreMalformed, fmt.Sprintf("%d headers in one message", len(payload.Headers))}
+	}
+
+	return n.sync.headersReceived(p, payload.Headers)
+}
+
+/*-------------------------------headers-------------------------------*/
+
+// Locator continuing from the last header we have, or from our tip
+func (s *syncManager) locator() [][]byte {
+	locator := s.node.chain.BlockLocator()
+	if len(s.headers) > 0 {
+		locator = append([][]byte{s.headers[len(s.headers)-1].Hash}, locator...)
+	}
+
+	return locator
+}
+
+// Fetch headers from p, after the peer currently asked if there is one
+func (s *syncManager) start(p *Peer) {
+	if p == nil || p.Addr() == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.headerPeer != nil && !s.headerPeer.closed() {
+		if p != s.headerPeer {
+			s.waitingPeers = append(s.waitingPeers, p)
+		}
+		return
+	}
+
+	s.requestHeaders(p)
+}
+
+// Current header peer is done, move on to the next one waiting
+func (s *syncManager) nextHeaderPeer() {
+	s.headerPeer = nil
+
+	for len(s.waitingPeers) > 0 {
+		p := s.waitingPeers[0]
+		s.waitingPeers = s.waitingPeers[1:]
+
+		if !p.closed() {
+			s.requestHeaders(p)
+			return
+		}
+	}
+}
+
+func (s *syncManager) requestHeaders(p *Peer) {
+	s.headerPeer = p
+	s.headersAsked = time.Now()
+
+	fmt.Printf("Requesting headers from %s\n", p)
+	s.node.SendGetHeaders(p, s.locator(), nil)
+}
+
+func (s *syncManager) headersReceived(p *Peer, headers []blockchain.BlockHeader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p == nil || p != s.headerPeer {
+		// Unsolicited, most likely a late answer to an earlier request
+		return nil
+	}
+
+	if len(headers) == 0 {
+		s.nextHeaderPeer()
+		return nil
+	}
+
+	// Attach to a block we have, or to the headers collected so far
+	var prev blockchain.BlockHeader
+	base := -1
+	first := headers[0]
+
+	if i := s.headerIndex(first.PrevHash); i >= 0 {
+		prev = s.headers[i]
+		base = i
+	} else if block, err := s.node.chain.GetBlock(first.PrevHash); err == nil {
+		prev = block.Header()
+	} else {
+		s.headerPeer = nil
+		return misbehavior{scoreMalformed, fmt.Sprintf("headers do not connect, %x is unknown", first.PrevHash)}
+	}
+
+	var fresh []blockchain.BlockHeader
+	for i := range headers {
+		h := headers[i]
+		if err := h.Validate(&prev); err != nil {
+			s.headerPeer = nil
+			return misbehavior{scoreInvalidBlock, err.Error()}
+		}
+		prev = h
+
+		if !s.node.chain.HasBlock(h.Hash) {
+			fresh = append(fresh, h)
+		}
+	}
+
+	if prev.Height > s.peerHeights[p] {
+		s.peerHeights[p] = prev.Height
+	}
+
+	// Headers of another branch only replace ours when it is longer
+	if base+1 < len(s.headers) && prev.Height <= s.headers[len(s.headers)-1].Height {
+		s.nextHeaderPeer()
+		return nil
+	}
+
+	s.forgetHeadersAfter(base)
+	s.headers = append(s.headers, fresh...)
+
+	fmt.Printf("Received %d headers from %s, %d blocks to download up to height %d\n",
+		len(headers), p, len(s.headers), prev.Height)
+
+	if len(headers) == maxHeadersPerMsg {
+		s.requestHeaders(p)
+	} else {
+		s.nextHeaderPeer()
+	}
+
+	s.schedule()
+
+	return nil
+}
+
+// Position of hash in headers, -1 if it is not there
+func (s *syncManager) headerIndex(hash []byte) int {
+	for i := range s.headers {
+		if bytes.Equal(s.headers[i].Hash, hash) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Drop headers after index i (all for -1), a peer sent another branch
+func (s *syncManager) forgetHeadersAfter(i int) {
+	for _, h := range s.headers[i+1:] {
+		key := hex.EncodeToString(h.Hash)
+		delete(s.inFlight, key)
+		delete(s.received, key)
+	}
+
+	s.headers = s.headers[:i+1]
+}
+
+/*-------------------------------bodies-------------------------------*/
+
+// Peers that should have the block at height
+func (s *syncManager) sources(height int) []*Peer {
+	var list []*Peer
+
+	for _, p := range s.node.Peers() {
+		if !p.HandshakeDone() || p.Services&ServiceFullNode == 0 {
+			continue
+		}
+		if p == s.headerPeer || p.StartHeight >= height || s.peerHeights[p] >= height {
+			list = append(list, p)
+		}
+	}
+
+	return list
+}
+
+// Ask for bodies of headers that are neither in flight nor received,
+// spreading them over the peers with the fewest requests
+func (s *syncManager) schedule() {
+	load := make(map[*Peer]int)
+	for _, req := range s.inFlight {
+		load[req.peer]++
+	}
+
+	for _, h := range s.headers {
+		key := hex.EncodeToString(h.Hash)
+		if _, ok := s.inFlight[key]; ok {
+			continue
+		}
+		if _, ok := s.received[key]; ok {
+			continue
+		}
+		if s.node.blockOrphans.has(h.Hash) {
+			continue
+		}
+
+		var best *Peer
+		for _, p := range s.sources(h.Height) {
+			if load[p] < maxInFlightPerPeer && (best == nil || load[p] < load[best]) {
+				best = p
+			}
+		}
+		if best == nil {
+			return
+		}
+
+		load[best]++
+		s.inFlight[key] = &blockRequest{best, time.Now()}
+		s.node.SendGetData(best, "block", h.Hash)
+	}
+}
+
+// Block arrived, returns false if it was not asked for by the sync
+func (s *syncManager) blockReceived(p *Peer, block *blockchain.Block) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := hex.EncodeToString(block.Hash)
+	i := s.headerIndex(block.Hash)
+	if i < 0 {
+		return false, nil
+	}
+
+	delete(s.inFlight, key)
+
+	if !s.headers[i].Matches(block) {
+		s.schedule()
+		return true, misbehavior{scoreInvalidBlock, fmt.Sprintf("block %x does not match its header", block.Hash)}
+	}
+
+	if p != nil {
+		s.stalls[p] = 0
+	}
+
+	s.received[key] = block
+	s.connectReceived()
+	s.schedule()
+
+	return true, nil
+}
+
+// Add received blocks to the s.node.chain in header order
+func (s *syncManager) connectReceived() {
+	for len(s.headers) > 0 {
+		key := hex.EncodeToString(s.headers[0].Hash)
+		block, ok := s.received[key]
+		if !ok {
+			// It may have come unasked before its parent
+			o := s.node.blockOrphans.take(s.headers[0].Hash)
+			if o == nil || !s.headers[0].Matches(o.block) {
+				break
+			}
+			block = o.block
+		}
+
+		if err := s.node.chain.Params.CheckBlock(block); err != nil {
+			fmt.Printf("Dropping sync, block %x is invalid: %s\n", block.Hash, err)
+			s.forgetHeadersAfter(-1)
+			break
+		}
+
+		if err := s.node.chain.CheckBlockTxs(block); err != nil {
+			fmt.Printf("Dropping sync, block %x is invalid: %s\n", block.Hash, err)
+			s.forgetHeadersAfter(-1)
+			break
+		}
+
+		if !s.reindexNeeded {
+			s.oldTip = s.node.chain.LastHash()
+		}
+
+		if err := s.node.chain.AddBlock(block); err != nil {
+			fmt.Printf("Dropping sync, block %x: %s\n", block.Hash, err)
+			s.forgetHeadersAfter(-1)
+			break
+		}
+		s.node.pool.RemoveForBlock(block)
+
+		for _, tx := range block.Transactions {
+			if s.node.txOrphans.waitingFor(tx.ID) {
+				s.orphanParents = append(s.orphanParents, tx.ID)
+			}
+		}
+
+		delete(s.received, key)
+		s.headers = s.headers[1:]
+		s.connected++
+		s.reindexNeeded = true
+	}
+
+	if len(s.headers) == 0 && s.reindexNeeded {
+		s.reindexNeeded = false
+
+		UTXOSet := blockchain.UTXOSet{Blockchain: s.node.chain}
+		UTXOSet.Reindex()
+
+		fmt.Printf("Synced to height %d\n", s.node.chain.GetBestHeight())
+		s.node.tipChanged()
+		s.node.readdDisconnectedTxs(s.oldTip)
+		s.oldTip = nil
+
+		// Orphans can only be checked against the reindexed UTXO set
+		s.node.connectOrphanBlocks()
+		s.node.acceptOrphanTxs(s.orphanParents)
+		s.orphanParents = nil
+	}
+}
+
+// Put txs of blocks that left the best chain since oldTip back into the
+// pool, those the new branch has mined or made invalid are turned down
+func (n *Node) readdDisconnectedTxs(oldTip []byte) {
+	disconnected, _, err := n.forkPath(oldTip, n.chain.LastHash())
+	if err != nil {
+		fmt.Printf("Could not find disconnected blocks: %s\n", err)
+		return
+	}
+
+	// Oldest first, so parents go back before their children
+	readded := 0
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		for _, tx := range disconnected[i].Transactions {
+			if tx.IsCoinbase() {
+				continue
+			}
+			if err := n.pool.Add(*tx); err != nil {
+				continue
+			}
+			n.txAccepted(tx, nil)
+			readded++
+		}
+	}
+
+	if len(disconnected) > 0 {
+		fmt.Printf("Reorg disconnected %d blocks, %d of their txs are back in the pool\n", len(disconnected), readded)
+	}
+}
+
+/*-------------------------------timeouts-------------------------------*/
+
+// Retry requests that took too long, replace a stalled header peer, log progress
+func (s *syncManager) tick() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, req := range s.inFlight {
+		if req.peer.closed() {
+			delete(s.inFlight, key)
+			continue
+		}
+
+		if time.Since(req.sent) > blockTimeout {
+			fmt.Printf("Block %s from %s timed out\n", key, req.peer)
+			delete(s.inFlight, key)
+
+			s.stalls[req.peer]++
+			if s.stalls[req.peer] >= maxStalls {
+				fmt.Printf("Disconnecting %s, it keeps stalling\n", req.peer)
+				delete(s.stalls, req.peer)
+				req.peer.Close()
+			}
+		}
+	}
+
+	for p := range s.peerHeights {
+		if p.closed() {
+			delete(s.peerHeights, p)
+			delete(s.stalls, p)
+		}
+	}
+
+	if s.headerPeer != nil && (s.headerPeer.closed() || time.Since(s.headersAsked) > headersTimeout) {
+		fmt.Printf("Headers from %s timed out\n", s.headerPeer)
+		s.nextHeaderPeer()
+	}
+
+	if s.headerPeer == nil {
+		if p := s.bestPeer(); p != nil {
+			s.requestHeaders(p)
+		}
+	}
+
+	s.schedule()
+
+	if len(s.headers) > 0 {
+		target := s.headers[len(s.headers)-1].Height
+		fmt.Printf("Sync: height %d of %d, %d blocks in flight, %d waiting\n",
+			s.node.chain.GetBestHeight(), target, len(s.inFlight), len(s.received))
+	}
+}
+
+// Peer claiming a longer s.node.chain than what we have and know headers of
+func (s *syncManager) bestPeer() *Peer {
+	height := s.node.chain.GetBestHeight()
+	if len(s.headers) > 0 {
+		height = s.headers[len(s.headers)-1].Height
+	}
+
+	var best *Peer
+	for _, p := range s.node.Peers() {
+		if p.HandshakeDone() && p.Services&ServiceFullNode != 0 && p.StartHeight > height {
+			if best == nil || p.StartHeight > best.StartHeight {
+				best = p
+				height = p.StartHeight
+			}
+		}
+	}
+
+	return best
+}
+
+func (s *syncManager) run(ctx context.Context) {
+	ticker := time.NewTicker(syncTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.tick()
+			s.node.expirePartialBlocks()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+/*-------------------------------status-------------------------------*/
+
+type syncStatus struct {
+	Syncing      bool
+	HeaderHeight int
+	InFlight     int
+	Waiting      int
+	Connected    int
+}
+
+func (s *syncManager) status() syncStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := syncStatus{
+		Syncing:      len(s.headers) > 0 || s.headerPeer != nil,
+		HeaderHeight: s.node.chain.GetBestHeight(),
+		InFlight:     len(s.inFlight),
+		Waiting:      len(s.received),
+		Connected:    s.connected,
+	}
+	if len(s.headers) > 0 {
+		st.HeaderHeight = s.headers[len(s.headers)-1].Height
+	}
+
+	return st
+}
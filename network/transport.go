@@ -0,0 +1,204 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Connections are plaintext unless Encrypt is set, then they use
+// the Noise handshake in noise.go and the static key of the node identifies
+// it. Nodes answer encrypted connections either way, so CLI commands (which
+// always encrypt) work against both kinds and an encrypting node can talk to
+// others. With an allow-list only the listed keys may connect either way.
+type TransportConfig struct {
+	Encrypt bool
+	// Hex public keys of nodes allowed to connect, empty allows everyone
+	AllowList []string
+}
+
+// Carries the connections of a node, Config.Network left nil means TCP
+// Simulated networks (see package simnet) run many nodes in one process on
+// connections of their own
+type Network interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+}
+
+type tcpNetwork struct{}
+
+func (tcpNetwork) Listen(addr string) (net.Listener, error) {
+	return net.Listen(protocol, addr)
+}
+
+func (tcpNetwork) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout(protocol, addr, timeout)
+}
+
+const nodeKeyFile = "./tmp/nodekey_%s"
+
+var (
+	// Key one-shot CLI connections authenticate with, see UseNodeKey()
+	clientNodeID string
+	clientKey    *noiseKeyPair
+)
+
+// Static key of the node using the data dir of nodeID, created on first use
+// Nodes without an ID get a new key every time
+func loadOrCreateNodeKey(nodeID string) (*noiseKeyPair, error) {
+	if nodeID == "" {
+		return newNoiseKeyPair()
+	}
+
+	path := fmt.Sprintf(nodeKeyFile, nodeID)
+	kp, err := loadNodeKey(path)
+	if !os.IsNotExist(err) {
+		return kp, err
+	}
+
+	if kp, err = newNoiseKeyPair(); err != nil {
+		return nil, err
+	}
+
+	data := []byte(hex.EncodeToString(kp.Private[:]) + "\n")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+
+	return kp, nil
+}
+
+func loadNodeKey(path string) (*noiseKeyPair, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	private, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(private) != noiseKeyLen {
+		return nil, fmt.Errorf("node key %s is malformed", path)
+	}
+
+	return noiseKeyPairFrom(private), nil
+}
+
+// CLI commands use the key of the node of NODE_ID, so an allow-list naming
+// the node admits its CLI as well
+func UseNodeKey(nodeID string) {
+	clientNodeID = nodeID
+	clientKey = nil
+}
+
+func oneShotKey() *noiseKeyPair {
+	if clientKey == nil {
+		kp, err := loadOrCreateNodeKey(clientNodeID)
+		if err != nil {
+			log.Panic(err)
+		}
+		clientKey = kp
+	}
+
+	return clientKey
+}
+
+func (t *TransportConfig) encrypted() bool {
+	return t.Encrypt || len(t.AllowList) > 0
+}
+
+func (n *Node) allowed(pubKey []byte) bool {
+	allowList := n.cfg.Transport.AllowList
+	if len(allowList) == 0 || bytes.Equal(pubKey, n.key.Public[:]) {
+		return true
+	}
+
+	key := hex.EncodeToString(pubKey)
+	for _, allowed := range allowList {
+		if strings.EqualFold(allowed, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*-------------------------------connections-------------------------------*/
+
+// Encrypt a connection to another node if the config asks for it, returns
+// the remote static key when encrypted
+func (n *Node) secureDial(conn net.Conn) (net.Conn, []byte, error) {
+	if !n.cfg.Transport.encrypted() {
+		return conn, nil, nil
+	}
+
+	nc, remote, err := dialNoise(conn, n.key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !n.allowed(remote) {
+		return nil, nil, fmt.Errorf("node key %x is not on the allow-list", remote)
+	}
+
+	return nc, remote, nil
+}
+
+// One-shot CLI connections are always encrypted
+func secureDialOnce(conn net.Conn) (net.Conn, error) {
+	nc, _, err := dialNoise(conn, oneShotKey())
+	return nc, err
+}
+
+func dialNoise(conn net.Conn, static *noiseKeyPair) (net.Conn, []byte, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nc, remote, err := noiseInitiate(conn, static)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return nc, remote, nil
+}
+
+// Find out whether an accepted connection is encrypted and run the handshake
+// if it is, plaintext is refused when the config asks for encryption
+func (n *Node) secureAccept(conn net.Conn) (net.Conn, []byte, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	start, err := r.Peek(len(noiseMagic))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !isNoiseMagic(start) {
+		if n.cfg.Transport.encrypted() {
+			return nil, nil, errors.New("connection is not encrypted")
+		}
+		return readerConn{conn, r}, nil, nil
+	}
+
+	if _, err := r.Discard(len(noiseMagic)); err != nil {
+		return nil, nil, err
+	}
+
+	nc, remote, err := noiseRespond(conn, r, n.key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !n.allowed(remote) {
+		return nil, nil, fmt.Errorf("node key %x is not on the allow-list", remote)
+	}
+
+	return nc, remote, nil
+}
@@ -0,0 +1,97 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const callTimeout = 30 * time.Second
+
+// Calls the RPC server of a node
+type Client struct {
+	info Info
+	http *http.Client
+	id   int
+}
+
+func NewClient(info Info) *Client {
+	return &Client{info: info, http: &http.Client{Timeout: callTimeout}}
+}
+
+// Client for the node nodeID running on this machine, errors when it is not
+// running or does not answer
+func Dial(nodeID string) (*Client, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf(infoFile, nodeID))
+	if err != nil {
+		return nil, err
+	}
+
+	var info Info
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+
+	// The file outlives a node that was killed
+	c := NewClient(info)
+	if err := c.Call("getbestblock", nil); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Call method with positional params and decode its result into result,
+// unless that is nil. Errors of the call itself are *Error.
+func (c *Client) Call(method string, result interface{}, params ...interface{}) error {
+	c.id++
+	if params == nil {
+		params = []interface{}{}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      c.id,
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.info.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.info.User, c.info.Password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", c.info.URL, resp.Status)
+	}
+
+	var r struct {
+		Result json.RawMessage `json:"result"`
+		Error  *Error          `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return err
+	}
+	if r.Error != nil {
+		return r.Error
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(r.Result, result)
+}
@@ -0,0 +1,181 @@
+package rpc
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/LidoKing/learnBlockchain/events"
+)
+
+// Events of the node are kept for a while, clients long-poll for them with
+// waitforevents and pass the seq they got up to, so none are lost between
+// two calls unless a client falls more than historySize events behind.
+
+const (
+	historySize = 1000
+	// Events buffered between the bus and the log
+	eventBuffer = 256
+	// Calls must be answered before the client's callTimeout
+	defaultWait = 20 * time.Second
+	maxWait     = 25 * time.Second
+)
+
+type eventLog struct {
+	mu     sync.Mutex
+	events []EventInfo
+	last   uint64
+	// Events up to this seq are not in the log, dropped or never received
+	lost uint64
+	// Closed and replaced whenever an event is added
+	added chan struct{}
+}
+
+// Log for events after seq
+func newEventLog(seq uint64) *eventLog {
+	return &eventLog{last: seq, lost: seq, added: make(chan struct{})}
+}
+
+func (l *eventLog) add(e EventInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Published before the log started
+	if e.Seq <= l.last {
+		return
+	}
+
+	// The bus dropped some while the log was behind
+	if e.Seq != l.last+1 {
+		l.lost = e.Seq - 1
+	}
+
+	l.events = append(l.events, e)
+	if len(l.events) > historySize {
+		l.lost = l.events[0].Seq
+		l.events = l.events[1:]
+	}
+	l.last = e.Seq
+
+	close(l.added)
+	l.added = make(chan struct{})
+}
+
+func (l *eventLog) seq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.last
+}
+
+// Events after since that match, the last seq in the log, whether events
+// after since are missing and what is closed once more are added
+func (l *eventLog) after(since uint64, match func(EventInfo) bool) ([]EventInfo, uint64, bool, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Seq of an earlier run of the node, which numbered from 1 as well
+	if since > l.last {
+		since = 0
+	}
+
+	matched := []EventInfo{}
+	for _, e := range l.events {
+		if e.Seq > since && match(e) {
+			matched = append(matched, e)
+		}
+	}
+
+	return matched, l.last, since < l.lost, l.added
+}
+
+// Move events from the bus to the log until the server stops
+func (s *Server) logEvents(sub *events.Subscription) {
+	for e := range sub.C {
+		s.events.add(eventInfo(e))
+	}
+}
+
+// [since?, [topic...]?, [address...]?, timeout seconds?] -> Events
+// Waits until there are events after since of the topics, all if none are
+// given. Payment events can be limited to the addresses. Without since only
+// events after the call are returned.
+func (s *Server) waitForEvents(params []json.RawMessage) (interface{}, error) {
+	var since *uint64
+	var topicNames, addresses []string
+	var timeout float64
+	if err := parseParams(params, 0, &since, &topicNames, &addresses, &timeout); err != nil {
+		return nil, err
+	}
+
+	topics := make(map[string]bool)
+	for _, name := range topicNames {
+		if !knownTopic(name) {
+			return nil, invalidParams("unknown topic %q", name)
+		}
+		topics[name] = true
+	}
+
+	watched := make(map[string]bool)
+	for _, address := range addresses {
+		if err := validAddress(address); err != nil {
+			return nil, err
+		}
+		watched[address] = true
+	}
+
+	match := func(e EventInfo) bool {
+		if len(topics) > 0 && !topics[e.Topic] {
+			return false
+		}
+		if e.Payment != nil && len(watched) > 0 && !watched[e.Payment.Address] {
+			return false
+		}
+		return true
+	}
+
+	wait := defaultWait
+	if timeout > 0 {
+		wait = time.Duration(timeout * float64(time.Second))
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	result := Events{}
+	for {
+		if since == nil {
+			last := s.events.seq()
+			since = &last
+		}
+
+		matched, last, missed, added := s.events.after(*since, match)
+		result.Events, result.Next = matched, last
+		result.Missed = result.Missed || missed
+
+		if len(matched) > 0 {
+			return result, nil
+		}
+		// Nothing that matches up to last, no need to look at it again
+		since = &last
+
+		select {
+		case <-added:
+		case <-timer.C:
+			return result, nil
+		case <-s.stopping:
+			return result, nil
+		}
+	}
+}
+
+func knownTopic(name string) bool {
+	for _, topic := range events.Topics {
+		if string(topic) == name {
+			return true
+		}
+	}
+	return false
+}
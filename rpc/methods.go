@@ -0,0 +1,592 @@
+package rpc
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/LidoKing/learnBlockchain/blockchain"
+	"github.com/LidoKing/learnBlockchain/blockchain/wallet"
+	"github.com/LidoKing/learnBlockchain/mempool"
+)
+
+func (s *Server) methodTable() map[string]method {
+	return map[string]method{
+		// Chain
+		"getbestblock":   s.getBestBlock,
+		"getblockhash":   s.getBlockHash,
+		"getblock":       s.getBlock,
+		"gettransaction": s.getTransaction,
+		"getbalance":     s.getBalance,
+		"submitblock":    s.submitBlock,
+		// Mempool
+		"getmempoolinfo":     s.getMempoolInfo,
+		"getrawmempool":      s.getRawMempool,
+		"sendrawtransaction": s.sendRawTransaction,
+		// Wallets
+		"createwallet":  s.createWallet,
+		"listaddresses": s.listAddresses,
+		"sendtoaddress": s.sendToAddress,
+		"sendmany":      s.sendMany,
+		"sweep":         s.sweep,
+		"bumpfee":       s.bumpFee,
+		// Offline signing, the sources of createpsbt need not be our wallets
+		"createpsbt":         s.createPSBT,
+		"signrawtransaction": s.signRawTransaction,
+		// Events, see events.go
+		"waitforevents": s.waitForEvents,
+		// Node
+		"getnodeinfo": s.getNodeInfo,
+		"getpeerinfo": s.getPeerInfo,
+		"stop":        s.stopNode,
+	}
+}
+
+func decodeHash(value string) ([]byte, error) {
+	hash, err := hex.DecodeString(value)
+	if err != nil || len(hash) == 0 {
+		return nil, invalidParams("%q is not a hex hash", value)
+	}
+	return hash, nil
+}
+
+func validAddress(address string) (err error) {
+	// Decoding panics on input that is not base58 or too short
+	defer func() {
+		if recover() != nil {
+			err = invalidParams("address %s is not valid", address)
+		}
+	}()
+
+	if !wallet.ValidateAddress(address) {
+		return invalidParams("address %s is not valid", address)
+	}
+	return nil
+}
+
+/*-------------------------------chain-------------------------------*/
+
+// [] -> BestBlock
+func (s *Server) getBestBlock(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+
+	chain := s.node.Chain()
+	return BestBlock{hex.EncodeToString(chain.LastHash()), chain.GetBestHeight()}, nil
+}
+
+// [height] -> hash of the main chain block at height
+func (s *Server) getBlockHash(params []json.RawMessage) (interface{}, error) {
+	var height int
+	if err := parseParams(params, 1, &height); err != nil {
+		return nil, err
+	}
+
+	hash, err := s.node.Chain().GetHashByHeight(height)
+	if err != nil {
+		return nil, fmt.Errorf("no block at height %d", height)
+	}
+	return hex.EncodeToString(hash), nil
+}
+
+// [hash, verbose?] -> BlockInfo, or the serialized block as hex unless verbose
+func (s *Server) getBlock(params []json.RawMessage) (interface{}, error) {
+	var hashHex string
+	verbose := true
+	if err := parseParams(params, 1, &hashHex, &verbose); err != nil {
+		return nil, err
+	}
+
+	hash, err := decodeHash(hashHex)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := s.node.Chain().GetBlock(hash)
+	if err != nil {
+		return nil, fmt.Errorf("block %s not found", hashHex)
+	}
+
+	if !verbose {
+		return hex.EncodeToString(block.Serialize()), nil
+	}
+	return blockInfo(&block), nil
+}
+
+// [txid] -> TxInfo of a pool or chain tx
+func (s *Server) getTransaction(params []json.RawMessage) (interface{}, error) {
+	var txIDHex string
+	if err := parseParams(params, 1, &txIDHex); err != nil {
+		return nil, err
+	}
+
+	txID, err := decodeHash(txIDHex)
+	if err != nil {
+		return nil, err
+	}
+
+	info, ok := s.findTx(txID)
+	if !ok {
+		return nil, fmt.Errorf("tx %s not found", txIDHex)
+	}
+	return info, nil
+}
+
+// Pool txs are looked up first, the chain is searched block by block
+func (s *Server) findTx(txID []byte) (TxInfo, bool) {
+	if tx, ok := s.node.Pool().Get(txID); ok {
+		info := txInfo(&tx)
+		info.InMempool = true
+		return info, true
+	}
+
+	tx, err := s.node.Chain().FindTransaction(txID)
+	if err != nil {
+		return TxInfo{}, false
+	}
+	return txInfo(&tx), true
+}
+
+// [address] -> confirmed balance
+func (s *Server) getBalance(params []json.RawMessage) (interface{}, error) {
+	var address string
+	if err := parseParams(params, 1, &address); err != nil {
+		return nil, err
+	}
+	if err := validAddress(address); err != nil {
+		return nil, err
+	}
+
+	UTXOSet := blockchain.UTXOSet{Blockchain: s.node.Chain()}
+	balance := 0
+	for _, out := range UTXOSet.FindUTXO(wallet.PubKeyHashFromAddress(address)) {
+		balance += out.Value
+	}
+
+	return balance, nil
+}
+
+// [block hex] -> hash of the block, once it extends the tip
+func (s *Server) submitBlock(params []json.RawMessage) (interface{}, error) {
+	var blockHex string
+	if err := parseParams(params, 1, &blockHex); err != nil {
+		return nil, err
+	}
+
+	data, err := hex.DecodeString(blockHex)
+	if err != nil {
+		return nil, invalidParams("block is not hex: %s", err)
+	}
+	block, err := blockchain.DecodeBlock(data)
+	if err != nil {
+		return nil, invalidParams("malformed block: %s", err)
+	}
+
+	if err := s.node.SubmitBlock(block); err != nil {
+		return nil, err
+	}
+	return hex.EncodeToString(block.Hash), nil
+}
+
+/*-------------------------------mempool-------------------------------*/
+
+// [] -> MempoolInfo
+func (s *Server) getMempoolInfo(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+
+	pool := s.node.Pool()
+	return MempoolInfo{pool.Count(), pool.Size()}, nil
+}
+
+// [] -> IDs of all pool txs
+func (s *Server) getRawMempool(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for id := range s.node.Pool().TxMap() {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// [tx hex] -> txid, the tx goes to the pool and is relayed
+func (s *Server) sendRawTransaction(params []json.RawMessage) (interface{}, error) {
+	var txHex string
+	if err := parseParams(params, 1, &txHex); err != nil {
+		return nil, err
+	}
+
+	tx, err := blockchain.TransactionFromHex(txHex)
+	if err != nil {
+		return nil, invalidParams("malformed tx: %s", err)
+	}
+
+	if err := s.node.SubmitTx(tx); err != nil {
+		return nil, err
+	}
+	return hex.EncodeToString(tx.ID), nil
+}
+
+/*-------------------------------wallets-------------------------------*/
+
+func (s *Server) wallets() (*wallet.Wallets, error) {
+	ws := s.node.Wallets()
+	if ws == nil {
+		return nil, errors.New("node has no wallets")
+	}
+	return ws, nil
+}
+
+// Wallets of addresses, which must all be managed by the node
+func (s *Server) sourceWallets(addresses []string) ([]*wallet.Wallet, error) {
+	ws, err := s.wallets()
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []*wallet.Wallet
+	for _, address := range addresses {
+		if err := validAddress(address); err != nil {
+			return nil, err
+		}
+
+		w, err := ws.GetWallet(address)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, &w)
+	}
+
+	if len(sources) == 0 {
+		return nil, invalidParams("no source addresses given")
+	}
+	return sources, nil
+}
+
+// Pool and relay a tx made by our wallets, and remember it for bumpfee
+func (s *Server) sendWalletTx(tx *blockchain.Transaction) (interface{}, error) {
+	if err := s.node.SubmitTx(tx); err != nil {
+		return nil, err
+	}
+
+	if s.node.ID() != "" {
+		walletTxs, err := blockchain.LoadWalletTxs(s.node.ID())
+		if err != nil {
+			return nil, err
+		}
+		walletTxs.Add(tx)
+		walletTxs.SaveFile(s.node.ID())
+	}
+
+	return hex.EncodeToString(tx.ID), nil
+}
+
+// [n] -> addresses of n new wallets
+func (s *Server) createWallet(params []json.RawMessage) (interface{}, error) {
+	n := 1
+	if err := parseParams(params, 0, &n); err != nil {
+		return nil, err
+	}
+	if n < 1 {
+		return nil, invalidParams("number of wallets must be positive")
+	}
+
+	s.walletMu.Lock()
+	defer s.walletMu.Unlock()
+
+	ws, err := s.wallets()
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	for i := 0; i < n; i++ {
+		addresses = append(addresses, ws.AddWallet())
+	}
+	if s.node.ID() != "" {
+		ws.SaveFile(s.node.ID())
+	}
+
+	return addresses, nil
+}
+
+// [] -> addresses of all wallets
+func (s *Server) listAddresses(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+
+	s.walletMu.Lock()
+	defer s.walletMu.Unlock()
+
+	ws, err := s.wallets()
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := ws.GetAllAddresses()
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+// [from, to, amount, fee?, rbf?] -> txid, change goes back to from
+func (s *Server) sendToAddress(params []json.RawMessage) (interface{}, error) {
+	var from, to string
+	var amount int
+	var opts blockchain.TxOptions
+	if err := parseParams(params, 3, &from, &to, &amount, &opts.Fee, &opts.Replaceable); err != nil {
+		return nil, err
+	}
+
+	return s.send([]string{from}, []blockchain.Payment{{Address: to, Amount: amount}}, "", opts)
+}
+
+// [[from...], [{address, amount}...], change?, fee?, rbf?] -> txid
+func (s *Server) sendMany(params []json.RawMessage) (interface{}, error) {
+	var from []string
+	var payments []blockchain.Payment
+	var change string
+	var opts blockchain.TxOptions
+	if err := parseParams(params, 2, &from, &payments, &change, &opts.Fee, &opts.Replaceable); err != nil {
+		return nil, err
+	}
+
+	return s.send(from, payments, change, opts)
+}
+
+// Change goes to the first source address unless given
+func (s *Server) send(from []string, payments []blockchain.Payment, change string, opts blockchain.TxOptions) (interface{}, error) {
+	if len(payments) == 0 {
+		return nil, invalidParams("no payments given")
+	}
+	for _, p := range payments {
+		if err := validAddress(p.Address); err != nil {
+			return nil, err
+		}
+	}
+
+	s.walletMu.Lock()
+	defer s.walletMu.Unlock()
+
+	sources, err := s.sourceWallets(from)
+	if err != nil {
+		return nil, err
+	}
+	if change == "" {
+		change = from[0]
+	}
+	if err := validAddress(change); err != nil {
+		return nil, err
+	}
+
+	UTXOSet := blockchain.UTXOSet{Blockchain: s.node.Chain()}
+	tx := blockchain.NewMultiSourceTransaction(sources, payments, change, opts, &UTXOSet)
+
+	return s.sendWalletTx(tx)
+}
+
+// [[from...], to, fee?, rbf?] -> txid, all coins of from go to to
+func (s *Server) sweep(params []json.RawMessage) (interface{}, error) {
+	var from []string
+	var to string
+	var opts blockchain.TxOptions
+	if err := parseParams(params, 2, &from, &to, &opts.Fee, &opts.Replaceable); err != nil {
+		return nil, err
+	}
+	if err := validAddress(to); err != nil {
+		return nil, err
+	}
+
+	s.walletMu.Lock()
+	defer s.walletMu.Unlock()
+
+	sources, err := s.sourceWallets(from)
+	if err != nil {
+		return nil, err
+	}
+
+	UTXOSet := blockchain.UTXOSet{Blockchain: s.node.Chain()}
+	tx := blockchain.NewSweepTransaction(sources, to, opts, &UTXOSet)
+
+	return s.sendWalletTx(tx)
+}
+
+// [txid, fee?] -> txid of the replacement, fee 0 bumps by the minimum
+func (s *Server) bumpFee(params []json.RawMessage) (interface{}, error) {
+	var txID string
+	var newFee int
+	if err := parseParams(params, 1, &txID, &newFee); err != nil {
+		return nil, err
+	}
+	if s.node.ID() == "" {
+		return nil, errors.New("node keeps no wallet txs")
+	}
+
+	s.walletMu.Lock()
+	defer s.walletMu.Unlock()
+
+	walletTxs, err := blockchain.LoadWalletTxs(s.node.ID())
+	if err != nil {
+		return nil, err
+	}
+	orig, ok := walletTxs.Get(txID)
+	if !ok {
+		return nil, fmt.Errorf("tx %s was not sent by this node's wallets", txID)
+	}
+
+	ws, err := s.wallets()
+	if err != nil {
+		return nil, err
+	}
+	var keys []*wallet.Wallet
+	for _, w := range ws.Wallets {
+		keys = append(keys, w)
+	}
+
+	prevOutputs, err := s.node.Chain().PrevOutputs(&orig)
+	if err != nil {
+		return nil, err
+	}
+	if newFee == 0 {
+		newFee = orig.Fee(prevOutputs) + mempool.MinReplacementBump
+	}
+
+	tx, err := blockchain.BumpFeeTransaction(&orig, prevOutputs, keys, newFee)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.node.SubmitTx(tx); err != nil {
+		return nil, err
+	}
+
+	walletTxs.Remove(txID)
+	walletTxs.Add(tx)
+	walletTxs.SaveFile(s.node.ID())
+
+	return hex.EncodeToString(tx.ID), nil
+}
+
+/*-------------------------------offline signing-------------------------------*/
+
+// [[from...], [{address, amount}...], change?, fee?, rbf?] -> base64 partially
+// signed tx, change goes to the first source address unless given
+func (s *Server) createPSBT(params []json.RawMessage) (interface{}, error) {
+	var from []string
+	var payments []blockchain.Payment
+	var change string
+	var opts blockchain.TxOptions
+	if err := parseParams(params, 2, &from, &payments, &change, &opts.Fee, &opts.Replaceable); err != nil {
+		return nil, err
+	}
+
+	if len(from) == 0 {
+		return nil, invalidParams("no source addresses given")
+	}
+	if len(payments) == 0 {
+		return nil, invalidParams("no payments given")
+	}
+	if change == "" {
+		change = from[0]
+	}
+
+	addresses := append([]string{change}, from...)
+	for _, p := range payments {
+		addresses = append(addresses, p.Address)
+	}
+	for _, address := range addresses {
+		if err := validAddress(address); err != nil {
+			return nil, err
+		}
+	}
+
+	UTXOSet := blockchain.UTXOSet{Blockchain: s.node.Chain()}
+	psbt := blockchain.CreatePartialTx(from, payments, change, opts, &UTXOSet)
+
+	return psbt.Encode(), nil
+}
+
+// [tx hex] -> SignedTx, inputs spending outputs of our wallets are signed
+func (s *Server) signRawTransaction(params []json.RawMessage) (interface{}, error) {
+	var txHex string
+	if err := parseParams(params, 1, &txHex); err != nil {
+		return nil, err
+	}
+
+	tx, err := blockchain.TransactionFromHex(txHex)
+	if err != nil {
+		return nil, invalidParams("malformed tx: %s", err)
+	}
+
+	prevOutputs, err := s.node.Chain().PrevOutputs(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.walletMu.Lock()
+	defer s.walletMu.Unlock()
+
+	ws, err := s.wallets()
+	if err != nil {
+		return nil, err
+	}
+	var keys []*wallet.Wallet
+	for _, w := range ws.Wallets {
+		keys = append(keys, w)
+	}
+
+	signed := tx.SignWith(keys, prevOutputs)
+	return SignedTx{tx.Hex(), signed, tx.FullySigned(prevOutputs)}, nil
+}
+
+/*-------------------------------node-------------------------------*/
+
+// [] -> NodeInfo
+func (s *Server) getNodeInfo(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+
+	st := s.node.Status()
+	return NodeInfo{
+		Address:   st.Address,
+		PubKey:    st.PubKey,
+		UserAgent: st.UserAgent,
+		Height:    st.Height,
+		Tip:       hex.EncodeToString(st.Tip),
+		Syncing:   st.Syncing,
+		Mempool:   st.MempoolTxs,
+		Peers:     len(st.Peers),
+	}, nil
+}
+
+// [] -> PeerInfo of every handshaked peer
+func (s *Server) getPeerInfo(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+
+	peers := []PeerInfo{}
+	for _, p := range s.node.Status().Peers {
+		peers = append(peers, peerInfo(p))
+	}
+	return peers, nil
+}
+
+// [] -> shuts the node down after answering
+func (s *Server) stopNode(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+
+	go s.stop()
+	return "stopping", nil
+}
@@ -0,0 +1,159 @@
+package rpc
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/LidoKing/learnBlockchain/blockchain"
+	"github.com/LidoKing/learnBlockchain/blockchain/wallet"
+)
+
+// Read-only REST endpoints, served without auth on GET when Config.REST is
+// set. Results use the same JSON as the RPC methods.
+//
+//	/block/<hash>
+//	/block-height/<height>
+//	/tx/<txid>
+//	/address/<address>/utxos
+//	/chaininfo
+
+// Failed request, answered as {"error": message} with status
+type restError struct {
+	status  int
+	message string
+}
+
+func notFound(format string, a ...interface{}) *restError {
+	return &restError{http.StatusNotFound, fmt.Sprintf(format, a...)}
+}
+
+func badRequest(format string, a ...interface{}) *restError {
+	return &restError{http.StatusBadRequest, fmt.Sprintf(format, a...)}
+}
+
+type restHandler func(arg string) (interface{}, *restError)
+
+func (s *Server) restMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/block/", s.restRoute("/block/", s.restBlock))
+	mux.Handle("/block-height/", s.restRoute("/block-height/", s.restBlockHeight))
+	mux.Handle("/tx/", s.restRoute("/tx/", s.restTx))
+	mux.Handle("/address/", s.restRoute("/address/", s.restAddressUTXOs))
+	mux.Handle("/chaininfo", s.restRoute("/chaininfo", s.restChainInfo))
+
+	return mux
+}
+
+// Handler calling h with the rest of the path after prefix
+func (s *Server) restRoute(prefix string, h restHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Lookups panic on a broken database like they do for the CLI
+		defer func() {
+			if r := recover(); r != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprint(r)})
+			}
+		}()
+
+		result, err := h(strings.TrimPrefix(r.URL.Path, prefix))
+		if err != nil {
+			w.WriteHeader(err.status)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.message})
+			return
+		}
+
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+func (s *Server) restBlock(hashHex string) (interface{}, *restError) {
+	hash, err := hex.DecodeString(hashHex)
+	if err != nil || len(hash) == 0 {
+		return nil, badRequest("%q is not a hex hash", hashHex)
+	}
+
+	block, err := s.node.Chain().GetBlock(hash)
+	if err != nil {
+		return nil, notFound("block %s not found", hashHex)
+	}
+	return blockInfo(&block), nil
+}
+
+func (s *Server) restBlockHeight(heightStr string) (interface{}, *restError) {
+	height, err := strconv.Atoi(heightStr)
+	if err != nil || height < 0 {
+		return nil, badRequest("%q is not a height", heightStr)
+	}
+
+	block, err := s.node.Chain().GetBlockByHeight(height)
+	if err != nil {
+		return nil, notFound("no block at height %d", height)
+	}
+	return blockInfo(&block), nil
+}
+
+func (s *Server) restTx(txIDHex string) (interface{}, *restError) {
+	txID, err := hex.DecodeString(txIDHex)
+	if err != nil || len(txID) == 0 {
+		return nil, badRequest("%q is not a hex tx ID", txIDHex)
+	}
+
+	info, ok := s.findTx(txID)
+	if !ok {
+		return nil, notFound("tx %s not found", txIDHex)
+	}
+	return info, nil
+}
+
+// Confirmed unspent outputs of the address, ordered by txid and index
+func (s *Server) restAddressUTXOs(path string) (interface{}, *restError) {
+	address := strings.TrimSuffix(path, "/utxos")
+	if address == path || strings.Contains(address, "/") {
+		return nil, notFound("unknown path")
+	}
+	if validAddress(address) != nil {
+		return nil, badRequest("address %s is not valid", address)
+	}
+
+	UTXOSet := blockchain.UTXOSet{Blockchain: s.node.Chain()}
+	pubKeyHash := wallet.PubKeyHashFromAddress(address)
+	_, outpoints := UTXOSet.FindAllSpendableOutputs(pubKeyHash)
+
+	utxos := []UTXOInfo{}
+	for txIDHex, outs := range outpoints {
+		txID, _ := hex.DecodeString(txIDHex)
+		for _, out := range outs {
+			if output, ok := UTXOSet.FindUnspentOutput(txID, out); ok {
+				utxos = append(utxos, UTXOInfo{txIDHex, out, output.Value, address})
+			}
+		}
+	}
+
+	sort.Slice(utxos, func(i, j int) bool {
+		if utxos[i].TxID != utxos[j].TxID {
+			return utxos[i].TxID < utxos[j].TxID
+		}
+		return utxos[i].Out < utxos[j].Out
+	})
+
+	return utxos, nil
+}
+
+func (s *Server) restChainInfo(string) (interface{}, *restError) {
+	st := s.node.Status()
+	return ChainInfo{
+		Height:     st.Height,
+		BestBlock:  hex.EncodeToString(st.Tip),
+		Difficulty: blockchain.Difficulty,
+		Syncing:    st.Syncing,
+		Mempool:    st.MempoolTxs,
+		Peers:      len(st.Peers),
+	}, nil
+}
@@ -0,0 +1,298 @@
+// Package rpc serves JSON-RPC 2.0 over HTTP for a running node, so that
+// wallets, CLI commands and other programs can use its chain, mempool and
+// wallets without opening the database, which the node holds locked.
+//
+// Calls are POSTed with basic auth. Unless a password is configured a new
+// one is made on every start. Either way it is written with the URL to a
+// file in the data dir that only the owner can read, which is how local CLI
+// commands find the node, see Dial().
+//
+// GET requests go to the read-only REST endpoints in rest.go if they are on.
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/LidoKing/learnBlockchain/network"
+)
+
+type Config struct {
+	// Port 0 picks a free one
+	Listen   string
+	User     string
+	Password string
+	// Also serve the read-only REST endpoints in rest.go, without auth
+	REST bool
+}
+
+var DefaultConfig = Config{
+	Listen: "localhost:0",
+	User:   "rpc",
+}
+
+const (
+	infoFile        = "./tmp/rpc_%s.json"
+	maxRequestSize  = 4 << 20
+	shutdownTimeout = 5 * time.Second
+)
+
+// Where a node serves RPC and the credentials, as written to infoFile
+type Info struct {
+	URL      string `json:"url"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+type request struct {
+	JSONRPC string            `json:"jsonrpc"`
+	ID      json.RawMessage   `json:"id"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// Error codes of the JSON-RPC 2.0 spec, failures of the call itself get
+// codeFailed
+const (
+	codeParse          = -32700
+	codeInvalidRequest = -32600
+	codeNoMethod       = -32601
+	codeInvalidParams  = -32602
+	codeInternal       = -32603
+	codeFailed         = -1
+)
+
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+func invalidParams(format string, a ...interface{}) *Error {
+	return &Error{codeInvalidParams, fmt.Sprintf(format, a...)}
+}
+
+type method func(params []json.RawMessage) (interface{}, error)
+
+// Serves the calls in methods.go for node
+type Server struct {
+	cfg  Config
+	node *network.Node
+	// Called by the stop method
+	stop func()
+	info Info
+
+	// Calls changing wallets or wallet txs run one at a time
+	walletMu sync.Mutex
+	methods  map[string]method
+
+	rest   *http.ServeMux
+	events *eventLog
+
+	srv *http.Server
+	// Closed when shutdown begins, ends calls waiting for events
+	stopping chan struct{}
+	done     chan struct{}
+}
+
+// Server for node, stop is what the stop method calls to shut the node down
+func NewServer(cfg Config, node *network.Node, stop func()) *Server {
+	s := &Server{
+		cfg:      cfg,
+		node:     node,
+		stop:     stop,
+		stopping: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	s.methods = s.methodTable()
+	s.rest = s.restMux()
+	s.srv = &http.Server{Handler: s}
+
+	return s
+}
+
+// Listen and serve until ctx is done
+func (s *Server) Start(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.cfg.Listen)
+	if err != nil {
+		return err
+	}
+
+	password := s.cfg.Password
+	if password == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			ln.Close()
+			return err
+		}
+		password = hex.EncodeToString(key)
+	}
+
+	// Clients on this machine dial localhost for a server on all interfaces
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	s.info = Info{"http://" + net.JoinHostPort(host, port), s.cfg.User, password}
+
+	if err := s.writeInfo(); err != nil {
+		ln.Close()
+		return err
+	}
+
+	sub := s.node.Events().Subscribe(eventBuffer)
+	s.events = newEventLog(s.node.Events().Seq())
+	go s.logEvents(sub)
+
+	go s.srv.Serve(ln)
+	fmt.Printf("Serving RPC at %s\n", s.info.URL)
+
+	go func() {
+		<-ctx.Done()
+		close(s.stopping)
+		sub.Unsubscribe()
+
+		// Calls being answered get to finish
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		s.srv.Shutdown(shutdownCtx)
+
+		s.removeInfo()
+		close(s.done)
+	}()
+
+	return nil
+}
+
+// Closed once the server has shut down
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// Only the owner may read the credentials, nodes without an ID have no
+// data dir and no file
+func (s *Server) writeInfo() error {
+	if s.node.ID() == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(s.info)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fmt.Sprintf(infoFile, s.node.ID()), data, 0600)
+}
+
+func (s *Server) removeInfo() {
+	if s.node.ID() != "" {
+		os.Remove(fmt.Sprintf(infoFile, s.node.ID()))
+	}
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(s.info.User)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(s.info.Password)) == 1
+	return userOK && passwordOK
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && s.cfg.REST {
+		s.rest.ServeHTTP(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "JSON-RPC calls are POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="rpc"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req request
+	resp := response{JSONRPC: "2.0"}
+
+	body := http.MaxBytesReader(w, r.Body, maxRequestSize)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		resp.Error = &Error{codeParse, err.Error()}
+	} else {
+		resp.ID = req.ID
+		resp.Result, resp.Error = s.call(req)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Run the method of req, chain and wallet code panics on bad input, which
+// ends only the call
+func (s *Server) call(req request) (result interface{}, rpcErr *Error) {
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return nil, &Error{codeInvalidRequest, "not a JSON-RPC 2.0 request"}
+	}
+
+	m, ok := s.methods[req.Method]
+	if !ok {
+		return nil, &Error{codeNoMethod, fmt.Sprintf("unknown method %q", req.Method)}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			result, rpcErr = nil, &Error{codeInternal, fmt.Sprint(r)}
+		}
+	}()
+
+	result, err := m(req.Params)
+	if err != nil {
+		if e, ok := err.(*Error); ok {
+			return nil, e
+		}
+		return nil, &Error{codeFailed, err.Error()}
+	}
+
+	return result, nil
+}
+
+// Decode positional params into dst, the first required ones must be given
+func parseParams(params []json.RawMessage, required int, dst ...interface{}) error {
+	if len(params) < required || len(params) > len(dst) {
+		return invalidParams("expected %d to %d params, got %d", required, len(dst), len(params))
+	}
+
+	for i, raw := range params {
+		if err := json.Unmarshal(raw, dst[i]); err != nil {
+			return invalidParams("param %d: %s", i+1, err)
+		}
+	}
+
+	return nil
+}
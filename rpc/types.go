@@ -0,0 +1,203 @@
+package rpc
+
+import (
+	"encoding/hex"
+
+	"github.com/LidoKing/learnBlockchain/blockchain"
+	"github.com/LidoKing/learnBlockchain/blockchain/wallet"
+	"github.com/LidoKing/learnBlockchain/events"
+	"github.com/LidoKing/learnBlockchain/network"
+)
+
+// Results as they are sent, hashes and tx IDs are hex and addresses base58
+
+type BlockInfo struct {
+	Hash      string   `json:"hash"`
+	PrevHash  string   `json:"prevhash"`
+	Height    int      `json:"height"`
+	Timestamp int64    `json:"time"`
+	Nonce     int      `json:"nonce"`
+	Txs       []TxInfo `json:"tx"`
+}
+
+type TxInfo struct {
+	ID          string       `json:"txid"`
+	Coinbase    bool         `json:"coinbase"`
+	Replaceable bool         `json:"replaceable"`
+	Inputs      []InputInfo  `json:"vin"`
+	Outputs     []OutputInfo `json:"vout"`
+	// Set by gettransaction only
+	InMempool bool `json:"inmempool,omitempty"`
+}
+
+type InputInfo struct {
+	TxID string `json:"txid"`
+	Out  int    `json:"vout"`
+	// Owner of the spent output, empty for coinbase and unsigned inputs
+	Address string `json:"address,omitempty"`
+}
+
+type OutputInfo struct {
+	Value   int    `json:"value"`
+	Address string `json:"address"`
+}
+
+type UTXOInfo struct {
+	TxID    string `json:"txid"`
+	Out     int    `json:"vout"`
+	Value   int    `json:"value"`
+	Address string `json:"address"`
+}
+
+type ChainInfo struct {
+	Height     int    `json:"height"`
+	BestBlock  string `json:"bestblock"`
+	Difficulty int    `json:"difficulty"`
+	Syncing    bool   `json:"syncing"`
+	Mempool    int    `json:"mempool"`
+	Peers      int    `json:"peers"`
+}
+
+type EventInfo struct {
+	Seq   uint64 `json:"seq"`
+	Topic string `json:"topic"`
+	Time  int64  `json:"time"`
+	// Block of block and tip events, and of payments that were mined
+	Block *BlockRef `json:"block,omitempty"`
+	// Tx of tx events
+	Tx      *TxInfo      `json:"tx,omitempty"`
+	Payment *PaymentInfo `json:"payment,omitempty"`
+}
+
+type BlockRef struct {
+	Hash      string `json:"hash"`
+	PrevHash  string `json:"prevhash"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"time"`
+}
+
+type PaymentInfo struct {
+	Address   string `json:"address"`
+	TxID      string `json:"txid"`
+	Out       int    `json:"vout"`
+	Value     int    `json:"value"`
+	Confirmed bool   `json:"confirmed"`
+}
+
+// Result of waitforevents
+type Events struct {
+	Events []EventInfo `json:"events"`
+	// Seq to wait for events after in the next call
+	Next uint64 `json:"next"`
+	// Some events after the seq waited for are no longer kept
+	Missed bool `json:"missed"`
+}
+
+type BestBlock struct {
+	Hash   string `json:"hash"`
+	Height int    `json:"height"`
+}
+
+// Result of signrawtransaction
+type SignedTx struct {
+	Hex string `json:"hex"`
+	// Inputs signed by the call
+	Signed   int  `json:"signed"`
+	Complete bool `json:"complete"`
+}
+
+type MempoolInfo struct {
+	Size  int `json:"size"`
+	Bytes int `json:"bytes"`
+}
+
+type PeerInfo struct {
+	Addr        string `json:"addr"`
+	PubKey      string `json:"pubkey,omitempty"`
+	Inbound     bool   `json:"inbound"`
+	Version     int    `json:"version"`
+	Services    uint64 `json:"services"`
+	UserAgent   string `json:"useragent"`
+	StartHeight int    `json:"startheight"`
+}
+
+type NodeInfo struct {
+	Address   string `json:"address"`
+	PubKey    string `json:"pubkey"`
+	UserAgent string `json:"useragent"`
+	Height    int    `json:"height"`
+	Tip       string `json:"tip"`
+	Syncing   bool   `json:"syncing"`
+	Mempool   int    `json:"mempool"`
+	Peers     int    `json:"peers"`
+}
+
+func blockInfo(block *blockchain.Block) BlockInfo {
+	info := BlockInfo{
+		Hash:      hex.EncodeToString(block.Hash),
+		PrevHash:  hex.EncodeToString(block.PrevHash),
+		Height:    block.Height,
+		Timestamp: block.Timestamp,
+		Nonce:     block.Nonce,
+	}
+
+	for _, tx := range block.Transactions {
+		info.Txs = append(info.Txs, txInfo(tx))
+	}
+
+	return info
+}
+
+func txInfo(tx *blockchain.Transaction) TxInfo {
+	info := TxInfo{
+		ID:          hex.EncodeToString(tx.ID),
+		Coinbase:    tx.IsCoinbase(),
+		Replaceable: tx.Replaceable,
+	}
+
+	for _, in := range tx.Inputs {
+		input := InputInfo{TxID: hex.EncodeToString(in.ID), Out: in.Out}
+		if !info.Coinbase && len(in.PubKey) > 0 {
+			input.Address = wallet.AddressFromPubKeyHash(wallet.PublicKeyHash(in.PubKey))
+		}
+		info.Inputs = append(info.Inputs, input)
+	}
+
+	for _, out := range tx.Outputs {
+		info.Outputs = append(info.Outputs, OutputInfo{out.Value, wallet.AddressFromPubKeyHash(out.PubKeyHash)})
+	}
+
+	return info
+}
+
+func eventInfo(e events.Event) EventInfo {
+	info := EventInfo{Seq: e.Seq, Topic: string(e.Topic), Time: e.Time.Unix()}
+
+	if e.Block != nil {
+		info.Block = &BlockRef{
+			Hash:      hex.EncodeToString(e.Block.Hash),
+			PrevHash:  hex.EncodeToString(e.Block.PrevHash),
+			Height:    e.Block.Height,
+			Timestamp: e.Block.Timestamp,
+		}
+	}
+
+	if e.Payment != nil {
+		info.Payment = &PaymentInfo{
+			Address:   e.Payment.Address,
+			TxID:      hex.EncodeToString(e.Tx.ID),
+			Out:       e.Payment.Out,
+			Value:     e.Payment.Value,
+			Confirmed: e.Block != nil,
+		}
+	} else if e.Tx != nil {
+		tx := txInfo(e.Tx)
+		info.Tx = &tx
+	}
+
+	return info
+}
+
+func peerInfo(p network.PeerStatus) PeerInfo {
+	return PeerInfo{p.Addr, p.PubKey, p.Inbound, p.Version, p.Services, p.UserAgent, p.StartHeight}
+}